@@ -1,23 +1,16 @@
 package main_test
 
 import (
-	"os"
-	"path/filepath"
 	"runtime"
-	"strings"
 	"testing"
 	"time"
 
-	"code.cloudfoundry.org/buildpackapplifecycle/test_helpers"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
 )
 
-var (
-	builderPath string
-	tarPath     string
-)
+var builderPath string
 
 func TestBuildpackLifecycleBuilder(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -27,19 +20,13 @@ func TestBuildpackLifecycleBuilder(t *testing.T) {
 var _ = SynchronizedBeforeSuite(func() []byte {
 
 	var builderArgs []string
-	var discoveredTarPath string
 	if runtime.GOOS == "windows" {
 		builderArgs = []string{"-tags=windows2012R2"}
-		discoveredTarPath = test_helpers.DownloadOrFindWindowsTar()
 	}
 
-	builder := buildBuilder(builderArgs)
-
-	return []byte(builder + "^" + discoveredTarPath)
-}, func(exePaths []byte) {
-	paths := strings.Split(string(exePaths), "^")
-	builderPath = paths[0]
-	tarPath = paths[1]
+	return []byte(buildBuilder(builderArgs))
+}, func(exePath []byte) {
+	builderPath = string(exePath)
 
 	SetDefaultEventuallyTimeout(10 * time.Second)
 })
@@ -48,7 +35,4 @@ var _ = SynchronizedAfterSuite(func() {
 	//noop
 }, func() {
 	gexec.CleanupBuildArtifacts()
-	if test_helpers.GetWindowsTarURL() != "" {
-		Expect(os.RemoveAll(filepath.Dir(tarPath))).To(Succeed())
-	}
 })
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -20,7 +21,6 @@ import (
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
-	"code.cloudfoundry.org/buildpackapplifecycle/test_helpers"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -37,12 +37,15 @@ var _ = Describe("Building", func() {
 		tmpDir                    string
 		buildDir                  string
 		buildpacksDir             string
+		buildpacksDownloadDir     string
 		outputDroplet             string
 		buildpackOrder            string
 		buildArtifactsCacheDir    string
 		outputMetadata            string
+		outputDropletManifest     string
 		outputBuildArtifactsCache string
 		skipDetect                bool
+		detectConcurrency         int
 
 		sessionEnv []string
 	)
@@ -71,13 +74,11 @@ var _ = Describe("Building", func() {
 		buildDir, err = os.MkdirTemp(tmpDir, "building-app")
 		Expect(err).NotTo(HaveOccurred())
 
-		if runtime.GOOS == "windows" {
-			test_helpers.CopyFile(tarPath, filepath.Join(tmpDir, "tmp", "lifecycle", "tar.exe"))
-		}
-
 		buildpacksDir, err = os.MkdirTemp(tmpDir, "building-buildpacks")
 		Expect(err).NotTo(HaveOccurred())
 
+		buildpacksDownloadDir = filepath.Join(tmpDir, "building-buildpack-downloads")
+
 		outputDropletFile, err := os.CreateTemp(tmpDir, "building-droplet")
 		Expect(err).NotTo(HaveOccurred())
 		outputDroplet = outputDropletFile.Name()
@@ -95,9 +96,12 @@ var _ = Describe("Building", func() {
 		outputMetadata = outputMetadataFile.Name()
 		Expect(outputMetadataFile.Close()).To(Succeed())
 
+		outputDropletManifest = filepath.Join(tmpDir, "droplet-manifest.json")
+
 		buildpackOrder = ""
 
 		skipDetect = false
+		detectConcurrency = 1
 
 		sessionEnv = append(os.Environ(), "TEST_CREDENTIAL_FILTER_WHITELIST=DATABASE_URL,VCAP_SERVICES", "TMPDIR="+tmpDir)
 	})
@@ -110,13 +114,16 @@ var _ = Describe("Building", func() {
 		builderCmd = exec.Command(builderPath,
 			"-buildDir", buildDir,
 			"-buildpacksDir", buildpacksDir,
+			"-buildpacksDownloadDir", buildpacksDownloadDir,
 			"-outputDroplet", outputDroplet,
 			"-outputBuildArtifactsCache", outputBuildArtifactsCache,
 			"-buildArtifactsCacheDir", buildArtifactsCacheDir,
 			"-buildpackOrder", buildpackOrder,
 			"-outputMetadata", outputMetadata,
+			"-outputDropletManifest", outputDropletManifest,
 			"-skipDetect="+strconv.FormatBool(skipDetect),
 			"-credhubRetryDelay=0s",
+			"-detectConcurrency="+strconv.Itoa(detectConcurrency),
 		)
 
 		builderCmd.Env = sessionEnv
@@ -423,6 +430,90 @@ var _ = Describe("Building", func() {
 
 		})
 
+		Context("when detect runs concurrently", func() {
+			BeforeEach(func() {
+				buildpackOrder = "always-fails-detect,also-always-detects,always-detects"
+				detectConcurrency = 3
+
+				cpBuildpack("always-fails-detect")
+			})
+
+			It("chooses the first passing buildpack in the buildpack order", func() {
+				data := &struct {
+					LifeCycle struct {
+						Key string `json:"buildpack_key"`
+					} `json:"lifecycle_metadata"`
+				}{}
+				Expect(json.Unmarshal(resultJSON(), data)).To(Succeed())
+
+				Expect(data.LifeCycle.Key).To(Equal("also-always-detects"))
+			})
+
+			It("uses the detect output of the chosen buildpack", func() {
+				stagingInfo, err := exec.Command("tar", "-xzf", outputDroplet, "-O", fmt.Sprintf("./%s", buildpackrunner.DeaStagingInfoFilename)).Output()
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(stagingInfo)).To(ContainSubstring(`"detected_buildpack":"Also Always Matching"`))
+			})
+
+			Context("and the detect scripts are slow", func() {
+				writeDetect := func(buildpack, script string) {
+					binDir := filepath.Join(buildpacksDir, buildpackHash(buildpack), "bin")
+					Expect(os.MkdirAll(binDir, 0755)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(binDir, "detect"), []byte("#!/bin/bash\n"+script), 0755)).To(Succeed())
+				}
+
+				BeforeEach(func() {
+					if runtime.GOOS == "windows" {
+						Skip("the detect scripts are shell scripts")
+					}
+				})
+
+				Context("and print while they run", func() {
+					BeforeEach(func() {
+						writeDetect("always-fails-detect", "echo first-starts >&2\nsleep 0.5\necho first-ends >&2\nexit 1\n")
+						writeDetect("also-always-detects", "echo second-starts >&2\nsleep 0.1\necho second-ends >&2\necho Also Always Matching\n")
+					})
+
+					It("prints the output of each script whole, in the buildpack order", func() {
+						Expect(session.Err).To(gbytes.Say("first-starts\nfirst-ends\n"))
+						Expect(session.Err).To(gbytes.Say("second-starts\nsecond-ends\n"))
+					})
+				})
+
+				Context("and there are more of them than may run at once", func() {
+					var runningDir string
+
+					BeforeEach(func() {
+						buildpackOrder = "slow-1,slow-2,slow-3,slow-4,also-always-detects"
+						detectConcurrency = 2
+
+						runningDir = filepath.Join(tmpDir, "running")
+						Expect(os.MkdirAll(runningDir, 0755)).To(Succeed())
+						for _, buildpack := range []string{"slow-1", "slow-2", "slow-3", "slow-4"} {
+							writeDetect(buildpack, fmt.Sprintf("touch %[1]s/$$\nls %[1]s | wc -l >> %[1]s.log\nsleep 0.3\nrm %[1]s/$$\nexit 1\n", runningDir))
+						}
+					})
+
+					It("runs no more of them at the same time than the concurrency allows", func() {
+						contents, err := os.ReadFile(runningDir + ".log")
+						Expect(err).NotTo(HaveOccurred())
+
+						counts := strings.Fields(string(contents))
+						Expect(counts).To(HaveLen(4))
+
+						peak := 0
+						for _, count := range counts {
+							running, err := strconv.Atoi(count)
+							Expect(err).NotTo(HaveOccurred())
+							peak = max(peak, running)
+						}
+						Expect(peak).To(Equal(2))
+					})
+				})
+			})
+		})
+
 		Describe("the contents of the output tgz", func() {
 			var files []string
 
@@ -457,6 +548,29 @@ var _ = Describe("Building", func() {
 				Expect(string(stagingInfo)).To(MatchJSON(expectedYAML))
 			})
 
+			It("should list every file of the droplet in the droplet manifest", func() {
+				contents, err := os.ReadFile(outputDropletManifest)
+				Expect(err).NotTo(HaveOccurred())
+
+				var manifest buildpackapplifecycle.DropletManifest
+				Expect(json.Unmarshal(contents, &manifest)).To(Succeed())
+				Expect(manifest.Digest).To(HavePrefix("sha256:"))
+
+				manifestPaths := []string{}
+				for _, file := range manifest.Files {
+					manifestPaths = append(manifestPaths, "./"+file.Path)
+					Expect(file.SHA256).To(HaveLen(64))
+				}
+
+				dropletFiles := []string{}
+				for _, file := range files {
+					if file != "" && !strings.HasSuffix(file, "/") {
+						dropletFiles = append(dropletFiles, file)
+					}
+				}
+				Expect(manifestPaths).To(ConsistOf(dropletFiles))
+			})
+
 			Context("buildpack with supply/finalize", func() {
 				BeforeEach(func() {
 					buildpackOrder = "has-finalize,always-detects,also-always-detects"
@@ -501,6 +615,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 								{"key": "always-detects", "name": "Always Matching"}
 							]
@@ -508,7 +623,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "the start command"
+            		"command": "the start command",
+            		"source": {"kind": "release", "buildpack": "always-detects"}
           		}
         		],
 						"execution_metadata": ""
@@ -527,6 +643,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 								{ "key": "always-detects", "name": "Always Matching" }
 							]
@@ -534,7 +651,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "procfile-provided start-command"
+            		"command": "procfile-provided start-command",
+            		"source": {"kind": "Procfile", "replaced": {"kind": "release", "buildpack": "always-detects"}}
           		}
         		],
 						"execution_metadata": ""
@@ -554,6 +672,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 								{ "key": "always-detects", "name": "Always Matching" }
 							]
@@ -561,7 +680,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "the start command"
+            		"command": "the start command",
+            		"source": {"kind": "release", "buildpack": "always-detects"}
           		}
         		],
 						"execution_metadata": ""
@@ -571,6 +691,238 @@ var _ = Describe("Building", func() {
 		})
 	})
 
+	Describe("plan mode", func() {
+		var session *gexec.Session
+
+		readPlan := func() buildpackrunner.Plan {
+			var plan buildpackrunner.Plan
+			Expect(json.Unmarshal(session.Out.Contents(), &plan)).To(Succeed())
+			return plan
+		}
+
+		stepsOf := func(plan buildpackrunner.Plan) []string {
+			steps := []string{}
+			for _, step := range plan.Steps {
+				steps = append(steps, step.Step+" "+step.Buildpack)
+			}
+			return steps
+		}
+
+		BeforeEach(func() {
+			skipDetect = true
+		})
+
+		JustBeforeEach(func() {
+			builderCmd.Args = append(builderCmd.Args, "-plan")
+			session = builder()
+		})
+
+		Context("with a valid multi-buildpack order", func() {
+			BeforeEach(func() {
+				buildpackOrder = "always-detects,has-finalize"
+				cpBuildpack("always-detects")
+				cpBuildpack("has-finalize")
+			})
+
+			It("prints the scripts that would run without running them", func() {
+				Eventually(session).Should(gexec.Exit(0))
+
+				plan := readPlan()
+				Expect(plan.Errors).To(BeEmpty())
+				Expect(stepsOf(plan)).To(Equal([]string{
+					"supply always-detects",
+					"supply has-finalize",
+					"finalize has-finalize",
+					"release has-finalize",
+				}))
+
+				Expect(plan.Steps[0].Script).To(Equal(filepath.Join(buildpacksDir, buildpackHash("always-detects"), "bin", "supply")))
+				Expect(plan.Steps[0].Args).To(Equal([]string{buildDir, plan.Steps[0].CacheDir, buildpackrunner.PlanDepsDir, "0"}))
+				Expect(plan.Steps[2].Args).To(Equal([]string{buildDir, filepath.Join(buildArtifactsCacheDir, "final"), buildpackrunner.PlanDepsDir, "1", buildpackrunner.PlanProfileDir}))
+				Expect(plan.Steps[3].Condition).NotTo(BeEmpty())
+
+				Expect(filepath.Join(buildDir, "finalized")).NotTo(BeAnExistingFile())
+				droplet, err := os.Stat(outputDroplet)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(droplet.Size()).To(BeZero())
+			})
+		})
+
+		Context("when a supply buildpack has no supply script", func() {
+			BeforeEach(func() {
+				buildpackOrder = "has-finalize-no-supply,always-detects"
+				cpBuildpack("has-finalize-no-supply")
+				cpBuildpack("always-detects")
+			})
+
+			It("reports the problems and fails", func() {
+				Eventually(session).Should(gexec.Exit(1))
+
+				plan := readPlan()
+				Expect(plan.Errors).To(ConsistOf("has-finalize-no-supply: " + buildpackapplifecycle.NoSupplyScriptFailMsg))
+				Expect(plan.Warnings).To(ConsistOf("always-detects: " + buildpackapplifecycle.MissingFinalizeWarnMsg))
+				Expect(stepsOf(plan)).To(Equal([]string{
+					"supply has-finalize-no-supply",
+					"compile always-detects",
+					"release always-detects",
+				}))
+			})
+		})
+	})
+
+	Describe("buildpack urls with credentials", func() {
+		var (
+			session *gexec.Session
+			server  *ghttp.Server
+		)
+
+		BeforeEach(func() {
+			skipDetect = true
+			server = ghttp.NewServer()
+			server.RouteToHandler("GET", "/buildpack.zip", ghttp.RespondWith(http.StatusForbidden, ""))
+
+			buildpackOrder = strings.Replace(server.URL(), "http://", "http://user:s3cr3t-token@", 1) + "/buildpack.zip"
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		JustBeforeEach(func() {
+			session = builder()
+			Eventually(session, 10*time.Second).Should(gexec.Exit())
+		})
+
+		It("redacts them from the output", func() {
+			Expect(session.ExitCode()).NotTo(BeZero())
+			Expect(session.Err).To(gbytes.Say(`Failed to download buildpack 'http://\*\*\*@`))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("s3cr3t-token"))
+			Expect(string(session.Err.Contents())).NotTo(ContainSubstring("s3cr3t-token"))
+		})
+	})
+
+	Describe("downloading several buildpacks", func() {
+		var (
+			session *gexec.Session
+			server  *ghttp.Server
+		)
+
+		BeforeEach(func() {
+			skipDetect = true
+
+			tarball := filepath.Join(tmpDir, "buildpack.tgz")
+			Expect(exec.Command("tar", "-czf", tarball, "-C", filepath.Join(buildpackFixtures, "always-detects"), ".").Run()).To(Succeed())
+			contents, err := os.ReadFile(tarball)
+			Expect(err).NotTo(HaveOccurred())
+
+			server = ghttp.NewServer()
+			server.RouteToHandler("GET", "/slow.tgz", func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				w.Write(contents)
+			})
+			server.RouteToHandler("GET", "/fast.tgz", ghttp.RespondWith(http.StatusOK, contents))
+			server.RouteToHandler("GET", "/slow-missing.tgz", func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				w.WriteHeader(http.StatusNotFound)
+			})
+			server.RouteToHandler("GET", "/missing.tgz", ghttp.RespondWith(http.StatusNotFound, ""))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		JustBeforeEach(func() {
+			session = builder()
+			Eventually(session, 10*time.Second).Should(gexec.Exit())
+		})
+
+		Context("when they all download", func() {
+			BeforeEach(func() {
+				buildpackOrder = server.URL() + "/slow.tgz," + server.URL() + "/fast.tgz"
+			})
+
+			It("reports them in the buildpack order", func() {
+				Expect(session.ExitCode()).To(BeZero())
+				Expect(session.Out).To(gbytes.Say("Downloaded buildpack `" + server.URL() + "/slow.tgz`"))
+				Expect(session.Out).To(gbytes.Say("Downloaded buildpack `" + server.URL() + "/fast.tgz`"))
+			})
+		})
+
+		Context("when several fail", func() {
+			BeforeEach(func() {
+				buildpackOrder = server.URL() + "/slow-missing.tgz," + server.URL() + "/fast.tgz," + server.URL() + "/missing.tgz"
+			})
+
+			It("reports every failure in the buildpack order", func() {
+				Expect(session.ExitCode()).NotTo(BeZero())
+				Expect(session.Err).To(gbytes.Say("Failed to download buildpack '" + server.URL() + "/slow-missing.tgz'"))
+				Expect(session.Err).To(gbytes.Say("Failed to download buildpack '" + server.URL() + "/missing.tgz'"))
+			})
+		})
+	})
+
+	Describe("config file", func() {
+		var (
+			session    *gexec.Session
+			configFile string
+			config     string
+		)
+
+		BeforeEach(func() {
+			skipDetect = true
+			buildpackOrder = "always-detects"
+			cpBuildpack("always-detects")
+
+			configFile = filepath.Join(tmpDir, "builder.yml")
+		})
+
+		JustBeforeEach(func() {
+			Expect(os.WriteFile(configFile, []byte(config), 0644)).To(Succeed())
+			builderCmd.Args = append(builderCmd.Args, "-config", configFile, "-plan")
+			session = builder()
+		})
+
+		Context("with per-buildpack settings", func() {
+			BeforeEach(func() {
+				config = `
+version: 1
+releaseTimeout: 5m
+buildpacks:
+- name: always-detects
+  timeout: 42s
+`
+			})
+
+			It("applies them to the buildpack's scripts", func() {
+				Eventually(session).Should(gexec.Exit(0))
+
+				var plan buildpackrunner.Plan
+				Expect(json.Unmarshal(session.Out.Contents(), &plan)).To(Succeed())
+				Expect(plan.Steps).NotTo(BeEmpty())
+				for _, step := range plan.Steps {
+					Expect(step.Timeout).To(Equal("42s"))
+				}
+			})
+		})
+
+		Context("when the file has an invalid buildpack entry", func() {
+			BeforeEach(func() {
+				config = `
+version: 1
+buildpacks:
+- name: always-detects
+  timeout: soon
+`
+			})
+
+			It("points at the offending key", func() {
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say(`invalid config key: buildpacks\[0\]\.timeout`))
+			})
+		})
+	})
+
 	Context("skip detect", func() {
 		BeforeEach(func() {
 			skipDetect = true
@@ -603,6 +955,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 								{ "key": "always-detects", "name": "" }
 						  ]
@@ -610,7 +963,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "the start command"
+            		"command": "the start command",
+            		"source": {"kind": "release", "buildpack": "always-detects"}
           		}
         		],
 						"execution_metadata": ""
@@ -618,6 +972,82 @@ var _ = Describe("Building", func() {
 				})
 			})
 
+			Context("with a tarball buildpack", func() {
+				var server *ghttp.Server
+
+				BeforeEach(func() {
+					tarball := filepath.Join(tmpDir, "buildpack.tgz")
+					Expect(exec.Command("tar", "-czf", tarball, "-C", filepath.Join(buildpackFixtures, "always-detects"), ".").Run()).To(Succeed())
+					contents, err := os.ReadFile(tarball)
+					Expect(err).NotTo(HaveOccurred())
+
+					server = ghttp.NewServer()
+					server.RouteToHandler("GET", "/buildpack.tgz", ghttp.RespondWith(http.StatusOK, contents))
+
+					buildpackOrder = server.URL() + "/buildpack.tgz"
+					cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+				})
+
+				AfterEach(func() {
+					server.Close()
+				})
+
+				It("stages with the extracted buildpack", func() {
+					Expect(files).To(ContainElement("./staging_info.yml"))
+					Expect(resultJSON()).To(ContainSubstring(`"buildpack_key":"` + buildpackOrder + `"`))
+				})
+			})
+
+			Context("with a local directory buildpack", func() {
+				BeforeEach(func() {
+					buildpackDir, err := filepath.Abs(filepath.Join(buildpackFixtures, "always-detects"))
+					Expect(err).NotTo(HaveOccurred())
+					buildpackOrder = (&url.URL{Scheme: "file", Path: filepath.ToSlash(buildpackDir)}).String()
+					cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+				})
+
+				It("stages with a copy of the directory", func() {
+					Expect(files).To(ContainElement("./staging_info.yml"))
+					Expect(resultJSON()).To(ContainSubstring(`"buildpack_key":"` + buildpackOrder + `"`))
+				})
+			})
+
+			Context("with a git buildpack pinned to a commit and path", func() {
+				var commit string
+
+				BeforeEach(func() {
+					repoDir := filepath.Join(tmpDir, "monorepo")
+					Expect(os.MkdirAll(filepath.Join(repoDir, "buildpacks"), 0755)).To(Succeed())
+					cp(filepath.Join(buildpackFixtures, "always-detects"), filepath.Join(repoDir, "buildpacks"))
+					for _, args := range [][]string{
+						{"init", "--quiet"},
+						{"add", "."},
+						{"-c", "user.email=you@example.com", "-c", "user.name=your name", "commit", "--quiet", "-m", "add buildpack"},
+					} {
+						cmd := exec.Command("git", args...)
+						cmd.Dir = repoDir
+						Expect(cmd.Run()).To(Succeed())
+					}
+
+					cmd := exec.Command("git", "rev-parse", "HEAD")
+					cmd.Dir = repoDir
+					output, err := cmd.Output()
+					Expect(err).NotTo(HaveOccurred())
+					commit = strings.TrimSpace(string(output))
+
+					buildpackOrder = "file://" + filepath.ToSlash(repoDir) + "#commit=" + commit + "&path=buildpacks/always-detects"
+					cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+				})
+
+				It("records the checked out commit in the result.json", func() {
+					var stagingResult buildpackapplifecycle.StagingResult
+					Expect(json.Unmarshal(resultJSON(), &stagingResult)).To(Succeed())
+					Expect(stagingResult.LifecycleMetadata.Buildpacks).To(HaveLen(1))
+					Expect(stagingResult.LifecycleMetadata.Buildpacks[0].Key).To(Equal(buildpackOrder))
+					Expect(stagingResult.LifecycleMetadata.Buildpacks[0].Commit).To(Equal(commit))
+				})
+			})
+
 			Context("final buildpack does not contain a finalize script", func() {
 				BeforeEach(func() {
 					buildpackOrder = "always-detects-creates-build-artifacts,always-detects,also-always-detects"
@@ -929,6 +1359,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Release Without Command",
 							"buildpack_key": "release-without-command",
+							"compression": "gzip",
 							"buildpacks": [
 							  { "key": "release-without-command", "name": "Release Without Command" }
 						  ]
@@ -936,7 +1367,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "procfile-provided start-command"
+            		"command": "procfile-provided start-command",
+            		"source": {"kind": "Procfile"}
           		}
         		],
 						"execution_metadata": ""
@@ -961,6 +1393,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata": {
 							"detected_buildpack": "Release Without Command",
 							"buildpack_key": "release-without-command",
+							"compression": "gzip",
 							"buildpacks": [
 							  { "key": "release-without-command", "name": "Release Without Command" }
 						  ]
@@ -968,7 +1401,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "spider",
-            		"command": "bogus command"
+            		"command": "bogus command",
+            		"source": {"kind": "Procfile"}
           		}
         		],
 						"execution_metadata": ""
@@ -1014,6 +1448,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 							  { "key": "always-detects", "name": "Always Matching" }
 						  ]
@@ -1021,7 +1456,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "procfile-provided start-command"
+            		"command": "procfile-provided start-command",
+            		"source": {"kind": "Procfile", "replaced": {"kind": "release", "buildpack": "always-detects"}}
           		}
         		],
 						"execution_metadata": ""
@@ -1046,6 +1482,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata": {
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 							  { "key": "always-detects", "name": "Always Matching" }
 						  ]
@@ -1053,11 +1490,13 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "the start command"
+            		"command": "the start command",
+            		"source": {"kind": "release", "buildpack": "always-detects"}
           		},
 							{
             		"type": "spider",
-            		"command": "bogus command"
+            		"command": "bogus command",
+            		"source": {"kind": "Procfile"}
           		}
         		],
 						"execution_metadata": ""
@@ -1083,6 +1522,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Matching",
 							"buildpack_key": "always-detects",
+							"compression": "gzip",
 							"buildpacks": [
 							  { "key": "always-detects", "name": "Always Matching" }
 						  ]
@@ -1090,7 +1530,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "web",
-            		"command": "the start command"
+            		"command": "the start command",
+            		"source": {"kind": "release", "buildpack": "always-detects"}
           		}
         		],
 						"execution_metadata": ""
@@ -1122,18 +1563,21 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata":{
 							"detected_buildpack": "Always Detects Non-Web",
 							"buildpack_key": "always-detects-non-web",
+							"compression": "gzip",
 						  "buildpacks": [
                   { "key": "always-detects-non-web", "name": "Always Detects Non-Web" }
               ]
 						},
 						"processes": [
 							{
-            		"type": "nonweb",
-            		"command": "start nonweb buildpack"
+            		"type": "web",
+            		"command": "procfile-provided start-command",
+            		"source": {"kind": "Procfile"}
           		},
           		{
-            		"type": "web",
-            		"command": "procfile-provided start-command"
+            		"type": "nonweb",
+            		"command": "start nonweb buildpack",
+            		"source": {"kind": "release", "buildpack": "always-detects-non-web"}
           		}
         		],
 						"execution_metadata": ""
@@ -1158,6 +1602,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata": {
 							"detected_buildpack": "Always Detects Non-Web",
 							"buildpack_key": "always-detects-non-web",
+							"compression": "gzip",
 						  "buildpacks": [
                   { "key": "always-detects-non-web", "name": "Always Detects Non-Web" }
               ]
@@ -1165,11 +1610,13 @@ var _ = Describe("Building", func() {
 						"processes": [
 							{
             		"type": "nonweb",
-            		"command": "start nonweb buildpack"
+            		"command": "start nonweb buildpack",
+            		"source": {"kind": "release", "buildpack": "always-detects-non-web"}
           		},
           		{
             		"type": "spider",
-            		"command": "bogus command"
+            		"command": "bogus command",
+            		"source": {"kind": "Procfile"}
           		}
         		],
 						"execution_metadata": ""
@@ -1194,6 +1641,7 @@ var _ = Describe("Building", func() {
 						"lifecycle_metadata": {
 							"detected_buildpack": "Always Detects Non-Web",
 							"buildpack_key": "always-detects-non-web",
+							"compression": "gzip",
 						  "buildpacks": [
                   { "key": "always-detects-non-web", "name": "Always Detects Non-Web" }
               ]
@@ -1201,7 +1649,8 @@ var _ = Describe("Building", func() {
 						"processes": [
           		{
             		"type": "nonweb",
-            		"command": "start nonweb buildpack"
+            		"command": "start nonweb buildpack",
+            		"source": {"kind": "release", "buildpack": "always-detects-non-web"}
           		}
         		],
 						"execution_metadata": ""
@@ -1222,7 +1671,7 @@ var _ = Describe("Building", func() {
 
 		It("fails", func() {
 			session := builder()
-			Eventually(session.Err).Should(gbytes.Say("Failed to read command from Procfile: invalid YAML"))
+			Eventually(session.Err).Should(gbytes.Say(`Failed to read command from Procfile: line 1: expected a line of the form "type: command", not "\["`))
 			Eventually(session, 5*time.Second).Should(gexec.Exit(1))
 		})
 	})
@@ -1240,6 +1689,19 @@ var _ = Describe("Building", func() {
 			Eventually(session, 5*time.Second).Should(gexec.Exit(222))
 			Expect(session.Err).To(gbytes.Say("None of the buildpacks detected a compatible application"))
 		})
+
+		It("records the failure in the result.json", func() {
+			session := builder()
+			Eventually(session, 5*time.Second).Should(gexec.Exit(222))
+
+			var stagingResult buildpackapplifecycle.StagingResult
+			Expect(json.Unmarshal(resultJSON(), &stagingResult)).To(Succeed())
+			Expect(stagingResult.Failure).To(Equal(&buildpackapplifecycle.StagingFailure{
+				Phase:    buildpackapplifecycle.DetectPhase,
+				Message:  buildpackapplifecycle.DetectFailMsg,
+				ExitCode: buildpackapplifecycle.DETECT_FAIL_CODE,
+			}))
+		})
 	})
 
 	Context("when the buildpack fails in compile", func() {
@@ -1355,6 +1817,151 @@ var _ = Describe("Building", func() {
 		})
 	})
 
+	Context("when the buildpacks declare the stacks they support", func() {
+		writeManifest := func(buildpack, manifest string) {
+			Expect(os.WriteFile(filepath.Join(buildpacksDir, buildpackHash(buildpack), "manifest.yml"), []byte(manifest), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			buildpackOrder = "has-finalize,always-detects"
+			skipDetect = true
+
+			cpBuildpack("has-finalize")
+			cpBuildpack("always-detects")
+			writeManifest("has-finalize", "language: ruby\ndependencies:\n- cf_stacks: [cflinuxfs3]\n- cf_stacks: [cflinuxfs4]\n")
+			writeManifest("always-detects", "language: go\nstack: cflinuxfs3\n")
+			Expect(os.WriteFile(filepath.Join(buildpacksDir, buildpackHash("always-detects"), "VERSION"), []byte("1.2.3\n"), 0644)).To(Succeed())
+			cp(filepath.Join(appFixtures, "bash-app", "app.sh"), buildDir)
+		})
+
+		Context("and the stack is one of them", func() {
+			BeforeEach(func() {
+				sessionSetEnv("CF_STACK", "cflinuxfs3")
+			})
+
+			It("records the language and version of the buildpacks", func() {
+				session := builder()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+
+				var stagingResult buildpackapplifecycle.StagingResult
+				Expect(json.Unmarshal(resultJSON(), &stagingResult)).To(Succeed())
+				Expect(stagingResult.Buildpacks).To(HaveLen(2))
+				Expect(stagingResult.Buildpacks[0].Language).To(Equal("ruby"))
+				Expect(stagingResult.Buildpacks[1].Language).To(Equal("go"))
+				Expect(stagingResult.Buildpacks[1].Version).To(Equal("1.2.3"))
+			})
+		})
+
+		Context("and the stack is not", func() {
+			BeforeEach(func() {
+				sessionSetEnv("CF_STACK", "cflinuxfs4")
+			})
+
+			It("fails before running any buildpack", func() {
+				session := builder()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(buildpackapplifecycle.STACK_FAIL_CODE))
+				Expect(session.Err).To(gbytes.Say("buildpack 'always-detects' supports cflinuxfs3 but the stack is cflinuxfs4"))
+				Expect(session.Out).NotTo(gbytes.Say("SUPPLYING"))
+
+				var stagingResult buildpackapplifecycle.StagingResult
+				Expect(json.Unmarshal(resultJSON(), &stagingResult)).To(Succeed())
+				Expect(stagingResult.Failure.Phase).To(Equal(buildpackapplifecycle.StackPhase))
+				Expect(stagingResult.Failure.BuildpackKey).To(Equal("always-detects"))
+				Expect(stagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.STACK_FAIL_CODE))
+			})
+		})
+
+		Context("and detect chooses the buildpack", func() {
+			BeforeEach(func() {
+				buildpackOrder = "always-detects,has-finalize"
+				skipDetect = false
+				sessionSetEnv("CF_STACK", "cflinuxfs4")
+			})
+
+			It("skips buildpacks for other stacks without running their detect", func() {
+				session := builder()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("buildpack 'always-detects' supports cflinuxfs3 but the stack is cflinuxfs4"))
+
+				data := &struct {
+					LifeCycle struct {
+						Key string `json:"buildpack_key"`
+					} `json:"lifecycle_metadata"`
+				}{}
+				Expect(json.Unmarshal(resultJSON(), data)).To(Succeed())
+				Expect(data.LifeCycle.Key).To(Equal("has-finalize"))
+			})
+
+			Context("concurrently", func() {
+				BeforeEach(func() {
+					detectConcurrency = 2
+				})
+
+				It("skips buildpacks for other stacks", func() {
+					session := builder()
+					Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+
+					data := &struct {
+						LifeCycle struct {
+							Key string `json:"buildpack_key"`
+						} `json:"lifecycle_metadata"`
+					}{}
+					Expect(json.Unmarshal(resultJSON(), data)).To(Succeed())
+					Expect(data.LifeCycle.Key).To(Equal("has-finalize"))
+				})
+			})
+		})
+
+		Context("and detect has no buildpack for the stack to choose from", func() {
+			BeforeEach(func() {
+				buildpackOrder = "always-detects,has-finalize"
+				skipDetect = false
+				sessionSetEnv("CF_STACK", "cflinuxfs4")
+				writeManifest("has-finalize", "language: ruby\nstack: cflinuxfs3\n")
+			})
+
+			itFailsWithTheStackMismatch := func() {
+				session := builder()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(buildpackapplifecycle.STACK_FAIL_CODE))
+				Expect(session.Err).To(gbytes.Say("buildpack 'always-detects' supports cflinuxfs3 but the stack is cflinuxfs4"))
+				Expect(session.Err).To(gbytes.Say("buildpack 'has-finalize' supports cflinuxfs3 but the stack is cflinuxfs4"))
+
+				var stagingResult buildpackapplifecycle.StagingResult
+				Expect(json.Unmarshal(resultJSON(), &stagingResult)).To(Succeed())
+				Expect(stagingResult.Failure.Phase).To(Equal(buildpackapplifecycle.StackPhase))
+				Expect(stagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.STACK_FAIL_CODE))
+				Expect(stagingResult.Failure.Message).To(ContainSubstring(buildpackapplifecycle.StackFailMsg))
+			}
+
+			It("fails with the stack mismatch rather than a failed detect", func() {
+				itFailsWithTheStackMismatch()
+			})
+
+			Context("concurrently", func() {
+				BeforeEach(func() {
+					detectConcurrency = 2
+				})
+
+				It("fails with the stack mismatch rather than a failed detect", func() {
+					itFailsWithTheStackMismatch()
+				})
+			})
+		})
+
+		Context("and only the dependencies of a buildpack are not built for the stack", func() {
+			BeforeEach(func() {
+				sessionSetEnv("CF_STACK", "cflinuxfs3")
+				writeManifest("has-finalize", "language: ruby\ndependencies:\n- cf_stacks: [cflinuxfs4]\n")
+			})
+
+			It("warns and stages", func() {
+				session := builder()
+				Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("Warning: buildpack 'has-finalize' has dependencies for cflinuxfs4 but the stack is cflinuxfs3"))
+			})
+		})
+	})
+
 	Context("with a buildpack using an md5 based path", func() {
 		BeforeEach(func() {
 			buildpack := "always-detect-buildpack"
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
@@ -21,11 +25,20 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := config.LoadConfigFile(); err != nil {
+		println(err.Error())
+		usage()
+	}
+
 	if err := config.Validate(); err != nil {
 		println(err.Error())
 		usage()
 	}
 
+	if config.Plan() {
+		os.Exit(printPlan(&config))
+	}
+
 	if platformOptions, err := platformoptions.Get(os.Getenv("VCAP_PLATFORM_OPTIONS")); err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid platform options: %v", err)
 		os.Exit(3)
@@ -53,19 +66,40 @@ func main() {
 		}
 	}
 	if err := execRunner(&config); err != nil {
-		println(err.Error())
+		println(buildpackapplifecycle.RedactCredentials(err.Error()))
 		os.Exit(buildpackapplifecycle.ExitCodeFromError(err))
 	}
 }
 
 func execRunner(config *buildpackapplifecycle.LifecycleBuilderConfig) error {
-	runner := buildpackrunner.New(config)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runner := buildpackrunner.NewWithContext(ctx, config)
 	defer runner.CleanUp()
 
 	_, err := runner.Run()
 	return err
 }
 
+// printPlan writes the staging plan to stdout and returns a non-zero exit code
+// if staging would fail.
+func printPlan(config *buildpackapplifecycle.LifecycleBuilderConfig) int {
+	plan := buildpackrunner.New(config).Plan()
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(plan); err != nil {
+		println(err.Error())
+		return 1
+	}
+
+	if len(plan.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
 func usage() {
 	flag.PrintDefaults()
 	os.Exit(1)
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/buildpackapplifecycle/credhub_flags"
+	"code.cloudfoundry.org/bytefmt"
 	"github.com/cespare/xxhash/v2"
 )
 
@@ -20,6 +21,7 @@ type LifecycleBuilderConfig struct {
 	*flag.FlagSet
 	workingDir     string
 	ExecutablePath string
+	configFile     *builderConfigFile
 }
 
 const (
@@ -33,8 +35,44 @@ const (
 	lifecycleBuilderBuildpackOrderFlag            = "buildpackOrder"
 	lifecycleBuilderSkipDetect                    = "skipDetect"
 	lifecycleBuilderSkipCertVerify                = "skipCertVerify"
+	lifecycleBuilderOutputEventsFlag              = "outputEvents"
+	lifecycleBuilderDetectTimeoutFlag             = "detectTimeout"
+	lifecycleBuilderSupplyTimeoutFlag             = "supplyTimeout"
+	lifecycleBuilderFinalizeTimeoutFlag           = "finalizeTimeout"
+	lifecycleBuilderReleaseTimeoutFlag            = "releaseTimeout"
+	lifecycleBuilderDetectConcurrencyFlag         = "detectConcurrency"
+	lifecycleBuilderDownloadCacheDirFlag          = "buildpackDownloadCacheDir"
+	lifecycleBuilderDownloadCacheMaxSizeFlag      = "buildpackDownloadCacheMaxSize"
+	lifecycleBuilderCompressionFlag               = "compression"
+	lifecycleBuilderCompressionLevelFlag          = "compressionLevel"
+	lifecycleBuilderOutputDropletManifestFlag     = "outputDropletManifest"
+	lifecycleBuilderPlanFlag                      = "plan"
+	lifecycleBuilderConfigFlag                    = "config"
+	lifecycleBuilderCredentialsFileFlag           = "buildpackCredentialsFile"
+	lifecycleBuilderDownloadAttemptsFlag          = "buildpackDownloadAttempts"
+	lifecycleBuilderDownloadRetryDelayFlag        = "buildpackDownloadRetryDelay"
+	lifecycleBuilderDownloadTimeoutFlag           = "buildpackDownloadTimeout"
+	lifecycleBuilderDownloadConnectTimeoutFlag    = "buildpackDownloadConnectTimeout"
+	lifecycleBuilderDownloadConcurrencyFlag       = "buildpackDownloadConcurrency"
+	lifecycleBuilderCACertsFlag                   = "buildpackCACerts"
+	lifecycleBuilderClientCertFlag                = "buildpackClientCert"
+	lifecycleBuilderClientKeyFlag                 = "buildpackClientKey"
+	lifecycleBuilderProxyFlag                     = "buildpackProxy"
+	lifecycleBuilderNoProxyFlag                   = "buildpackNoProxy"
+	lifecycleBuilderMaxExtractedSizeFlag          = "buildpackMaxExtractedSize"
+	lifecycleBuilderMaxArchiveEntriesFlag         = "buildpackMaxArchiveEntries"
 )
 
+// compression formats for the droplet and build artifacts cache
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// DefaultCompressionLevel selects the default level of the chosen codec.
+const DefaultCompressionLevel = -1
+
 var lifecycleBuilderDefaults = map[string]string{
 	lifecycleBuilderBuildDirFlag:                  "/tmp/app",
 	lifecycleBuilderOutputDropletFlag:             "/tmp/droplet",
@@ -43,6 +81,24 @@ var lifecycleBuilderDefaults = map[string]string{
 	lifecycleBuilderBuildpacksDirFlag:             "/tmp/buildpacks",
 	lifecycleBuilderBuildpacksDownloadDirFlag:     "/tmp/buildpackdownloads",
 	lifecycleBuilderBuildArtifactsCacheDirFlag:    "/tmp/cache",
+	lifecycleBuilderDownloadCacheMaxSizeFlag:      "1G",
+	lifecycleBuilderMaxExtractedSizeFlag:          "4G",
+	lifecycleBuilderCompressionFlag:               CompressionGzip,
+	lifecycleBuilderOutputDropletManifestFlag:     "",
+}
+
+// flags that may be left empty when validating the config
+var lifecycleBuilderOptionalFlags = map[string]bool{
+	lifecycleBuilderOutputEventsFlag:          true,
+	lifecycleBuilderOutputDropletManifestFlag: true,
+	lifecycleBuilderDownloadCacheDirFlag:      true,
+	lifecycleBuilderConfigFlag:                true,
+	lifecycleBuilderCredentialsFileFlag:       true,
+	lifecycleBuilderCACertsFlag:               true,
+	lifecycleBuilderClientCertFlag:            true,
+	lifecycleBuilderClientKeyFlag:             true,
+	lifecycleBuilderProxyFlag:                 true,
+	lifecycleBuilderNoProxyFlag:               true,
 }
 
 func NewLifecycleBuilderConfig(buildpacks []string, skipDetect bool, skipCertVerify bool) LifecycleBuilderConfig {
@@ -66,6 +122,12 @@ func NewLifecycleBuilderConfig(buildpacks []string, skipDetect bool, skipCertVer
 		"directory in which to write the app metadata",
 	)
 
+	flagSet.String(
+		lifecycleBuilderOutputDropletManifestFlag,
+		lifecycleBuilderDefaults[lifecycleBuilderOutputDropletManifestFlag],
+		"file where the manifest of the droplet's files and their digests should be written (default: droplet-manifest.json next to -outputMetadata)",
+	)
+
 	flagSet.String(
 		lifecycleBuilderOutputBuildArtifactsCacheFlag,
 		lifecycleBuilderDefaults[lifecycleBuilderOutputBuildArtifactsCacheFlag],
@@ -108,6 +170,156 @@ func NewLifecycleBuilderConfig(buildpacks []string, skipDetect bool, skipCertVer
 		"skip SSL certificate verification",
 	)
 
+	flagSet.String(
+		lifecycleBuilderOutputEventsFlag,
+		"",
+		"file where JSON-lines staging events should be written (disabled when empty)",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderDetectTimeoutFlag,
+		0,
+		"maximum duration of each buildpack's bin/detect (0 for no limit)",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderSupplyTimeoutFlag,
+		0,
+		"maximum duration of each buildpack's bin/supply (0 for no limit)",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderFinalizeTimeoutFlag,
+		0,
+		"maximum duration of the final buildpack's bin/finalize or bin/compile (0 for no limit)",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderReleaseTimeoutFlag,
+		0,
+		"maximum duration of the final buildpack's bin/release (0 for no limit)",
+	)
+
+	flagSet.Int(
+		lifecycleBuilderDetectConcurrencyFlag,
+		1,
+		"number of buildpack detect scripts to run at the same time",
+	)
+
+	flagSet.String(
+		lifecycleBuilderDownloadCacheDirFlag,
+		"",
+		"persistent directory in which to cache downloaded buildpacks between stagings (disabled when empty)",
+	)
+
+	flagSet.String(
+		lifecycleBuilderDownloadCacheMaxSizeFlag,
+		lifecycleBuilderDefaults[lifecycleBuilderDownloadCacheMaxSizeFlag],
+		"maximum size of the buildpack download cache, least recently used entries are evicted first",
+	)
+
+	flagSet.String(
+		lifecycleBuilderCompressionFlag,
+		lifecycleBuilderDefaults[lifecycleBuilderCompressionFlag],
+		"compression of the droplet and build artifacts cache: gzip, zstd or none",
+	)
+
+	flagSet.Int(
+		lifecycleBuilderCompressionLevelFlag,
+		DefaultCompressionLevel,
+		"compression level, 1-9 for gzip and 1-22 for zstd (-1 for the codec's default)",
+	)
+
+	flagSet.Bool(
+		lifecycleBuilderPlanFlag,
+		false,
+		"print the buildpack scripts staging would run as JSON, without running them",
+	)
+
+	flagSet.String(
+		lifecycleBuilderConfigFlag,
+		"",
+		"YAML or JSON file with builder settings and per-buildpack settings, overridden by flags (disabled when empty)",
+	)
+
+	flagSet.String(
+		lifecycleBuilderCredentialsFileFlag,
+		"",
+		"netrc file with logins for the hosts buildpacks are downloaded from (disabled when empty)",
+	)
+
+	flagSet.Int(
+		lifecycleBuilderDownloadAttemptsFlag,
+		3,
+		"number of times a buildpack download is tried before staging fails",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderDownloadRetryDelayFlag,
+		time.Second,
+		"delay before retrying a failed buildpack download, doubled with every further retry",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderDownloadTimeoutFlag,
+		10*time.Minute,
+		"maximum duration of each attempt to download a buildpack (0 for no limit)",
+	)
+
+	flagSet.Duration(
+		lifecycleBuilderDownloadConnectTimeoutFlag,
+		30*time.Second,
+		"maximum duration of connecting to a buildpack's server and waiting for its response (0 for no limit)",
+	)
+
+	flagSet.Int(
+		lifecycleBuilderDownloadConcurrencyFlag,
+		4,
+		"number of buildpacks to download at the same time",
+	)
+
+	flagSet.String(
+		lifecycleBuilderCACertsFlag,
+		"",
+		"PEM file, or directory of .crt and .pem files, with certificate authorities to trust for buildpack downloads in addition to the system's",
+	)
+
+	flagSet.String(
+		lifecycleBuilderClientCertFlag,
+		"",
+		"PEM client certificate presented to buildpack servers that require mutual TLS",
+	)
+
+	flagSet.String(
+		lifecycleBuilderClientKeyFlag,
+		"",
+		"PEM private key of the client certificate",
+	)
+
+	flagSet.String(
+		lifecycleBuilderProxyFlag,
+		"",
+		"URL of the proxy for buildpack downloads, overriding $http_proxy and $https_proxy",
+	)
+
+	flagSet.String(
+		lifecycleBuilderNoProxyFlag,
+		"",
+		"comma-separated hosts, domains and CIDRs to download buildpacks from without a proxy, overriding $no_proxy",
+	)
+
+	flagSet.String(
+		lifecycleBuilderMaxExtractedSizeFlag,
+		lifecycleBuilderDefaults[lifecycleBuilderMaxExtractedSizeFlag],
+		"maximum total size of the files extracted from a buildpack archive (0 for no limit)",
+	)
+
+	flagSet.Int(
+		lifecycleBuilderMaxArchiveEntriesFlag,
+		100000,
+		"maximum number of files, directories and links in a buildpack archive (0 for no limit)",
+	)
+
 	credhub_flags.AddCredhubFlags(flagSet)
 
 	wd, err := os.Getwd()
@@ -119,6 +331,7 @@ func NewLifecycleBuilderConfig(buildpacks []string, skipDetect bool, skipCertVer
 		FlagSet:        flagSet,
 		workingDir:     wd,
 		ExecutablePath: "/tmp/lifecycle/builder",
+		configFile:     &builderConfigFile{},
 	}
 }
 
@@ -141,11 +354,67 @@ func (s LifecycleBuilderConfig) Validate() error {
 
 	s.FlagSet.VisitAll(func(flag *flag.Flag) {
 		value := flag.Value.String()
-		if value == "" {
-			validationError = validationError.Append(fmt.Errorf("missing flag: -%s", flag.Name))
+		if value == "" && !lifecycleBuilderOptionalFlags[flag.Name] {
+			validationError = validationError.Append(fmt.Errorf("missing %s", s.flagRef(flag.Name)))
 		}
 	})
 
+	for _, timeoutFlag := range []string{
+		lifecycleBuilderDetectTimeoutFlag,
+		lifecycleBuilderSupplyTimeoutFlag,
+		lifecycleBuilderFinalizeTimeoutFlag,
+		lifecycleBuilderReleaseTimeoutFlag,
+		lifecycleBuilderDownloadRetryDelayFlag,
+		lifecycleBuilderDownloadTimeoutFlag,
+		lifecycleBuilderDownloadConnectTimeoutFlag,
+	} {
+		if s.duration(timeoutFlag) < 0 {
+			validationError = validationError.Append(fmt.Errorf("invalid %s must not be negative", s.flagRef(timeoutFlag)))
+		}
+	}
+
+	if s.DetectConcurrency() < 1 {
+		validationError = validationError.Append(fmt.Errorf("invalid %s must be at least 1", s.flagRef(lifecycleBuilderDetectConcurrencyFlag)))
+	}
+
+	if s.BuildpackDownloadConcurrency() < 1 {
+		validationError = validationError.Append(fmt.Errorf("invalid %s must be at least 1", s.flagRef(lifecycleBuilderDownloadConcurrencyFlag)))
+	}
+
+	if s.BuildpackDownloadAttempts() < 1 {
+		validationError = validationError.Append(fmt.Errorf("invalid %s must be at least 1", s.flagRef(lifecycleBuilderDownloadAttemptsFlag)))
+	}
+
+	if _, err := bytefmt.ToBytes(s.Lookup(lifecycleBuilderDownloadCacheMaxSizeFlag).Value.String()); err != nil {
+		validationError = validationError.Append(fmt.Errorf("invalid %s: %s", s.flagRef(lifecycleBuilderDownloadCacheMaxSizeFlag), err.Error()))
+	}
+
+	if _, err := s.maxExtractedSize(); err != nil {
+		validationError = validationError.Append(fmt.Errorf("invalid %s: %s", s.flagRef(lifecycleBuilderMaxExtractedSizeFlag), err.Error()))
+	}
+
+	if s.BuildpackMaxArchiveEntries() < 0 {
+		validationError = validationError.Append(fmt.Errorf("invalid %s must not be negative", s.flagRef(lifecycleBuilderMaxArchiveEntriesFlag)))
+	}
+
+	if (s.BuildpackClientCert() == "") != (s.BuildpackClientKey() == "") {
+		validationError = validationError.Append(fmt.Errorf("invalid %s and %s must be given together", s.flagRef(lifecycleBuilderClientCertFlag), s.flagRef(lifecycleBuilderClientKeyFlag)))
+	}
+
+	if proxy := s.BuildpackProxy(); proxy != "" {
+		if proxyURL, err := url.Parse(proxy); err != nil || proxyURL.Host == "" {
+			validationError = validationError.Append(fmt.Errorf("invalid %s must be a URL such as http://proxy.example.com:3128", s.flagRef(lifecycleBuilderProxyFlag)))
+		}
+	}
+
+	if err := s.validateCompression(); err != nil {
+		validationError = validationError.Append(err)
+	}
+
+	if err := s.validateConfigFile(); err != nil {
+		validationError = validationError.Append(err)
+	}
+
 	if !validationError.Empty() {
 		return validationError
 	}
@@ -153,6 +422,29 @@ func (s LifecycleBuilderConfig) Validate() error {
 	return nil
 }
 
+func (s LifecycleBuilderConfig) validateCompression() error {
+	level := s.CompressionLevel()
+	if level == DefaultCompressionLevel {
+		level = 1
+	}
+
+	switch s.Compression() {
+	case CompressionGzip:
+		if level < 1 || level > 9 {
+			return fmt.Errorf("invalid %s must be between 1 and 9 for gzip", s.flagRef(lifecycleBuilderCompressionLevelFlag))
+		}
+	case CompressionZstd:
+		if level < 1 || level > 22 {
+			return fmt.Errorf("invalid %s must be between 1 and 22 for zstd", s.flagRef(lifecycleBuilderCompressionLevelFlag))
+		}
+	case CompressionNone:
+	default:
+		return fmt.Errorf("invalid %s must be one of gzip, zstd or none", s.flagRef(lifecycleBuilderCompressionFlag))
+	}
+
+	return nil
+}
+
 func (s LifecycleBuilderConfig) BuildDir() string {
 	return s.getPath(s.Lookup(lifecycleBuilderBuildDirFlag).Value.String())
 }
@@ -215,10 +507,128 @@ func (s LifecycleBuilderConfig) OutputMetadata() string {
 	return s.getPath(s.Lookup(lifecycleBuilderOutputMetadataFlag).Value.String())
 }
 
+// OutputDropletManifest defaults to a file next to the app metadata, so that
+// stagings writing their metadata to separate directories do not share it.
+func (s LifecycleBuilderConfig) OutputDropletManifest() string {
+	outputDropletManifest := s.Lookup(lifecycleBuilderOutputDropletManifestFlag).Value.String()
+	if outputDropletManifest == "" {
+		return filepath.Join(filepath.Dir(s.OutputMetadata()), "droplet-manifest.json")
+	}
+	return s.getPath(outputDropletManifest)
+}
+
 func (s LifecycleBuilderConfig) OutputBuildArtifactsCache() string {
 	return s.getPath(s.Lookup(lifecycleBuilderOutputBuildArtifactsCacheFlag).Value.String())
 }
 
+func (s LifecycleBuilderConfig) OutputEvents() string {
+	outputEvents := s.Lookup(lifecycleBuilderOutputEventsFlag).Value.String()
+	if outputEvents == "" {
+		return ""
+	}
+	return s.getPath(outputEvents)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadCacheDir() string {
+	cacheDir := s.Lookup(lifecycleBuilderDownloadCacheDirFlag).Value.String()
+	if cacheDir == "" {
+		return ""
+	}
+	return s.getPath(cacheDir)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadCacheMaxSize() uint64 {
+	// Validate rejects sizes that do not parse
+	maxSize, _ := bytefmt.ToBytes(s.Lookup(lifecycleBuilderDownloadCacheMaxSizeFlag).Value.String())
+	return maxSize
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadAttempts() int {
+	return s.Lookup(lifecycleBuilderDownloadAttemptsFlag).Value.(flag.Getter).Get().(int)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadConcurrency() int {
+	return s.Lookup(lifecycleBuilderDownloadConcurrencyFlag).Value.(flag.Getter).Get().(int)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadRetryDelay() time.Duration {
+	return s.duration(lifecycleBuilderDownloadRetryDelayFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadTimeout() time.Duration {
+	return s.duration(lifecycleBuilderDownloadTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackDownloadConnectTimeout() time.Duration {
+	return s.duration(lifecycleBuilderDownloadConnectTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackCredentialsFile() string {
+	credentialsFile := s.Lookup(lifecycleBuilderCredentialsFileFlag).Value.String()
+	if credentialsFile == "" {
+		return ""
+	}
+	return s.getPath(credentialsFile)
+}
+
+func (s LifecycleBuilderConfig) BuildpackCACerts() string {
+	return s.optionalPath(lifecycleBuilderCACertsFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackClientCert() string {
+	return s.optionalPath(lifecycleBuilderClientCertFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackClientKey() string {
+	return s.optionalPath(lifecycleBuilderClientKeyFlag)
+}
+
+func (s LifecycleBuilderConfig) BuildpackProxy() string {
+	return s.Lookup(lifecycleBuilderProxyFlag).Value.String()
+}
+
+func (s LifecycleBuilderConfig) BuildpackNoProxy() string {
+	return s.Lookup(lifecycleBuilderNoProxyFlag).Value.String()
+}
+
+// BuildpackMaxExtractedSize returns 0 when extraction is not limited
+func (s LifecycleBuilderConfig) BuildpackMaxExtractedSize() uint64 {
+	// Validate rejects sizes that do not parse
+	maxSize, _ := s.maxExtractedSize()
+	return maxSize
+}
+
+// maxExtractedSize accepts a plain 0, which bytefmt does not, to disable the
+// limit
+func (s LifecycleBuilderConfig) maxExtractedSize() (uint64, error) {
+	maxSize := s.Lookup(lifecycleBuilderMaxExtractedSizeFlag).Value.String()
+	if maxSize == "0" {
+		return 0, nil
+	}
+	return bytefmt.ToBytes(maxSize)
+}
+
+func (s LifecycleBuilderConfig) BuildpackMaxArchiveEntries() int {
+	return s.Lookup(lifecycleBuilderMaxArchiveEntriesFlag).Value.(flag.Getter).Get().(int)
+}
+
+// optionalPath returns "" for an empty path rather than the working directory
+func (s LifecycleBuilderConfig) optionalPath(name string) string {
+	path := s.Lookup(name).Value.String()
+	if path == "" {
+		return ""
+	}
+	return s.getPath(path)
+}
+
+func (s LifecycleBuilderConfig) Compression() string {
+	return s.Lookup(lifecycleBuilderCompressionFlag).Value.String()
+}
+
+func (s LifecycleBuilderConfig) CompressionLevel() int {
+	return s.Lookup(lifecycleBuilderCompressionLevelFlag).Value.(flag.Getter).Get().(int)
+}
+
 func (s LifecycleBuilderConfig) SkipCertVerify() bool {
 	return s.Lookup(lifecycleBuilderSkipCertVerify).Value.String() == "true"
 }
@@ -227,6 +637,34 @@ func (s LifecycleBuilderConfig) SkipDetect() bool {
 	return s.Lookup(lifecycleBuilderSkipDetect).Value.String() == "true"
 }
 
+func (s LifecycleBuilderConfig) Plan() bool {
+	return s.Lookup(lifecycleBuilderPlanFlag).Value.String() == "true"
+}
+
+func (s LifecycleBuilderConfig) DetectConcurrency() int {
+	return s.Lookup(lifecycleBuilderDetectConcurrencyFlag).Value.(flag.Getter).Get().(int)
+}
+
+func (s LifecycleBuilderConfig) DetectTimeout() time.Duration {
+	return s.duration(lifecycleBuilderDetectTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) SupplyTimeout() time.Duration {
+	return s.duration(lifecycleBuilderSupplyTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) FinalizeTimeout() time.Duration {
+	return s.duration(lifecycleBuilderFinalizeTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) ReleaseTimeout() time.Duration {
+	return s.duration(lifecycleBuilderReleaseTimeoutFlag)
+}
+
+func (s LifecycleBuilderConfig) duration(name string) time.Duration {
+	return s.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+}
+
 func (s LifecycleBuilderConfig) CredhubConnectAttempts() int {
 	return credhub_flags.ConnectAttempts(s.FlagSet)
 }
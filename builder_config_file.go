@@ -0,0 +1,296 @@
+package buildpackapplifecycle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BuilderConfigFileVersion is the only version of the builder config file
+// format understood by this builder.
+const BuilderConfigFileVersion = 1
+
+const builderConfigFileBuildpacksKey = "buildpacks"
+
+// builderConfigFile is the YAML (or JSON) file passed with -config. Besides
+// its version and buildpacks, every top-level key is the name of a builder
+// flag, e.g.
+//
+//	version: 1
+//	skipDetect: true
+//	supplyTimeout: 10m
+//	buildpacks:
+//	- name: ruby_buildpack
+//	  timeout: 15m
+//	- url: https://example.com/buildpack.zip
+//	  digest: sha256:<hex>
+//	  env:
+//	    BP_DEBUG: "true"
+type builderConfigFile struct {
+	// flags whose value was taken from the file, to blame it in errors
+	keys map[string]bool
+
+	Version    int                    `yaml:"version"`
+	Buildpacks []BuildpackSettings    `yaml:"buildpacks"`
+	Settings   map[string]interface{} `yaml:",inline"`
+}
+
+// BuildpackSettings holds the settings of a single buildpack in the config file.
+// A buildpack is either a system buildpack referred to by name, or one that is
+// downloaded from its URL, optionally pinned to a digest.
+type BuildpackSettings struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Digest  string            `yaml:"digest"`
+	Timeout string            `yaml:"timeout"`
+	Env     map[string]string `yaml:"env"`
+}
+
+// Key returns the buildpack's entry in the buildpack order. A pinned digest
+// is carried in the URL fragment.
+func (b BuildpackSettings) Key() string {
+	if b.URL == "" {
+		return b.Name
+	}
+	if b.Digest == "" {
+		return b.URL
+	}
+
+	algorithm, value, _ := strings.Cut(b.Digest, ":")
+	return b.URL + "#" + algorithm + "=" + strings.ToLower(value)
+}
+
+func (b BuildpackSettings) validate(key string) error {
+	var validationError ValidationError
+
+	switch {
+	case b.Name == "" && b.URL == "":
+		validationError = validationError.Append(fmt.Errorf("invalid config key: %s: one of name or url is required", key))
+	case b.Name != "" && b.URL != "":
+		validationError = validationError.Append(fmt.Errorf("invalid config key: %s: name and url are mutually exclusive", key))
+	case b.URL != "":
+		if u, err := url.Parse(b.URL); err != nil || !u.IsAbs() {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.url: must be an absolute URL", key))
+		} else if b.Digest != "" && u.Fragment != "" {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.url: must not have a fragment when a digest is set", key))
+		}
+	}
+
+	if b.Digest != "" {
+		algorithm, value, _ := strings.Cut(b.Digest, ":")
+		decoded, err := hex.DecodeString(value)
+		if algorithm != "sha256" || err != nil || len(decoded) != sha256.Size {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.digest: expected sha256:<hex>", key))
+		} else if b.URL == "" {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.digest: only downloaded buildpacks can be pinned", key))
+		}
+	}
+
+	if b.Timeout != "" {
+		if timeout, err := time.ParseDuration(b.Timeout); err != nil {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.timeout: %s", key, err.Error()))
+		} else if timeout < 0 {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.timeout: must not be negative", key))
+		}
+	}
+
+	for _, name := range sortedKeys(b.Env) {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s.env: invalid variable name %q", key, name))
+		}
+	}
+
+	if !validationError.Empty() {
+		return validationError
+	}
+	return nil
+}
+
+// LoadConfigFile applies the settings of the file passed with -config to
+// every flag that was not set on the command line. It must be called after
+// Parse; without -config it does nothing.
+func (s LifecycleBuilderConfig) LoadConfigFile() error {
+	path := s.Lookup(lifecycleBuilderConfigFlag).Value.String()
+	if path == "" {
+		return nil
+	}
+	path = s.getPath(path)
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %s", err.Error())
+	}
+
+	// JSON is a subset of YAML, so both formats are parsed the same way
+	file := s.configFile
+	*file = builderConfigFile{keys: map[string]bool{}}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(file); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %s", path, err.Error())
+	}
+
+	if file.Version != BuilderConfigFileVersion {
+		return fmt.Errorf("invalid config key: version: must be %d", BuilderConfigFileVersion)
+	}
+
+	explicit := map[string]bool{}
+	s.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var validationError ValidationError
+	for _, name := range sortedKeys(file.Settings) {
+		if name == lifecycleBuilderConfigFlag || s.Lookup(name) == nil {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s: unknown setting", name))
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+
+		value, err := configFileValue(file.Settings[name])
+		if err == nil {
+			err = s.Set(name, value)
+		}
+		if err != nil {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s: %s", name, err.Error()))
+			continue
+		}
+		file.keys[name] = true
+	}
+
+	if len(file.Buildpacks) > 0 {
+		if _, ok := file.Settings[lifecycleBuilderBuildpackOrderFlag]; ok {
+			validationError = validationError.Append(fmt.Errorf("invalid config key: %s: cannot be combined with %s", builderConfigFileBuildpacksKey, lifecycleBuilderBuildpackOrderFlag))
+		} else if !explicit[lifecycleBuilderBuildpackOrderFlag] {
+			keys := make([]string, len(file.Buildpacks))
+			for i, buildpack := range file.Buildpacks {
+				keys[i] = buildpack.Key()
+			}
+			file.keys[lifecycleBuilderBuildpackOrderFlag] = true
+			if err := s.Set(lifecycleBuilderBuildpackOrderFlag, strings.Join(keys, ",")); err != nil {
+				validationError = validationError.Append(fmt.Errorf("invalid %s: %s", s.flagRef(lifecycleBuilderBuildpackOrderFlag), err.Error()))
+			}
+		}
+	}
+
+	if !validationError.Empty() {
+		return validationError
+	}
+	return nil
+}
+
+// configFileValue converts a scalar, or for the buildpack order a list, to
+// the string form of a flag value.
+func configFileValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case int, int64, uint64, float64, bool:
+		return fmt.Sprint(value), nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("item %d must be a string", i)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case nil:
+		return "", nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func (s LifecycleBuilderConfig) validateConfigFile() error {
+	if s.configFile == nil {
+		return nil
+	}
+
+	var validationError ValidationError
+	for i, buildpack := range s.configFile.Buildpacks {
+		if err := buildpack.validate(fmt.Sprintf("%s[%d]", builderConfigFileBuildpacksKey, i)); err != nil {
+			validationError = validationError.Append(err)
+		}
+	}
+
+	if !validationError.Empty() {
+		return validationError
+	}
+	return nil
+}
+
+// flagRef names a flag in errors, as the config file key when its value was
+// taken from the config file.
+func (s LifecycleBuilderConfig) flagRef(name string) string {
+	if s.configFile != nil && s.configFile.keys[name] {
+		return "config key: " + name
+	}
+	return "flag: -" + name
+}
+
+// buildpackSettings returns the config file settings of the buildpack with the
+// given key in the buildpack order.
+func (s LifecycleBuilderConfig) buildpackSettings(buildpack string) (BuildpackSettings, bool) {
+	if s.configFile == nil {
+		return BuildpackSettings{}, false
+	}
+
+	for _, config := range s.configFile.Buildpacks {
+		if config.Key() == buildpack {
+			return config, true
+		}
+	}
+	return BuildpackSettings{}, false
+}
+
+// BuildpackTimeout returns the timeout configured for the buildpack's
+// scripts, or the timeout of the phase if it has none.
+func (s LifecycleBuilderConfig) BuildpackTimeout(buildpack string, phaseTimeout time.Duration) time.Duration {
+	config, ok := s.buildpackSettings(buildpack)
+	if !ok || config.Timeout == "" {
+		return phaseTimeout
+	}
+
+	// Validate rejects timeouts that do not parse
+	timeout, _ := time.ParseDuration(config.Timeout)
+	return timeout
+}
+
+// BuildpackEnv returns the environment configured for the buildpack's
+// scripts as sorted KEY=value pairs.
+func (s LifecycleBuilderConfig) BuildpackEnv(buildpack string) []string {
+	config, ok := s.buildpackSettings(buildpack)
+	if !ok {
+		return nil
+	}
+
+	env := []string{}
+	for _, name := range sortedKeys(config.Env) {
+		env = append(env, name+"="+config.Env[name])
+	}
+	return env
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
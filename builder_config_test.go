@@ -1,7 +1,9 @@
 package buildpackapplifecycle_test
 
 import (
+	"os"
 	"path/filepath"
+	"time"
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	. "github.com/onsi/ginkgo/v2"
@@ -30,11 +32,37 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 				"-buildArtifactsCacheDir=/tmp/cache",
 				"-outputDroplet=/tmp/droplet",
 				"-outputMetadata=/tmp/result.json",
+				"-outputDropletManifest=",
 				"-outputBuildArtifactsCache=/tmp/output-cache",
 				"-skipCertVerify=false",
 				"-skipDetect=false",
 				"-credhubConnectAttempts=3",
 				"-credhubRetryDelay=1s",
+				"-outputEvents=",
+				"-detectTimeout=0s",
+				"-supplyTimeout=0s",
+				"-finalizeTimeout=0s",
+				"-releaseTimeout=0s",
+				"-detectConcurrency=1",
+				"-buildpackDownloadCacheDir=",
+				"-buildpackDownloadCacheMaxSize=1G",
+				"-compression=gzip",
+				"-compressionLevel=-1",
+				"-plan=false",
+				"-config=",
+				"-buildpackCredentialsFile=",
+				"-buildpackDownloadAttempts=3",
+				"-buildpackDownloadRetryDelay=1s",
+				"-buildpackDownloadTimeout=10m0s",
+				"-buildpackDownloadConnectTimeout=30s",
+				"-buildpackDownloadConcurrency=4",
+				"-buildpackCACerts=",
+				"-buildpackClientCert=",
+				"-buildpackClientKey=",
+				"-buildpackProxy=",
+				"-buildpackNoProxy=",
+				"-buildpackMaxExtractedSize=4G",
+				"-buildpackMaxArchiveEntries=100000",
 			}
 
 			Expect(builderConfig.Path()).To(Equal(filepath.Join(pathPrefix(), "tmp", "lifecycle", "builder")))
@@ -48,6 +76,7 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 			Expect(builderConfig.BuildArtifactsCacheDir()).To(Equal(filepath.Join(pathPrefix(), "tmp", "cache")))
 			Expect(builderConfig.OutputDroplet()).To(Equal(filepath.Join(pathPrefix(), "tmp", "droplet")))
 			Expect(builderConfig.OutputMetadata()).To(Equal(filepath.Join(pathPrefix(), "tmp", "result.json")))
+			Expect(builderConfig.OutputDropletManifest()).To(Equal(filepath.Join(pathPrefix(), "tmp", "droplet-manifest.json")))
 			Expect(builderConfig.OutputBuildArtifactsCache()).To(Equal(filepath.Join(pathPrefix(), "tmp", "output-cache")))
 		})
 	})
@@ -61,6 +90,7 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 			builderConfig.Set("buildDir", "/some/build/dir")
 			builderConfig.Set("outputDroplet", "/some/droplet")
 			builderConfig.Set("outputMetadata", "/some/result-file")
+			builderConfig.Set("outputDropletManifest", "/some/droplet-manifest")
 			builderConfig.Set("buildpacksDir", "/some/buildpacks/dir")
 			builderConfig.Set("buildpacksDownloadDir", "/some/downloads/dir")
 			builderConfig.Set("buildArtifactsCacheDir", "/some/cache/dir")
@@ -80,11 +110,37 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 				"-buildArtifactsCacheDir=/some/cache/dir",
 				"-outputDroplet=/some/droplet",
 				"-outputMetadata=/some/result-file",
+				"-outputDropletManifest=/some/droplet-manifest",
 				"-outputBuildArtifactsCache=/some/cache-file",
 				"-skipCertVerify=true",
 				"-skipDetect=true",
 				"-credhubConnectAttempts=5",
 				"-credhubRetryDelay=5s",
+				"-outputEvents=",
+				"-detectTimeout=0s",
+				"-supplyTimeout=0s",
+				"-finalizeTimeout=0s",
+				"-releaseTimeout=0s",
+				"-detectConcurrency=1",
+				"-buildpackDownloadCacheDir=",
+				"-buildpackDownloadCacheMaxSize=1G",
+				"-compression=gzip",
+				"-compressionLevel=-1",
+				"-plan=false",
+				"-config=",
+				"-buildpackCredentialsFile=",
+				"-buildpackDownloadAttempts=3",
+				"-buildpackDownloadRetryDelay=1s",
+				"-buildpackDownloadTimeout=10m0s",
+				"-buildpackDownloadConnectTimeout=30s",
+				"-buildpackDownloadConcurrency=4",
+				"-buildpackCACerts=",
+				"-buildpackClientCert=",
+				"-buildpackClientKey=",
+				"-buildpackProxy=",
+				"-buildpackNoProxy=",
+				"-buildpackMaxExtractedSize=4G",
+				"-buildpackMaxArchiveEntries=100000",
 			}
 
 			Expect(builderConfig.Path()).To(Equal(filepath.Join(pathPrefix(), "tmp", "lifecycle", "builder")))
@@ -98,10 +154,21 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 			Expect(builderConfig.BuildArtifactsCacheDir()).To(Equal(filepath.Join(pathPrefix(), "some", "cache", "dir")))
 			Expect(builderConfig.OutputDroplet()).To(Equal(filepath.Join(pathPrefix(), "some", "droplet")))
 			Expect(builderConfig.OutputMetadata()).To(Equal(filepath.Join(pathPrefix(), "some", "result-file")))
+			Expect(builderConfig.OutputDropletManifest()).To(Equal(filepath.Join(pathPrefix(), "some", "droplet-manifest")))
 			Expect(builderConfig.OutputBuildArtifactsCache()).To(Equal(filepath.Join(pathPrefix(), "some", "cache-file")))
 		})
 	})
 
+	Context("when only the metadata output is overridden", func() {
+		JustBeforeEach(func() {
+			builderConfig.Set("outputMetadata", "/some/staging/result.json")
+		})
+
+		It("writes the droplet manifest next to the metadata", func() {
+			Expect(builderConfig.OutputDropletManifest()).To(Equal(filepath.Join(pathPrefix(), "some", "staging", "droplet-manifest.json")))
+		})
+	})
+
 	Describe("LegacyBuildpackPath", func() {
 		It("returns the path to a given system buildpack using legacy md5", func() {
 			key := "my-buildpack/key/::"
@@ -137,4 +204,144 @@ var _ = Describe("LifecycleBuilderConfig", func() {
 	It("returns the path to the staging metadata", func() {
 		Expect(builderConfig.OutputMetadata()).To(Equal(filepath.Join(pathPrefix(), "tmp", "result.json")))
 	})
+
+	Describe("Validate", func() {
+		It("accepts the defaults", func() {
+			Expect(builderConfig.Validate()).To(Succeed())
+		})
+
+		DescribeTable("compression",
+			func(compression, level string, expectedError string) {
+				Expect(builderConfig.Set("compression", compression)).To(Succeed())
+				Expect(builderConfig.Set("compressionLevel", level)).To(Succeed())
+
+				if expectedError == "" {
+					Expect(builderConfig.Validate()).To(Succeed())
+				} else {
+					Expect(builderConfig.Validate()).To(MatchError(ContainSubstring(expectedError)))
+				}
+			},
+			Entry("gzip at its default level", "gzip", "-1", ""),
+			Entry("gzip at level 9", "gzip", "9", ""),
+			Entry("gzip above level 9", "gzip", "10", "-compressionLevel must be between 1 and 9 for gzip"),
+			Entry("zstd at level 22", "zstd", "22", ""),
+			Entry("zstd above level 22", "zstd", "23", "-compressionLevel must be between 1 and 22 for zstd"),
+			Entry("no compression ignores the level", "none", "42", ""),
+			Entry("an unknown codec", "bzip2", "-1", "-compression must be one of gzip, zstd or none"),
+		)
+	})
+
+	Describe("LoadConfigFile", func() {
+		var configPath string
+
+		writeConfig := func(contents string) {
+			Expect(os.WriteFile(configPath, []byte(contents), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			configPath = filepath.Join(GinkgoT().TempDir(), "builder.yml")
+		})
+
+		It("does nothing without -config", func() {
+			Expect(builderConfig.LoadConfigFile()).To(Succeed())
+			Expect(builderConfig.BuildpackOrder()).To(Equal([]string{"ocaml-buildpack", "haskell-buildpack", "bash-buildpack"}))
+		})
+
+		It("applies the settings of a YAML file", func() {
+			writeConfig(`
+version: 1
+skipDetect: true
+supplyTimeout: 10m
+detectConcurrency: 4
+buildpacks:
+- name: ocaml-buildpack
+  timeout: 1m
+  env:
+    OCAML_DEBUG: "true"
+    A_FIRST: "1"
+- url: https://example.com/haskell.zip
+  digest: sha256:E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855
+`)
+			Expect(builderConfig.Parse([]string{"-config=" + configPath})).To(Succeed())
+			Expect(builderConfig.LoadConfigFile()).To(Succeed())
+			Expect(builderConfig.Validate()).To(Succeed())
+
+			Expect(builderConfig.SkipDetect()).To(BeTrue())
+			Expect(builderConfig.SupplyTimeout()).To(Equal(10 * time.Minute))
+			Expect(builderConfig.DetectConcurrency()).To(Equal(4))
+			Expect(builderConfig.BuildpackOrder()).To(Equal([]string{
+				"ocaml-buildpack",
+				"https://example.com/haskell.zip#sha256=e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			}))
+
+			Expect(builderConfig.BuildpackTimeout("ocaml-buildpack", time.Hour)).To(Equal(time.Minute))
+			Expect(builderConfig.BuildpackTimeout("bash-buildpack", time.Hour)).To(Equal(time.Hour))
+			Expect(builderConfig.BuildpackEnv("ocaml-buildpack")).To(Equal([]string{"A_FIRST=1", "OCAML_DEBUG=true"}))
+			Expect(builderConfig.BuildpackEnv("bash-buildpack")).To(BeEmpty())
+		})
+
+		It("applies the settings of a JSON file", func() {
+			writeConfig(`{"version": 1, "skipDetect": true, "buildpackOrder": ["bash-buildpack", "ocaml-buildpack"]}`)
+			Expect(builderConfig.Parse([]string{"-config=" + configPath})).To(Succeed())
+			Expect(builderConfig.LoadConfigFile()).To(Succeed())
+
+			Expect(builderConfig.SkipDetect()).To(BeTrue())
+			Expect(builderConfig.BuildpackOrder()).To(Equal([]string{"bash-buildpack", "ocaml-buildpack"}))
+		})
+
+		It("lets flags take precedence over the file", func() {
+			writeConfig(`
+version: 1
+supplyTimeout: 10m
+buildpacks:
+- name: ocaml-buildpack
+`)
+			Expect(builderConfig.Parse([]string{"-config=" + configPath, "-supplyTimeout=1m", "-buildpackOrder=bash-buildpack"})).To(Succeed())
+			Expect(builderConfig.LoadConfigFile()).To(Succeed())
+
+			Expect(builderConfig.SupplyTimeout()).To(Equal(time.Minute))
+			Expect(builderConfig.BuildpackOrder()).To(Equal([]string{"bash-buildpack"}))
+		})
+
+		DescribeTable("rejecting invalid files",
+			func(contents string, expectedError string) {
+				writeConfig(contents)
+				Expect(builderConfig.Parse([]string{"-config=" + configPath})).To(Succeed())
+
+				err := builderConfig.LoadConfigFile()
+				if err == nil {
+					err = builderConfig.Validate()
+				}
+				Expect(err).To(MatchError(ContainSubstring(expectedError)))
+			},
+			Entry("a missing version", "skipDetect: true", "invalid config key: version: must be 1"),
+			Entry("an unknown version", "version: 2", "invalid config key: version: must be 1"),
+			Entry("an unknown setting", "version: 1\nfoo: bar", "invalid config key: foo: unknown setting"),
+			Entry("a nested config file", "version: 1\nconfig: other.yml", "invalid config key: config: unknown setting"),
+			Entry("a malformed value", "version: 1\ndetectTimeout: soon", "invalid config key: detectTimeout: "),
+			Entry("an invalid value", "version: 1\ndetectTimeout: -1s", "invalid config key: detectTimeout must not be negative"),
+			Entry("an empty value", "version: 1\nbuildDir: ''", "missing config key: buildDir"),
+			Entry("too few download attempts", "version: 1\nbuildpackDownloadAttempts: 0", "invalid config key: buildpackDownloadAttempts must be at least 1"),
+			Entry("a client certificate without its key", "version: 1\nbuildpackClientCert: client.crt", "invalid config key: buildpackClientCert and flag: -buildpackClientKey must be given together"),
+			Entry("a proxy that is not a URL", "version: 1\nbuildpackProxy: proxy", "invalid config key: buildpackProxy must be a URL"),
+			Entry("a malformed extraction size limit", "version: 1\nbuildpackMaxExtractedSize: lots", "invalid config key: buildpackMaxExtractedSize: byte quantity"),
+			Entry("a negative archive entry limit", "version: 1\nbuildpackMaxArchiveEntries: -1", "invalid config key: buildpackMaxArchiveEntries must not be negative"),
+			Entry("both buildpacks and buildpackOrder", "version: 1\nbuildpackOrder: a\nbuildpacks: [{name: a}]", "invalid config key: buildpacks: cannot be combined with buildpackOrder"),
+			Entry("a buildpack without name or url", "version: 1\nbuildpacks: [{name: a}, {timeout: 1m}]", "invalid config key: buildpacks[1]: one of name or url is required"),
+			Entry("a buildpack with both name and url", "version: 1\nbuildpacks: [{name: a, url: 'https://example.com/a.zip'}]", "invalid config key: buildpacks[0]: name and url are mutually exclusive"),
+			Entry("a relative buildpack url", "version: 1\nbuildpacks: [{url: a.zip}]", "invalid config key: buildpacks[0].url: must be an absolute URL"),
+			Entry("a malformed digest", "version: 1\nbuildpacks: [{url: 'https://example.com/a.zip', digest: 'md5:abc'}]", "invalid config key: buildpacks[0].digest: expected sha256:<hex>"),
+			Entry("a digest of a system buildpack", "version: 1\nbuildpacks: [{name: a, digest: 'sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855'}]", "invalid config key: buildpacks[0].digest: only downloaded buildpacks can be pinned"),
+			Entry("a malformed timeout", "version: 1\nbuildpacks: [{name: a}, {name: b, timeout: soon}]", "invalid config key: buildpacks[1].timeout: "),
+			Entry("a negative timeout", "version: 1\nbuildpacks: [{name: a, timeout: -1m}]", "invalid config key: buildpacks[0].timeout: must not be negative"),
+			Entry("an invalid env name", "version: 1\nbuildpacks: [{name: a, env: {'A=B': c}}]", "invalid config key: buildpacks[0].env: invalid variable name"),
+		)
+
+		It("still blames the flag when it overrides the file", func() {
+			writeConfig("version: 1\ndetectTimeout: 1m")
+			Expect(builderConfig.Parse([]string{"-config=" + configPath, "-detectTimeout=-1s"})).To(Succeed())
+			Expect(builderConfig.LoadConfigFile()).To(Succeed())
+			Expect(builderConfig.Validate()).To(MatchError(ContainSubstring("invalid flag: -detectTimeout must not be negative")))
+		})
+	})
 })
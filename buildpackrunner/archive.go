@@ -0,0 +1,211 @@
+package buildpackrunner
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveModTime is stamped on every entry so that archives only depend on
+// the contents of the directory, not on when it was staged. It is the
+// earliest time representable in a zip file, which keeps droplets unpacked
+// into other formats valid too.
+var archiveModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// writeArchive writes the contents of srcDir to dest as a tarball compressed
+// with the given codec. Entries are written in lexical order with normalized
+// timestamps and ownership, so that the same directory contents always
+// produce the same bytes. Entry names are prefixed with "./", as those
+// written by `tar -C dir .`. Every archived file is also recorded in the
+// manifest, unless it is nil.
+func writeArchive(srcDir, dest, compression string, level int, manifest *buildpackapplifecycle.DropletManifest) error {
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressor, err := newCompressor(file, compression, level)
+	if err != nil {
+		return err
+	}
+	if err := writeTar(compressor, srcDir, manifest); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func newCompressor(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	switch compression {
+	case buildpackapplifecycle.CompressionGzip:
+		if level == buildpackapplifecycle.DefaultCompressionLevel {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case buildpackapplifecycle.CompressionZstd:
+		options := []zstd.EOption{}
+		if level != buildpackapplifecycle.DefaultCompressionLevel {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, options...)
+
+	case buildpackapplifecycle.CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression: %s", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func writeTar(w io.Writer, srcDir string, manifest *buildpackapplifecycle.DropletManifest) error {
+	tarWriter := tar.NewWriter(w)
+	hardlinks := map[fileIdentity]string{}
+	digests := map[string]string{}
+
+	// WalkDir visits entries in lexical order
+	err := filepath.WalkDir(srcDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		name := "./"
+		if relPath != "." {
+			name += filepath.ToSlash(relPath)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := int64(info.Mode().Perm())
+		if info.Mode()&fs.ModeSetuid != 0 {
+			mode |= 04000
+		}
+		if info.Mode()&fs.ModeSetgid != 0 {
+			mode |= 02000
+		}
+		if info.Mode()&fs.ModeSticky != 0 {
+			mode |= 01000
+		}
+
+		header := &tar.Header{
+			Name:    name,
+			Mode:    mode,
+			ModTime: archiveModTime,
+		}
+
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			if relPath != "." {
+				header.Name += "/"
+			}
+
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = filepath.ToSlash(target)
+
+		case info.Mode().IsRegular():
+			if id, ok := hardlinkIdentity(info); ok {
+				if firstName, seen := hardlinks[id]; seen {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = firstName
+					break
+				}
+				hardlinks[id] = name
+			}
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+
+		default:
+			// sockets, pipes and devices have no place in a droplet
+			return nil
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			digest, err := copyFileTo(tarWriter, path)
+			if err != nil {
+				return err
+			}
+			digests[name] = digest
+
+		case tar.TypeLink:
+			digests[name] = digests[header.Linkname]
+		}
+
+		if manifest != nil && header.Typeflag != tar.TypeDir {
+			manifestFile := buildpackapplifecycle.DropletManifestFile{
+				Path:   strings.TrimPrefix(name, "./"),
+				Size:   info.Size(),
+				Mode:   fmt.Sprintf("%04o", mode),
+				SHA256: digests[name],
+			}
+			if header.Typeflag == tar.TypeSymlink {
+				manifestFile.LinkTarget = header.Linkname
+			}
+			manifest.Files = append(manifest.Files, manifestFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		if err := manifest.ComputeDigest(); err != nil {
+			return err
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// copyFileTo copies the file to w and returns the sha256 of its contents.
+func copyFileTo(w io.Writer, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package buildpackrunner
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+type fileIdentity struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkIdentity identifies files with more than one link, so that every
+// link after the first is archived as a hardlink rather than a second copy.
+func hardlinkIdentity(info fs.FileInfo) (fileIdentity, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileIdentity{}, false
+	}
+	return fileIdentity{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true //nolint:unconvert
+}
@@ -0,0 +1,11 @@
+package buildpackrunner
+
+import "io/fs"
+
+type fileIdentity struct{}
+
+// os.Stat does not expose file indexes on Windows, so hardlinked files are
+// archived as separate copies.
+func hardlinkIdentity(info fs.FileInfo) (fileIdentity, bool) {
+	return fileIdentity{}, false
+}
@@ -8,11 +8,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"testing"
 
-	"code.cloudfoundry.org/buildpackapplifecycle/test_helpers"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -26,7 +24,6 @@ var fileGitUrl url.URL
 var gitUrl url.URL
 var httpServer *httptest.Server
 var tmpDir string
-var tmpTarPath string
 
 var _ = SynchronizedBeforeSuite(func() []byte {
 	gitPath, err := exec.LookPath("git")
@@ -76,18 +73,12 @@ var _ = SynchronizedBeforeSuite(func() []byte {
 	execute(buildpackDir, gitPath, "checkout", "master")
 	execute(buildpackDir, gitPath, "update-server-info")
 
-	tarPath := ""
-	if runtime.GOOS == "windows" {
-		tarPath = test_helpers.DownloadOrFindWindowsTar()
-	}
-
-	return []byte(string(tmpDir+"|"+httpServer.Listener.Addr().String()) + "|" + tarPath)
+	return []byte(tmpDir + "|" + httpServer.Listener.Addr().String())
 
 }, func(data []byte) {
 	synchronizedData := strings.Split(string(data), "|")
 	tmpDir := synchronizedData[0]
 	gitUrlHost := synchronizedData[1]
-	tmpTarPath = synchronizedData[2]
 
 	gitUrl = url.URL{
 		Scheme: "http",
@@ -0,0 +1,147 @@
+package buildpackrunner
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// BuildpackCredentialsEnv holds netrc-formatted credentials for buildpack
+// hosts. The builder removes it from its environment before running any
+// buildpack scripts.
+const BuildpackCredentialsEnv = "CF_BUILDPACK_CREDENTIALS"
+
+// Credentials are logins for the hosts that buildpacks are downloaded from,
+// so that tokens need not be embedded in buildpack URLs.
+type Credentials struct {
+	machines []netrcMachine
+}
+
+type netrcMachine struct {
+	// empty for the default entry
+	host     string
+	login    string
+	password string
+}
+
+// ParseNetrc parses credentials in the format of a .netrc file. Macro
+// definitions and accounts are ignored.
+func ParseNetrc(contents string) (*Credentials, error) {
+	credentials := &Credentials{}
+
+	lines := strings.Split(contents, "\n")
+	var machine *netrcMachine
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			token := fields[j]
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+
+			value := func() (string, error) {
+				j++
+				if j >= len(fields) {
+					return "", fmt.Errorf("line %d: missing value for %s", i+1, token)
+				}
+				return fields[j], nil
+			}
+
+			switch token {
+			case "machine":
+				host, err := value()
+				if err != nil {
+					return nil, err
+				}
+				credentials.machines = append(credentials.machines, netrcMachine{host: host})
+				machine = &credentials.machines[len(credentials.machines)-1]
+
+			case "default":
+				credentials.machines = append(credentials.machines, netrcMachine{})
+				machine = &credentials.machines[len(credentials.machines)-1]
+
+			case "login", "password", "account":
+				v, err := value()
+				if err != nil {
+					return nil, err
+				}
+				if machine == nil {
+					return nil, fmt.Errorf("line %d: %s outside of a machine entry", i+1, token)
+				}
+				if token == "login" {
+					machine.login = v
+				} else if token == "password" {
+					machine.password = v
+				}
+
+			case "macdef":
+				// a macro runs until the next empty line
+				for i++; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				}
+				j = len(fields)
+
+			default:
+				return nil, fmt.Errorf("line %d: unexpected token %q", i+1, token)
+			}
+		}
+	}
+
+	return credentials, nil
+}
+
+// LoadCredentials reads the netrc file at path, if any, followed by the
+// credentials in the environment. Entries of the file take precedence.
+func LoadCredentials(path string) (*Credentials, error) {
+	credentials := &Credentials{}
+
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read buildpack credentials: %s", err.Error())
+		}
+		fromFile, err := ParseNetrc(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid buildpack credentials file %s: %s", path, err.Error())
+		}
+		credentials.machines = append(credentials.machines, fromFile.machines...)
+	}
+
+	if contents := os.Getenv(BuildpackCredentialsEnv); contents != "" {
+		fromEnv, err := ParseNetrc(contents)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid buildpack credentials in $%s: %s", BuildpackCredentialsEnv, err.Error())
+		}
+		credentials.machines = append(credentials.machines, fromEnv.machines...)
+	}
+
+	return credentials, nil
+}
+
+// Apply returns u with the login for its host, unless u already carries
+// credentials or is not an HTTP(S) URL. Only the first matching entry is
+// used, and a default entry only matches when no entry names the host.
+func (c *Credentials) Apply(u *url.URL) *url.URL {
+	if c == nil || u.User != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return u
+	}
+
+	var found *netrcMachine
+	for i := range c.machines {
+		machine := &c.machines[i]
+		if strings.EqualFold(machine.host, u.Hostname()) {
+			found = machine
+			break
+		}
+		if machine.host == "" && found == nil {
+			found = machine
+		}
+	}
+	if found == nil || found.login == "" {
+		return u
+	}
+
+	withCredentials := *u
+	withCredentials.User = url.UserPassword(found.login, found.password)
+	return &withCredentials
+}
@@ -9,6 +9,20 @@ type DeaStagingInfo struct {
 	DetectedBuildpack string                                 `json:"detected_buildpack" yaml:"detected_buildpack"`
 	StartCommand      string                                 `json:"start_command" yaml:"start_command"`
 	Config            *buildpackapplifecycle.BuildpackConfig `json:"config,omitempty" yaml:"config,omitempty"`
+	// ProcessEnv is the environment the buildpacks declared for each
+	// process type, which the launcher sets for the process it starts.
+	ProcessEnv map[string]map[string]string `json:"process_env,omitempty" yaml:"process_env,omitempty"`
+	SidecarEnv []SidecarEnv                 `json:"sidecar_env,omitempty" yaml:"sidecar_env,omitempty"`
+}
+
+// SidecarEnv is the environment the buildpacks declared for a sidecar. The
+// launcher is not told which sidecar it starts, so it is recognised by its
+// command, which staging ensures no other process it runs alongside shares.
+type SidecarEnv struct {
+	Name         string            `json:"name" yaml:"name"`
+	Command      string            `json:"command" yaml:"command"`
+	ProcessTypes []string          `json:"process_types" yaml:"process_types"`
+	Env          map[string]string `json:"env" yaml:"env"`
 }
 
 func (stagingInfo DeaStagingInfo) GetEntrypointPrefix() string {
@@ -18,3 +32,20 @@ func (stagingInfo DeaStagingInfo) GetEntrypointPrefix() string {
 
 	return ""
 }
+
+// GetEnv returns the environment declared for the sidecar that runs command
+// alongside processType, or else for processType itself.
+func (stagingInfo DeaStagingInfo) GetEnv(processType, command string) map[string]string {
+	for _, sidecar := range stagingInfo.SidecarEnv {
+		if sidecar.Command != command {
+			continue
+		}
+		for _, sidecarFor := range sidecar.ProcessTypes {
+			if processType == "" || sidecarFor == processType {
+				return sidecar.Env
+			}
+		}
+	}
+
+	return stagingInfo.ProcessEnv[processType]
+}
@@ -0,0 +1,120 @@
+package buildpackrunner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+type detectResult struct {
+	buildpack     string
+	buildpackPath string
+	err           error
+	// set when the buildpack was skipped for not supporting the stack
+	stackErr error
+
+	// script stdout is the detect output handed to the result; messages and
+	// errOutput are replayed to the staging log once the result is consumed,
+	// so that the output of concurrent scripts never interleaves
+	stdout    bytes.Buffer
+	messages  bytes.Buffer
+	errOutput bytes.Buffer
+
+	done chan struct{}
+}
+
+func (result *detectResult) flush() {
+	io.Copy(os.Stdout, &result.messages)  //nolint:errcheck
+	io.Copy(os.Stderr, &result.errOutput) //nolint:errcheck
+}
+
+// detectConcurrently runs up to -detectConcurrency detect scripts at the same
+// time. Results are consumed in BuildpackOrder, so the chosen buildpack is the
+// same one a sequential detect would have picked; once it is known, the
+// scripts still running for later buildpacks are cancelled.
+func (runner *Runner) detectConcurrently() (string, string, string, error) {
+	ctx, cancel := context.WithCancel(runner.ctx)
+	defer cancel()
+
+	buildpacks := runner.config.BuildpackOrder()
+	results := make([]*detectResult, len(buildpacks))
+	semaphore := make(chan struct{}, runner.config.DetectConcurrency())
+
+	var wg sync.WaitGroup
+	for i, buildpack := range buildpacks {
+		result := &detectResult{buildpack: buildpack, done: make(chan struct{})}
+		results[i] = result
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(result.done)
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				result.err = ctx.Err()
+				return
+			}
+
+			runner.detectOne(ctx, result)
+		}()
+	}
+	defer wg.Wait()
+
+	var stackErrs []error
+	for _, result := range results {
+		<-result.done
+		result.flush()
+
+		if result.err == nil {
+			cancel()
+			return result.buildpack, result.buildpackPath, strings.TrimRight(result.stdout.String(), "\r\n"), nil
+		}
+
+		if runner.detectShouldAbort(result.err) {
+			cancel()
+			return "", "", "", newStagingError(result.err, buildpackapplifecycle.DetectPhase, result.buildpack, buildpackapplifecycle.DetectFailMsg)
+		}
+
+		if result.stackErr != nil {
+			stackErrs = append(stackErrs, result.stackErr)
+		}
+	}
+
+	return "", "", "", runner.noBuildpackDetectedError(stackErrs)
+}
+
+func (runner *Runner) detectOne(ctx context.Context, result *detectResult) {
+	buildpackPath, err := runner.buildpackPath(result.buildpack)
+	if err != nil {
+		fmt.Fprintln(&result.errOutput, err.Error())
+		result.err = err
+		return
+	}
+	result.buildpackPath = buildpackPath
+
+	if err := runner.checkStack(result.buildpack, buildpackPath, &result.errOutput); err != nil {
+		result.err = err
+		result.stackErr = err
+		return
+	}
+
+	if err := runner.warnIfDetectNotExecutable(buildpackPath, &result.messages); err != nil {
+		fmt.Fprintln(&result.errOutput, err.Error())
+		result.err = err
+		return
+	}
+
+	result.err = runner.step(EventStepDetect, result.buildpack, func() error {
+		return runner.runScriptContext(ctx, result.buildpack, runner.config.DetectTimeout(), &result.stdout, &result.errOutput, filepath.Join(buildpackPath, "bin", "detect"), runner.config.BuildDir())
+	})
+}
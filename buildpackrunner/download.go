@@ -0,0 +1,91 @@
+package buildpackrunner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+type downloadResult struct {
+	buildpack    string
+	buildpackURL *url.URL
+	commit       string
+	err          error
+
+	// output is replayed to the staging log once the result is consumed, so
+	// that the output of concurrent downloads never interleaves
+	output bytes.Buffer
+
+	done chan struct{}
+}
+
+// downloadBuildpacks downloads up to -buildpackDownloadConcurrency URL
+// buildpacks at the same time. Results are consumed in BuildpackOrder, so the
+// staging log reads the same as that of sequential downloads, and every
+// failed download is reported rather than just the first.
+func (runner *Runner) downloadBuildpacks() error {
+	var results []*downloadResult
+	scheduled := map[string]bool{}
+	for _, buildpackName := range runner.config.BuildpackOrder() {
+		buildpackURL, err := url.Parse(buildpackName)
+		if err != nil {
+			return fmt.Errorf("Invalid buildpack url (%s): %s", buildpackapplifecycle.RedactCredentials(buildpackName), buildpackapplifecycle.RedactCredentials(err.Error()))
+		}
+		// a buildpack listed twice is downloaded to the same destination
+		if !buildpackURL.IsAbs() || scheduled[buildpackName] {
+			continue
+		}
+		scheduled[buildpackName] = true
+
+		results = append(results, &downloadResult{buildpack: buildpackName, buildpackURL: buildpackURL, done: make(chan struct{})})
+	}
+
+	cache := runner.downloadCache()
+	semaphore := make(chan struct{}, runner.config.BuildpackDownloadConcurrency())
+
+	var wg sync.WaitGroup
+	for _, result := range results {
+		wg.Add(1)
+		go func(result *downloadResult) {
+			defer wg.Done()
+			defer close(result.done)
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-runner.ctx.Done():
+				result.err = runner.ctx.Err()
+				return
+			}
+
+			result.err = runner.step(EventStepBuildpackDownload, result.buildpack, func() error {
+				var err error
+				result.commit, err = runner.downloadBuildpack(result.buildpack, result.buildpackURL, runner.config.BuildpackPath(result.buildpack), cache, &result.output)
+				return err
+			})
+		}(result)
+	}
+	defer wg.Wait()
+
+	var errs []error
+	for _, result := range results {
+		<-result.done
+		io.Copy(os.Stdout, &result.output) //nolint:errcheck
+
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+		if result.commit != "" {
+			runner.gitCommits[result.buildpack] = result.commit
+		}
+	}
+
+	return errors.Join(errs...)
+}
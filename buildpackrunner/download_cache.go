@@ -0,0 +1,307 @@
+package buildpackrunner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	downloadCacheMetadataSuffix = ".json"
+	downloadCacheLockSuffix     = ".lock"
+)
+
+// DownloadCache keeps downloaded buildpack archives in a directory that
+// outlives a single staging. Archives pinned by digest are stored under that
+// digest and are reused without touching the network; all other archives are
+// stored under their URL together with the ETag/Last-Modified validators of
+// the response, so that a later download can be made conditional.
+type DownloadCache struct {
+	dir     string
+	maxSize uint64
+
+	// archives handed out and not yet released are never evicted, as
+	// concurrent downloads may still be extracting them; the shared locks
+	// held on their lock files keep stagings sharing the directory from
+	// evicting them too
+	mutex sync.Mutex
+	inUse map[string][]*os.File
+}
+
+type downloadCacheEntry struct {
+	URL          string    `json:"url"`
+	Digest       string    `json:"digest,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Size         int64     `json:"size"`
+	LastUsed     time.Time `json:"last_used"`
+
+	key string
+}
+
+func NewDownloadCache(dir string, maxSize uint64) *DownloadCache {
+	return &DownloadCache{dir: dir, maxSize: maxSize, inUse: map[string][]*os.File{}}
+}
+
+// lookup returns the cached entry for the URL or digest and the path of its
+// archive, which is kept until it is released. A missing or unreadable entry
+// is reported as a miss and need not be released.
+func (c *DownloadCache) lookup(u string, digest *BuildpackDigest) (*downloadCacheEntry, string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := c.key(u, digest)
+
+	// the lock is taken first, so that the entry is either evicted before
+	// it is read or not at all
+	lock, _, err := lockFile(c.lockPath(key), false, true)
+	if err != nil {
+		return nil, "", false
+	}
+
+	entry, err := c.readEntry(key)
+	if err != nil {
+		lock.Close()
+		return nil, "", false
+	}
+
+	archivePath := c.archivePath(key)
+	if _, err := os.Stat(archivePath); err != nil {
+		lock.Close()
+		return nil, "", false
+	}
+	c.inUse[key] = append(c.inUse[key], lock)
+
+	return entry, archivePath, true
+}
+
+// createTemp creates a file inside the cache directory, so that it can be
+// stored without copying.
+func (c *DownloadCache) createTemp(pattern string) (*os.File, error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(c.dir, pattern+".*.tmp")
+}
+
+// touch marks an entry handed out by lookup as recently used so that it is
+// evicted last.
+func (c *DownloadCache) touch(entry *downloadCacheEntry) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry.LastUsed = time.Now().UTC()
+	return c.writeEntry(entry)
+}
+
+// release allows the archive handed out by lookup or store to be evicted
+// again.
+func (c *DownloadCache) release(archivePath string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := filepath.Base(archivePath)
+	locks := c.inUse[key]
+	if len(locks) == 0 {
+		return
+	}
+
+	locks[len(locks)-1].Close()
+	if len(locks) == 1 {
+		delete(c.inUse, key)
+	} else {
+		c.inUse[key] = locks[:len(locks)-1]
+	}
+}
+
+// store moves the downloaded archive into the cache and evicts the least
+// recently used entries until the cache fits its maximum size again. The
+// returned path is the archive's new location, kept until it is released.
+// The archive is removed when it cannot be stored.
+func (c *DownloadCache) store(u string, digest *BuildpackDigest, etag, lastModified, archive string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		os.Remove(archive)
+		return "", err
+	}
+
+	fi, err := os.Stat(archive)
+	if err != nil {
+		os.Remove(archive)
+		return "", err
+	}
+
+	entry := &downloadCacheEntry{
+		URL:          u,
+		ETag:         etag,
+		LastModified: lastModified,
+		Size:         fi.Size(),
+		LastUsed:     time.Now().UTC(),
+		key:          c.key(u, digest),
+	}
+	if digest != nil {
+		entry.Digest = digest.String()
+	}
+
+	lock, _, err := lockFile(c.lockPath(entry.key), false, true)
+	if err != nil {
+		os.Remove(archive)
+		return "", err
+	}
+
+	archivePath := c.archivePath(entry.key)
+	if err := os.Rename(archive, archivePath); err != nil {
+		lock.Close()
+		os.Remove(archive)
+		return "", err
+	}
+
+	if err := c.writeEntry(entry); err != nil {
+		lock.Close()
+		os.Remove(archivePath)
+		return "", err
+	}
+	c.inUse[entry.key] = append(c.inUse[entry.key], lock)
+
+	if err := c.evict(); err != nil {
+		c.inUse[entry.key] = c.inUse[entry.key][:len(c.inUse[entry.key])-1]
+		lock.Close()
+		return "", err
+	}
+	return archivePath, nil
+}
+
+func (c *DownloadCache) evict() error {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var entries []*downloadCacheEntry
+	var total uint64
+	for _, file := range files {
+		key, isMetadata := strings.CutSuffix(file.Name(), downloadCacheMetadataSuffix)
+		if !isMetadata {
+			continue
+		}
+
+		entry, err := c.readEntry(key)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+		total += uint64(entry.Size)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if len(c.inUse[entry.key]) > 0 {
+			continue
+		}
+
+		removed, err := c.remove(entry.key)
+		if err != nil {
+			return err
+		}
+		if removed {
+			total -= uint64(entry.Size)
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the entry unless another staging sharing the directory is
+// using it, which it tells by the lock on the entry's lock file. The lock
+// file itself is kept, so that every staging locks the same file.
+func (c *DownloadCache) remove(key string) (bool, error) {
+	lock, locked, err := lockFile(c.lockPath(key), true, false)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer lock.Close()
+
+	if err := os.Remove(c.metadataPath(key)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Remove(c.archivePath(key)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// pinned archives are content addressed, so the same buildpack served from
+// different URLs is only cached once
+func (c *DownloadCache) key(u string, digest *BuildpackDigest) string {
+	if digest != nil {
+		return fmt.Sprintf("%s-%s", digest.Algorithm, digest.Value)
+	}
+
+	sum := sha256.Sum256([]byte(u))
+	return "url-" + hex.EncodeToString(sum[:])
+}
+
+func (c *DownloadCache) readEntry(key string) (*downloadCacheEntry, error) {
+	contents, err := os.ReadFile(c.metadataPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &downloadCacheEntry{}
+	if err := json.Unmarshal(contents, entry); err != nil {
+		return nil, err
+	}
+	entry.key = key
+
+	return entry, nil
+}
+
+func (c *DownloadCache) writeEntry(entry *downloadCacheEntry) error {
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(c.dir, entry.key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), c.metadataPath(entry.key))
+}
+
+func (c *DownloadCache) archivePath(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func (c *DownloadCache) metadataPath(key string) string {
+	return filepath.Join(c.dir, key+downloadCacheMetadataSuffix)
+}
+
+func (c *DownloadCache) lockPath(key string) string {
+	return filepath.Join(c.dir, key+downloadCacheLockSuffix)
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package buildpackrunner
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile locks the file, shared unless exclusive is set, until it is
+// closed. Unless wait is set, a lock that is not free right away is given up
+// on and false is returned.
+func lockFile(path string, exclusive, wait bool) (*os.File, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return file, true, nil
+}
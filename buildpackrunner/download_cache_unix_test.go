@@ -0,0 +1,19 @@
+//go:build !windows
+
+package buildpackrunner_test
+
+import (
+	"os"
+	"syscall"
+
+	. "github.com/onsi/gomega"
+)
+
+// lockShared holds a shared lock on the file the way another staging using
+// the same download cache does, until the file is closed.
+func lockShared(path string) *os.File {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(syscall.Flock(int(file.Fd()), syscall.LOCK_SH)).To(Succeed())
+	return file
+}
@@ -0,0 +1,18 @@
+package buildpackrunner_test
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+
+	. "github.com/onsi/gomega"
+)
+
+// lockShared holds a shared lock on the file the way another staging using
+// the same download cache does, until the file is closed.
+func lockShared(path string) *os.File {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(windows.LockFileEx(windows.Handle(file.Fd()), 0, 0, 1, 0, &windows.Overlapped{})).To(Succeed())
+	return file
+}
@@ -0,0 +1,136 @@
+package buildpackrunner
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+const (
+	EventStepBuildpackDownload = "buildpack_download"
+	EventStepDetect            = "detect"
+	EventStepSupply            = "supply"
+	EventStepFinalize          = "finalize"
+	EventStepCompile           = "compile"
+	EventStepRelease           = "release"
+	EventStepProcfile          = "procfile"
+	EventStepPackageDroplet    = "package_droplet"
+	EventStepPackageCache      = "package_build_artifacts_cache"
+
+	EventStatusStarted   = "started"
+	EventStatusSucceeded = "succeeded"
+	EventStatusFailed    = "failed"
+)
+
+// Event is a single lifecycle step, written as one JSON line to the file
+// given by -outputEvents so that tooling can follow staging as it happens.
+type Event struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Step      string         `json:"step"`
+	Status    string         `json:"status"`
+	Buildpack string         `json:"buildpack,omitempty"`
+	ExitCode  *int           `json:"exit_code,omitempty"`
+	Duration  *float64       `json:"duration_seconds,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// steps that run a buildpack script and therefore report an exit code
+var scriptSteps = map[string]bool{
+	EventStepDetect:   true,
+	EventStepSupply:   true,
+	EventStepFinalize: true,
+	EventStepCompile:  true,
+	EventStepRelease:  true,
+}
+
+type eventWriter struct {
+	mu      sync.Mutex
+	closer  io.Closer
+	encoder *json.Encoder
+}
+
+func openEventWriter(path string) (*eventWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eventWriter{closer: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// emit is a no-op on a nil writer, so callers never need to check whether
+// events were requested.
+func (e *eventWriter) emit(event Event) {
+	if e == nil {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	event.Buildpack = buildpackapplifecycle.RedactCredentials(event.Buildpack)
+	event.Error = buildpackapplifecycle.RedactCredentials(event.Error)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.encoder.Encode(event) //nolint:errcheck
+}
+
+func (e *eventWriter) Close() error {
+	if e == nil || e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
+
+// step emits a started event, runs fn, and emits a succeeded or failed event
+// carrying the duration and, for buildpack scripts, the exit code.
+func (runner *Runner) step(step, buildpack string, fn func() error) error {
+	runner.events.emit(Event{Step: step, Status: EventStatusStarted, Buildpack: buildpack})
+
+	start := time.Now()
+	err := fn()
+	duration := time.Since(start).Seconds()
+
+	event := Event{
+		Step:      step,
+		Status:    EventStatusSucceeded,
+		Buildpack: buildpack,
+		Duration:  &duration,
+	}
+	if scriptSteps[step] {
+		event.ExitCode = exitCode(err)
+	}
+	if err != nil {
+		event.Status = EventStatusFailed
+		event.Error = err.Error()
+	}
+	runner.events.emit(event)
+
+	return err
+}
+
+func exitCode(err error) *int {
+	code := 0
+	if err == nil {
+		return &code
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+		return &code
+	}
+	return nil
+}
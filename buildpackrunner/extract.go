@@ -0,0 +1,301 @@
+package buildpackrunner
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// maxSymlinkHops is the number of links followed while resolving a path,
+// as on Linux.
+const maxSymlinkHops = 40
+
+// ExtractionLimits bound what extracting a buildpack archive may write, so
+// that a broken or malicious archive cannot fill the disk. A zero limit is
+// no limit.
+type ExtractionLimits struct {
+	// MaxSize is the total size of the extracted files, in bytes.
+	MaxSize uint64
+	// MaxEntries is the number of files, directories and links.
+	MaxEntries int
+}
+
+// extraction writes the entries of an archive into destination, and keeps
+// count of them against the limits. Symlinks are only created once all other
+// entries are written, so that nothing is ever written through one.
+type extraction struct {
+	destination string
+	limits      ExtractionLimits
+
+	entries  int
+	size     uint64
+	symlinks []archiveSymlink
+}
+
+type archiveSymlink struct {
+	name   string
+	target string
+}
+
+func newExtraction(destination string, limits ExtractionLimits) *extraction {
+	return &extraction{destination: destination, limits: limits}
+}
+
+func extractArchive(archivePath string, format ArchiveFormat, destination string, limits ExtractionLimits) error {
+	if format == ArchiveZip {
+		return extractZip(archivePath, newExtraction(destination, limits))
+	}
+	return extractTar(archivePath, format, newExtraction(destination, limits))
+}
+
+func extractZip(archivePath string, e *extraction) error {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return err
+	}
+	defer reader.Close()
+
+	for _, file := range reader.File {
+		name, err := e.entry(file.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.mkdir(name, mode.Perm())
+
+		case mode&os.ModeSymlink != 0:
+			var target string
+			target, err = readZipSymlink(file)
+			if err == nil {
+				err = e.symlink(name, target)
+			}
+
+		case mode.IsRegular():
+			var r io.ReadCloser
+			r, err = file.Open()
+			if err == nil {
+				err = e.writeFile(name, r, mode.Perm())
+				r.Close()
+			}
+
+		default:
+			// devices, fifos and the like have no place in a buildpack
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.finish()
+}
+
+// readZipSymlink returns the target of a symlink, which zip stores as the
+// contents of the entry.
+func readZipSymlink(file *zip.File) (string, error) {
+	r, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	target, err := io.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
+// entry counts an entry against the limits and returns its path relative to
+// the destination.
+func (e *extraction) entry(name string) (string, error) {
+	e.entries++
+	if e.limits.MaxEntries > 0 && e.entries > e.limits.MaxEntries {
+		return "", fmt.Errorf("archive has more than %d entries", e.limits.MaxEntries)
+	}
+	return localArchivePath(name)
+}
+
+func (e *extraction) mkdir(name string, mode os.FileMode) error {
+	return os.MkdirAll(filepath.Join(e.destination, name), mode|0700)
+}
+
+func (e *extraction) writeFile(name string, r io.Reader, mode os.FileMode) error {
+	target := filepath.Join(e.destination, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// the sizes in headers are not to be trusted, so what is written counts
+	if e.limits.MaxSize > 0 {
+		r = io.LimitReader(r, int64(e.limits.MaxSize-e.size)+1)
+	}
+	n, err := io.Copy(file, r)
+	e.size += uint64(n)
+	if err != nil {
+		return err
+	}
+	if e.limits.MaxSize > 0 && e.size > e.limits.MaxSize {
+		return fmt.Errorf("archive extracts to more than %s", bytefmt.ByteSize(e.limits.MaxSize))
+	}
+	return file.Close()
+}
+
+// link hard links name to the regular file target, both relative to the
+// destination.
+func (e *extraction) link(name, target string) error {
+	localTarget, err := localArchivePath(target)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(filepath.Join(e.destination, localTarget))
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("illegal link in archive: %s -> %s", name, target)
+	}
+
+	linkPath := filepath.Join(e.destination, name)
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return err
+	}
+	return os.Link(filepath.Join(e.destination, localTarget), linkPath)
+}
+
+// symlink records a symlink to create once all other entries are written.
+// Its target must be relative and lead to somewhere inside the destination.
+func (e *extraction) symlink(name, target string) error {
+	slashTarget := filepath.ToSlash(target)
+	if target == "" || path.IsAbs(slashTarget) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return fmt.Errorf("illegal link in archive: %s -> %s", filepath.ToSlash(name), target)
+	}
+
+	resolved := path.Join(path.Dir(filepath.ToSlash(name)), slashTarget)
+	if !filepath.IsLocal(filepath.FromSlash(resolved)) && resolved != "." {
+		return fmt.Errorf("illegal link in archive: %s -> %s", filepath.ToSlash(name), target)
+	}
+
+	e.symlinks = append(e.symlinks, archiveSymlink{name: name, target: target})
+	return nil
+}
+
+// finish creates the symlinks. A link may only be created where no other
+// link leads, and once all of them exist every one of them must still
+// resolve inside the destination: a link to "a/../b" is harmless on its own,
+// but not once "a" turns out to be a link to "..".
+func (e *extraction) finish() error {
+	for _, symlink := range e.symlinks {
+		if err := e.checkParents(symlink.name); err != nil {
+			return err
+		}
+
+		linkPath := filepath.Join(e.destination, symlink.name)
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(symlink.target, linkPath); err != nil {
+			return err
+		}
+	}
+
+	for _, symlink := range e.symlinks {
+		if err := e.resolve(symlink.name); err != nil {
+			os.Remove(filepath.Join(e.destination, symlink.name))
+			return fmt.Errorf("illegal link in archive: %s -> %s: %s", filepath.ToSlash(symlink.name), symlink.target, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkParents fails when a directory on the way to name is a link.
+func (e *extraction) checkParents(name string) error {
+	parent := filepath.Dir(name)
+	for parent != "." {
+		fi, err := os.Lstat(filepath.Join(e.destination, parent))
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal path in archive: %s is inside the link %s", filepath.ToSlash(name), filepath.ToSlash(parent))
+		}
+		parent = filepath.Dir(parent)
+	}
+	return nil
+}
+
+// resolve follows the links on the path name, relative to the destination,
+// the way the system would, and fails when they lead outside of it. Links
+// to files that do not exist are fine, as long as they point inside.
+func (e *extraction) resolve(name string) error {
+	pending := strings.Split(filepath.ToSlash(name), "/")
+	resolved := []string{}
+
+	for hops := 0; len(pending) > 0; {
+		component := pending[0]
+		pending = pending[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return errors.New("leads outside of the buildpack")
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, component)
+		target, err := os.Readlink(filepath.Join(e.destination, filepath.Join(resolved...)))
+		if err != nil {
+			// not a link, or nothing at all
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return errors.New("too many levels of links")
+		}
+		if path.IsAbs(filepath.ToSlash(target)) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+			return errors.New("leads outside of the buildpack")
+		}
+		resolved = resolved[:len(resolved)-1]
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+
+	return nil
+}
+
+// localArchivePath returns the name of an archive entry as a path relative to
+// the extraction directory. Absolute names and names that lead outside of it
+// are rejected.
+func localArchivePath(name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+
+	cleanName := path.Clean(name)
+	local := filepath.FromSlash(cleanName)
+	if !filepath.IsLocal(local) && cleanName != "." {
+		return "", fmt.Errorf("illegal path in archive: %s", name)
+	}
+	return local, nil
+}
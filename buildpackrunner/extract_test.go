@@ -0,0 +1,136 @@
+package buildpackrunner_test
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Safe extraction", func() {
+	var (
+		archiveDir  string
+		destination string
+		limits      buildpackrunner.ExtractionLimits
+	)
+
+	writeTar := func(entries ...archiveEntry) string {
+		archivePath := filepath.Join(archiveDir, "buildpack.tar")
+		Expect(os.WriteFile(archivePath, newTar(entries...), 0644)).To(Succeed())
+		return archivePath
+	}
+
+	writeZip := func(entries ...archiveEntry) string {
+		archivePath := filepath.Join(archiveDir, "buildpack.zip")
+		Expect(os.WriteFile(archivePath, newZip(entries...), 0644)).To(Succeed())
+		return archivePath
+	}
+
+	extract := func(archivePath string) error {
+		_, err := buildpackrunner.CopyLocalBuildpack(&url.URL{Scheme: "file", Path: filepath.ToSlash(archivePath)}, destination, limits)
+		return err
+	}
+
+	BeforeEach(func() {
+		archiveDir = GinkgoT().TempDir()
+		destination = filepath.Join(GinkgoT().TempDir(), "buildpack")
+		limits = buildpackrunner.ExtractionLimits{}
+	})
+
+	for _, format := range []struct {
+		name  string
+		write func(...archiveEntry) string
+	}{
+		{"tarballs", writeTar},
+		{"zip files", writeZip},
+	} {
+		write := format.write
+
+		Context("for "+format.name, func() {
+			It("extracts files within the limits", func() {
+				limits = buildpackrunner.ExtractionLimits{MaxSize: 10, MaxEntries: 2}
+
+				Expect(extract(write(archiveEntry{name: "bin/detect", contents: "12345"}, archiveEntry{name: "VERSION", contents: "12345"}))).To(Succeed())
+				Expect(filepath.Join(destination, "bin", "detect")).To(BeAnExistingFile())
+			})
+
+			It("rejects entries that traverse out of the destination", func() {
+				err := extract(write(archiveEntry{name: "bin/../../escaped", contents: "nope"}))
+				Expect(err).To(MatchError(ContainSubstring("illegal path in archive: bin/../../escaped")))
+				Expect(filepath.Join(filepath.Dir(destination), "escaped")).NotTo(BeAnExistingFile())
+			})
+
+			It("rejects absolute paths", func() {
+				err := extract(write(archiveEntry{name: "/etc/escaped", contents: "nope"}))
+				Expect(err).To(MatchError(ContainSubstring("illegal path in archive: /etc/escaped")))
+			})
+
+			It("rejects archives that extract to more than the size limit", func() {
+				limits.MaxSize = 8
+
+				err := extract(write(archiveEntry{name: "a", contents: "12345"}, archiveEntry{name: "b", contents: "12345"}))
+				Expect(err).To(MatchError(ContainSubstring("archive extracts to more than 8B")))
+			})
+
+			It("rejects archives with more entries than the limit", func() {
+				limits.MaxEntries = 2
+
+				err := extract(write(archiveEntry{name: "a"}, archiveEntry{name: "b"}, archiveEntry{name: "c"}))
+				Expect(err).To(MatchError(ContainSubstring("archive has more than 2 entries")))
+				Expect(filepath.Join(destination, "c")).NotTo(BeAnExistingFile())
+			})
+
+			Context("with symlinks", func() {
+				BeforeEach(func() {
+					if runtime.GOOS == "windows" {
+						Skip("links need privileges on Windows")
+					}
+				})
+
+				It("extracts links within the destination", func() {
+					Expect(extract(write(
+						archiveEntry{name: "lib/v1/run", contents: "#!/bin/sh\n"},
+						archiveEntry{name: "lib/current", symlink: "v1"},
+						archiveEntry{name: "bin/run", symlink: "../lib/current/run"},
+					))).To(Succeed())
+
+					contents, err := os.ReadFile(filepath.Join(destination, "bin", "run"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("#!/bin/sh\n"))
+				})
+
+				It("rejects links to absolute paths", func() {
+					err := extract(write(archiveEntry{name: "passwd", symlink: "/etc/passwd"}))
+					Expect(err).To(MatchError(ContainSubstring("illegal link in archive: passwd -> /etc/passwd")))
+				})
+
+				It("rejects links that lead out of the destination", func() {
+					err := extract(write(archiveEntry{name: "bin/escape", symlink: "../../.."}))
+					Expect(err).To(MatchError(ContainSubstring("illegal link in archive: bin/escape -> ../../..")))
+				})
+
+				It("rejects links that only lead out through other links", func() {
+					err := extract(write(
+						archiveEntry{name: "escape", symlink: "here/../outside"},
+						archiveEntry{name: "here", symlink: "."},
+					))
+					Expect(err).To(MatchError(ContainSubstring("illegal link in archive: escape -> here/../outside")))
+					Expect(filepath.Join(destination, "escape")).NotTo(BeAnExistingFile())
+				})
+
+				It("never creates a link inside another link", func() {
+					err := extract(write(
+						archiveEntry{name: "parent", symlink: "."},
+						archiveEntry{name: "parent/child", symlink: "target"},
+					))
+					Expect(err).To(MatchError(ContainSubstring("illegal path in archive: parent/child is inside the link parent")))
+				})
+			})
+		})
+	}
+})
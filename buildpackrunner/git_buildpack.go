@@ -1,23 +1,192 @@
 package buildpackrunner
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
 )
 
+// GitRef is what the fragment of a git buildpack URL selects. A plain
+// fragment names a branch or tag, e.g. https://example.com/buildpack.git#v1.2,
+// while a query-style fragment pins a commit and/or a subdirectory of the
+// repository holding the buildpack, e.g.
+// https://example.com/monorepo.git#commit=<sha>&path=buildpacks/ruby
+type GitRef struct {
+	Branch string
+	Commit string
+	Path   string
+}
+
+// ParseGitRef parses the fragment of a git buildpack URL.
+func ParseGitRef(fragment string) (GitRef, error) {
+	if !strings.Contains(fragment, "=") {
+		return GitRef{Branch: fragment}, nil
+	}
+
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': %s", fragment, err.Error())
+	}
+
+	ref := GitRef{}
+	for key, value := range values {
+		if len(value) != 1 {
+			return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': %s must be given once", fragment, key)
+		}
+
+		switch key {
+		case "branch":
+			ref.Branch = value[0]
+		case "commit":
+			ref.Commit = strings.ToLower(value[0])
+		case "path":
+			ref.Path = value[0]
+		default:
+			return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': unknown key %s", fragment, key)
+		}
+	}
+
+	if ref.Branch != "" && ref.Commit != "" {
+		return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': branch and commit are mutually exclusive", fragment)
+	}
+
+	// only full object names can be fetched on their own, and only those
+	// pin the buildpack unambiguously
+	if _, err := hex.DecodeString(ref.Commit); ref.Commit != "" && (err != nil || (len(ref.Commit) != 40 && len(ref.Commit) != 64)) {
+		return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': commit must be a full SHA", fragment)
+	}
+
+	if ref.Path != "" {
+		cleanPath := path.Clean(ref.Path)
+		if path.IsAbs(cleanPath) || cleanPath == "." || cleanPath == ".." || strings.HasPrefix(cleanPath, "../") {
+			return GitRef{}, fmt.Errorf("Invalid git buildpack fragment '%s': path must be a subdirectory of the repository", fragment)
+		}
+		ref.Path = cleanPath
+	}
+
+	return ref, nil
+}
+
+// GitClone clones the repository into destination, checked out at the ref in
+// the URL fragment. When the fragment names a path, only that subdirectory
+// ends up in destination. Credentials in an HTTP(S) URL are passed to git in
+// its environment rather than its arguments.
 func GitClone(repo url.URL, destination string) error {
+	_, err := GitCloneWithOptions(repo, destination, TransportOptions{})
+	return err
+}
+
+// GitCloneWithOptions is GitClone with the certificates and proxy that git
+// connects with, and returns the SHA of the commit that was checked out.
+func GitCloneWithOptions(repo url.URL, destination string, transport TransportOptions) (string, error) {
 	gitPath, err := exec.LookPath("git")
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	branch := repo.Fragment
+	ref, err := ParseGitRef(repo.Fragment)
+	if err != nil {
+		return "", err
+	}
 	repo.Fragment = ""
+	g, err := newGitRunner(gitPath, &repo, transport)
+	if err != nil {
+		return "", err
+	}
+	defer g.cleanup()
 	gitUrl := repo.String()
 
-	err = performGitClone(gitPath,
+	cloneDir := destination
+	if ref.Path != "" {
+		if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+			return "", err
+		}
+		cloneDir, err = os.MkdirTemp(filepath.Dir(destination), filepath.Base(destination)+"-clone")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(cloneDir)
+	}
+
+	if ref.Commit != "" {
+		err = g.checkoutCommit(gitUrl, ref.Commit, cloneDir)
+	} else {
+		err = g.cloneBranch(gitUrl, ref.Branch, cloneDir)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sha, err := g.run(cloneDir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	if ref.Path != "" {
+		subdir := filepath.Join(cloneDir, filepath.FromSlash(ref.Path))
+		if fi, err := os.Stat(subdir); err != nil || !fi.IsDir() {
+			return "", fmt.Errorf("Failed to find path '%s' in git repository at %s", ref.Path, gitUrl)
+		}
+
+		if err := os.RemoveAll(destination); err != nil {
+			return "", err
+		}
+		if err := os.Rename(subdir, destination); err != nil {
+			return "", err
+		}
+	}
+
+	return sha, nil
+}
+
+type gitRunner struct {
+	path    string
+	env     []string
+	cleanup func()
+}
+
+// newGitRunner moves the credentials of an HTTP(S) repo URL into an
+// Authorization header for that host, configured through the environment so
+// that they never show up in the arguments of a git process.
+func newGitRunner(gitPath string, repo *url.URL, transport TransportOptions) (gitRunner, error) {
+	transportEnv, cleanup, err := transport.gitEnv()
+	if err != nil {
+		return gitRunner{}, err
+	}
+
+	g := gitRunner{
+		path:    gitPath,
+		env:     append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), transportEnv...),
+		cleanup: cleanup,
+	}
+
+	if repo.User == nil || (repo.Scheme != "http" && repo.Scheme != "https") {
+		return g, nil
+	}
+
+	password, _ := repo.User.Password()
+	auth := base64.StdEncoding.EncodeToString([]byte(repo.User.Username() + ":" + password))
+	repo.User = nil
+
+	g.env = append(g.env,
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=http.%s://%s/.extraHeader", repo.Scheme, repo.Host),
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+	)
+	return g, nil
+}
+
+func (g gitRunner) cloneBranch(gitUrl, branch, destination string) error {
+	err := g.clone(
 		[]string{
 			"--depth",
 			"1",
@@ -32,7 +201,7 @@ func GitClone(repo url.URL, destination string) error {
 			return fmt.Errorf("Failed to remove %s prior to cloning on top: %s", destination, err)
 		}
 
-		err = performGitClone(gitPath,
+		err = g.clone(
 			[]string{
 				"--recursive",
 				gitUrl,
@@ -47,17 +216,78 @@ func GitClone(repo url.URL, destination string) error {
 	return nil
 }
 
-func performGitClone(gitPath string, args []string, branch string) error {
+// checkoutCommit fetches just the commit where the server allows fetching by
+// SHA, and otherwise clones the whole repository to check it out.
+func (g gitRunner) checkoutCommit(gitUrl, commit, destination string) error {
+	err := g.fetchCommit(gitUrl, commit, destination)
+	if err == nil {
+		return nil
+	}
+
+	if err := os.RemoveAll(destination); err != nil {
+		return fmt.Errorf("Failed to remove %s prior to cloning on top: %s", destination, err)
+	}
+
+	if err := g.clone([]string{"--no-checkout", gitUrl, destination}, ""); err != nil {
+		return fmt.Errorf("Failed to clone git repository at %s", gitUrl)
+	}
+	if _, err := g.run(destination, "checkout", "--quiet", commit); err != nil {
+		return fmt.Errorf("Failed to check out commit %s of git repository at %s", commit, gitUrl)
+	}
+	if _, err := g.run(destination, "submodule", "update", "--init", "--recursive"); err != nil {
+		return fmt.Errorf("Failed to update submodules of git repository at %s", gitUrl)
+	}
+
+	return nil
+}
+
+func (g gitRunner) fetchCommit(gitUrl, commit, destination string) error {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return err
+	}
+
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", gitUrl},
+		{"fetch", "--quiet", "--depth", "1", "origin", commit},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+		{"submodule", "update", "--init", "--recursive", "--depth", "1"},
+	} {
+		if _, err := g.run(destination, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g gitRunner) clone(args []string, branch string) error {
 	args = append([]string{"clone"}, args...)
 
 	if branch != "" {
 		args = append(args, "-b", branch)
 	}
-	cmd := exec.Command(gitPath, args...)
+	cmd := exec.Command(g.path, args...)
+	cmd.Env = g.env
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		err = fmt.Errorf("git clone failed:\n%s\n%w\n", output, err)
+		err = fmt.Errorf("git clone failed:\n%s\n%w\n", buildpackapplifecycle.RedactCredentials(string(output)), err)
 	}
 
 	return err
 }
+
+func (g gitRunner) run(dir string, args ...string) (string, error) {
+	cmd := exec.Command(g.path, args...)
+	cmd.Dir = dir
+	cmd.Env = g.env
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed:\n%s\n%w\n", args[0], buildpackapplifecycle.RedactCredentials(stderr.String()), err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
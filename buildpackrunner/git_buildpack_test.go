@@ -1,8 +1,12 @@
 package buildpackrunner_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
@@ -102,6 +106,12 @@ var _ = Describe("GitBuildpack", func() {
 				Expect(currentBranch(cloneTarget)).To(Equal("a_lightweight_tag"))
 			})
 
+			It("returns the SHA of the checked out commit", func() {
+				sha, err := buildpackrunner.GitCloneWithOptions(fileGitUrl, cloneTarget, buildpackrunner.TransportOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sha).To(Equal(revParse(fileGitUrl.Path, "master")))
+			})
+
 			It("does a shallow clone of the repo", func() {
 				gitPath, err := exec.LookPath("git")
 				Expect(err).NotTo(HaveOccurred())
@@ -122,9 +132,170 @@ var _ = Describe("GitBuildpack", func() {
 				Expect(output).To(Equal("1"))
 			})
 		})
+
+		for _, transport := range []struct {
+			description string
+			url         func() url.URL
+		}{
+			{"that doesn't support fetching a commit", func() url.URL { return gitUrl }},
+			{"that supports fetching a commit", func() url.URL { return fileGitUrl }},
+		} {
+			transport := transport
+
+			Context("With a Git transport "+transport.description, func() {
+				It("checks out a pinned commit", func() {
+					commit := revParse(fileGitUrl.Path, "master^")
+					commitUrl := transport.url()
+					commitUrl.Fragment = "commit=" + commit
+
+					sha, err := buildpackrunner.GitCloneWithOptions(commitUrl, cloneTarget, buildpackrunner.TransportOptions{})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(sha).To(Equal(commit))
+					Expect(revParse(cloneTarget, "HEAD")).To(Equal(commit))
+
+					fileContents, err := os.ReadFile(filepath.Join(cloneTarget, "sub", "README"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(fileContents)).To(Equal("1st commit"))
+				})
+
+				It("fails for a commit that does not exist", func() {
+					commitUrl := transport.url()
+					commitUrl.Fragment = "commit=" + strings.Repeat("0", 40)
+
+					err := buildpackrunner.GitClone(commitUrl, cloneTarget)
+					Expect(err).To(MatchError(ContainSubstring("Failed to check out commit")))
+				})
+			})
+		}
+
+		Context("with credentials in the url", func() {
+			var authServer *httptest.Server
+
+			BeforeEach(func() {
+				fileServer := http.FileServer(http.Dir(tmpDir))
+				authServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "s3cr3t-token" {
+						w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					fileServer.ServeHTTP(w, r)
+				}))
+			})
+
+			AfterEach(func() {
+				authServer.Close()
+			})
+
+			privateUrl := func(password string) url.URL {
+				u, err := url.Parse(authServer.URL + gitUrl.Path)
+				Expect(err).NotTo(HaveOccurred())
+				u.User = url.UserPassword("user", password)
+				return *u
+			}
+
+			It("authenticates with them", func() {
+				err := buildpackrunner.GitClone(privateUrl("s3cr3t-token"), cloneTarget)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(cloneTarget, "content")).To(BeAnExistingFile())
+
+				remote := exec.Command("git", "remote", "get-url", "origin")
+				remote.Dir = cloneTarget
+				output, err := remote.Output()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(output)).NotTo(ContainSubstring("s3cr3t-token"))
+			})
+
+			It("does not reveal them in errors", func() {
+				err := buildpackrunner.GitClone(privateUrl("wrong-s3cr3t"), cloneTarget)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).NotTo(ContainSubstring("wrong-s3cr3t"))
+			})
+		})
+
+		Context("with a path", func() {
+			var destination string
+
+			BeforeEach(func() {
+				destination = filepath.Join(cloneTarget, "buildpack")
+			})
+
+			It("only keeps that subdirectory of the repository", func() {
+				pathUrl := fileGitUrl
+				pathUrl.Fragment = "branch=a_branch&path=sub"
+
+				sha, err := buildpackrunner.GitCloneWithOptions(pathUrl, destination, buildpackrunner.TransportOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(sha).To(Equal(revParse(fileGitUrl.Path, "a_branch")))
+
+				fileContents, err := os.ReadFile(filepath.Join(destination, "README"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(fileContents)).To(Equal("2nd commit"))
+
+				entries, err := os.ReadDir(cloneTarget)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
+			})
+
+			It("combines with a pinned commit", func() {
+				pathUrl := fileGitUrl
+				pathUrl.Fragment = "commit=" + revParse(fileGitUrl.Path, "master") + "&path=./sub/"
+
+				err := buildpackrunner.GitClone(pathUrl, destination)
+				Expect(err).NotTo(HaveOccurred())
+
+				fileContents, err := os.ReadFile(filepath.Join(destination, "README"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(fileContents)).To(Equal("1st commit"))
+			})
+
+			It("fails when the path is not in the repository", func() {
+				pathUrl := fileGitUrl
+				pathUrl.Fragment = "path=missing"
+
+				err := buildpackrunner.GitClone(pathUrl, destination)
+				Expect(err).To(MatchError(ContainSubstring("Failed to find path 'missing'")))
+			})
+		})
+	})
+
+	Describe("ParseGitRef", func() {
+		It("treats a plain fragment as a branch", func() {
+			Expect(buildpackrunner.ParseGitRef("v1.2")).To(Equal(buildpackrunner.GitRef{Branch: "v1.2"}))
+		})
+
+		It("parses a commit and a path", func() {
+			commit := strings.Repeat("AB", 20)
+			Expect(buildpackrunner.ParseGitRef("commit=" + commit + "&path=buildpacks/ruby")).To(Equal(buildpackrunner.GitRef{
+				Commit: strings.ToLower(commit),
+				Path:   "buildpacks/ruby",
+			}))
+		})
+
+		DescribeTable("rejecting invalid fragments",
+			func(fragment, expectedError string) {
+				_, err := buildpackrunner.ParseGitRef(fragment)
+				Expect(err).To(MatchError(ContainSubstring(expectedError)))
+			},
+			Entry("an abbreviated commit", "commit=abc1234", "commit must be a full SHA"),
+			Entry("a commit that is not hex", "commit="+strings.Repeat("z", 40), "commit must be a full SHA"),
+			Entry("both a branch and a commit", "branch=main&commit="+strings.Repeat("a", 40), "branch and commit are mutually exclusive"),
+			Entry("an unknown key", "tag=v1", "unknown key tag"),
+			Entry("a repeated key", "path=a&path=b", "path must be given once"),
+			Entry("a path outside the repository", "path=../other", "path must be a subdirectory of the repository"),
+			Entry("an absolute path", "path=/etc", "path must be a subdirectory of the repository"),
+		)
 	})
 })
 
+func revParse(gitDir, rev string) string {
+	cmd := exec.Command("git", "rev-parse", rev)
+	cmd.Dir = gitDir
+	bytes, err := cmd.Output()
+	Expect(err).NotTo(HaveOccurred())
+	return strings.TrimSpace(string(bytes))
+}
+
 func currentBranch(gitDir string) string {
 	cmd := exec.Command("git", "symbolic-ref", "--short", "-q", "HEAD")
 	cmd.Dir = gitDir
@@ -0,0 +1,78 @@
+package buildpackrunner_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+
+	. "github.com/onsi/gomega"
+)
+
+// archiveEntry is a file in an archive built by newTar or newZip. Files are
+// written with mode 0644 unless another is given; names ending in / are
+// directories.
+type archiveEntry struct {
+	name     string
+	contents string
+	mode     os.FileMode
+	// the entry is a symbolic link to symlink, or in tarballs a hard link
+	// to hardlink
+	symlink  string
+	hardlink string
+}
+
+func newTar(entries ...archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: int64(entry.fileMode()), Typeflag: tar.TypeReg, Size: int64(len(entry.contents))}
+		switch {
+		case entry.symlink != "":
+			header = &tar.Header{Name: entry.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: entry.symlink}
+		case entry.hardlink != "":
+			header = &tar.Header{Name: entry.name, Mode: int64(entry.fileMode()), Typeflag: tar.TypeLink, Linkname: entry.hardlink}
+		case entry.isDir():
+			header = &tar.Header{Name: entry.name, Mode: int64(entry.fileMode()), Typeflag: tar.TypeDir}
+		}
+		Expect(w.WriteHeader(header)).To(Succeed())
+		_, err := w.Write([]byte(entry.contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(w.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func newZip(entries ...archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.fileMode())
+		contents := entry.contents
+		if entry.symlink != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			contents = entry.symlink
+		}
+		f, err := w.CreateHeader(header)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte(contents))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(w.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func (entry archiveEntry) isDir() bool {
+	return len(entry.name) > 0 && entry.name[len(entry.name)-1] == '/'
+}
+
+func (entry archiveEntry) fileMode() os.FileMode {
+	switch {
+	case entry.mode != 0:
+		return entry.mode
+	case entry.isDir():
+		return 0755
+	}
+	return 0644
+}
@@ -0,0 +1,336 @@
+package buildpackrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// maxDownloadRetryDelay caps the exponential backoff between attempts.
+const maxDownloadRetryDelay = time.Minute
+
+// DownloadOptions configure how buildpacks are downloaded over HTTP(S).
+type DownloadOptions struct {
+	// Attempts is the number of times a download is tried before giving up.
+	Attempts int
+	// RetryDelay is the delay before the first retry. It doubles with every
+	// further retry, up to a minute, and is randomized by up to half.
+	RetryDelay time.Duration
+	// Timeout limits each attempt, including reading the body (0 for no
+	// limit).
+	Timeout time.Duration
+	// ConnectTimeout limits connecting to the server and waiting for the
+	// headers of its response (0 for no limit).
+	ConnectTimeout time.Duration
+
+	TransportOptions
+
+	// Limits bound what is extracted from a downloaded archive.
+	Limits ExtractionLimits
+
+	// Output receives a line for every failed attempt and every retry.
+	Output io.Writer
+}
+
+// DefaultDownloadOptions retry a failed download twice and discard the
+// output of the attempts.
+func DefaultDownloadOptions() DownloadOptions {
+	return DownloadOptions{
+		Attempts:       3,
+		RetryDelay:     time.Second,
+		Timeout:        DOWNLOAD_TIMEOUT,
+		ConnectTimeout: 30 * time.Second,
+		Output:         io.Discard,
+	}
+}
+
+// cachingInfo holds the validators of a response, to revalidate a cached
+// download or to resume a partial one.
+type cachingInfo struct {
+	ETag         string
+	LastModified string
+}
+
+func (c cachingInfo) empty() bool {
+	return c.ETag == "" && c.LastModified == ""
+}
+
+// ifRange returns the validator for an If-Range header, which must not be a
+// weak ETag.
+func (c cachingInfo) ifRange() string {
+	if c.ETag != "" && !strings.HasPrefix(c.ETag, "W/") {
+		return c.ETag
+	}
+	return c.LastModified
+}
+
+// permanentDownloadError is not worth another attempt, such as a 404.
+type permanentDownloadError struct {
+	err error
+}
+
+func (e permanentDownloadError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentDownloadError) Unwrap() error {
+	return e.err
+}
+
+type httpDownloader struct {
+	client  *http.Client
+	options DownloadOptions
+}
+
+func newHTTPDownloader(options DownloadOptions) (*httpDownloader, error) {
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Attempts < 1 {
+		options.Attempts = 1
+	}
+	if options.Output == nil {
+		options.Output = io.Discard
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   options.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &httpDownloader{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 options.proxy(),
+				DialContext:           dialer.DialContext,
+				TLSClientConfig:       tlsConfig,
+				TLSHandshakeTimeout:   options.ConnectTimeout,
+				ResponseHeaderTimeout: options.ConnectTimeout,
+			},
+		},
+		options: options,
+	}, nil
+}
+
+// head returns the response to a HEAD request for u, whose body is closed.
+func (d *httpDownloader) head(u *url.URL) (*http.Response, error) {
+	ctx, cancel := d.attemptContext()
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// download writes the body at u to the file at path, trying up to the
+// configured number of attempts. An attempt that fails part way through
+// resumes where the previous one stopped, if the server supports ranges.
+// When the server confirms that the copy described by cached is current,
+// download returns true and leaves the file empty.
+func (d *httpDownloader) download(u *url.URL, path string, cached cachingInfo) (cachingInfo, bool, error) {
+	var (
+		partial cachingInfo
+		err     error
+	)
+
+	for attempt := 1; attempt <= d.options.Attempts; attempt++ {
+		if attempt > 1 {
+			delay := d.retryDelay(attempt - 1)
+			fmt.Fprintf(d.options.Output, "Retrying download of buildpack `%s` in %s (attempt %d of %d)\n", redactedURL(u), delay.Round(time.Millisecond), attempt, d.options.Attempts)
+			time.Sleep(delay)
+		}
+
+		var (
+			info        cachingInfo
+			notModified bool
+		)
+		info, notModified, err = d.attempt(u, path, cached, &partial)
+		if err == nil {
+			return info, notModified, nil
+		}
+
+		fmt.Fprintf(d.options.Output, "Failed on attempt %d of %d to download buildpack `%s`: %s\n", attempt, d.options.Attempts, redactedURL(u), buildpackapplifecycle.RedactCredentials(err.Error()))
+
+		var permanent permanentDownloadError
+		if errors.As(err, &permanent) {
+			return cachingInfo{}, false, err
+		}
+	}
+
+	if d.options.Attempts > 1 {
+		return cachingInfo{}, false, fmt.Errorf("giving up after %d attempts: %w", d.options.Attempts, err)
+	}
+	return cachingInfo{}, false, err
+}
+
+// attempt downloads u once. partial holds the validators of the response
+// whose body is already partly in the file, or nothing if it cannot be
+// resumed.
+func (d *httpDownloader) attempt(u *url.URL, path string, cached cachingInfo, partial *cachingInfo) (cachingInfo, bool, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return cachingInfo{}, false, permanentDownloadError{err}
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return cachingInfo{}, false, permanentDownloadError{err}
+	}
+	if offset > 0 && partial.ifRange() == "" {
+		if offset, err = restart(file); err != nil {
+			return cachingInfo{}, false, permanentDownloadError{err}
+		}
+	}
+
+	ctx, cancel := d.attemptContext()
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return cachingInfo{}, false, permanentDownloadError{err}
+	}
+	if offset > 0 {
+		fmt.Fprintf(d.options.Output, "Resuming download of buildpack `%s` at %s\n", redactedURL(u), bytefmt.ByteSize(uint64(offset)))
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", partial.ifRange())
+	} else {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return cachingInfo{}, false, err
+	}
+	defer resp.Body.Close()
+
+	info := cachingInfo{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && offset == 0 && !cached.empty():
+		return cached, true, nil
+
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			restart(file)
+			*partial = cachingInfo{}
+			return cachingInfo{}, false, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		info = *partial
+
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, or the buildpack changed
+		if _, err := restart(file); err != nil {
+			return cachingInfo{}, false, permanentDownloadError{err}
+		}
+		*partial = cachingInfo{}
+		if resp.Header.Get("Accept-Ranges") == "bytes" {
+			*partial = info
+		}
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable,
+		resp.StatusCode == http.StatusPartialContent:
+		// a range that cannot be satisfied, or one that was never asked
+		// for, is retried from the start
+		restart(file)
+		*partial = cachingInfo{}
+		return cachingInfo{}, false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+
+	default:
+		err := fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		if !retryableStatus(resp.StatusCode) {
+			return cachingInfo{}, false, permanentDownloadError{err}
+		}
+		return cachingInfo{}, false, err
+	}
+
+	n, err := io.Copy(file, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return cachingInfo{}, false, err
+	}
+
+	return info, false, file.Close()
+}
+
+func (d *httpDownloader) attemptContext() (context.Context, context.CancelFunc) {
+	if d.options.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d.options.Timeout)
+}
+
+// retryDelay doubles the delay with every retry and picks a random delay
+// between half of it and all of it, so that stagings that failed together
+// do not retry together.
+func (d *httpDownloader) retryDelay(retry int) time.Duration {
+	delay := d.options.RetryDelay
+	for i := 1; i < retry && delay < maxDownloadRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDownloadRetryDelay {
+		delay = maxDownloadRetryDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// restart empties the file for a download from the start.
+func restart(file *os.File) (int64, error) {
+	if err := file.Truncate(0); err != nil {
+		return 0, err
+	}
+	return file.Seek(0, io.SeekStart)
+}
+
+func retryableStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// contentRangeStart returns the first byte of a Content-Range such as
+// "bytes 100-199/200".
+func contentRangeStart(contentRange string) (int64, bool) {
+	byteRange, found := strings.CutPrefix(contentRange, "bytes ")
+	if !found {
+		return 0, false
+	}
+	start, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
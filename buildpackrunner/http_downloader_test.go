@@ -0,0 +1,221 @@
+package buildpackrunner_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+	"github.com/onsi/gomega/gbytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Resilient downloads", func() {
+	var (
+		destination   string
+		zipContents   []byte
+		server        *httptest.Server
+		handlers      []http.HandlerFunc
+		requests      []*http.Request
+		mutex         sync.Mutex
+		output        *gbytes.Buffer
+		options       buildpackrunner.DownloadOptions
+		zipDownloader *buildpackrunner.ZipDownloader
+	)
+
+	download := func() error {
+		u, err := url.Parse(server.URL + "/buildpack.zip")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = zipDownloader.DownloadAndExtract(u, destination)
+		return err
+	}
+
+	serveFrom := func(offset int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Accept-Ranges", "bytes")
+			if offset > 0 {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(zipContents)-1, len(zipContents)))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+			w.Write(zipContents[offset:])
+		}
+	}
+
+	// fails part way through the body, after the headers promised all of it
+	breakAfter := func(n int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(zipContents)))
+			w.Write(zipContents[:n])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	respondWith := func(statusCode int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+		}
+	}
+
+	BeforeEach(func() {
+		destination = GinkgoT().TempDir()
+
+		zipContents = newZip(archiveEntry{name: "contents", contents: strings.Repeat("stuff", 1000)})
+
+		handlers = nil
+		requests = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			i := len(requests)
+			requests = append(requests, r)
+			mutex.Unlock()
+
+			if i >= len(handlers) {
+				w.WriteHeader(http.StatusTeapot)
+				return
+			}
+			handlers[i](w, r)
+		}))
+
+		output = gbytes.NewBuffer()
+		options = buildpackrunner.DefaultDownloadOptions()
+		options.RetryDelay = time.Millisecond
+		options.Output = output
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		zipDownloader, err = buildpackrunner.NewZipDownloaderWithOptions(options, nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("retries server errors", func() {
+		handlers = []http.HandlerFunc{respondWith(http.StatusServiceUnavailable), serveFrom(0)}
+
+		Expect(download()).To(Succeed())
+		Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+		Expect(requests).To(HaveLen(2))
+		Expect(output).To(gbytes.Say("Failed on attempt 1 of 3 to download buildpack `http://.*/buildpack.zip`: unexpected status code 503"))
+		Expect(output).To(gbytes.Say(`Retrying download of buildpack .* \(attempt 2 of 3\)`))
+	})
+
+	It("does not retry client errors", func() {
+		handlers = []http.HandlerFunc{respondWith(http.StatusNotFound), serveFrom(0)}
+
+		Expect(download()).To(MatchError(ContainSubstring("unexpected status code 404")))
+		Expect(requests).To(HaveLen(1))
+	})
+
+	Context("with fewer attempts", func() {
+		BeforeEach(func() {
+			options.Attempts = 2
+		})
+
+		It("gives up after the configured number of attempts", func() {
+			handlers = []http.HandlerFunc{respondWith(http.StatusBadGateway), respondWith(http.StatusBadGateway), serveFrom(0)}
+
+			Expect(download()).To(MatchError(ContainSubstring("giving up after 2 attempts: unexpected status code 502")))
+			Expect(requests).To(HaveLen(2))
+		})
+	})
+
+	It("resumes an interrupted download where it stopped", func() {
+		handlers = []http.HandlerFunc{breakAfter(100), serveFrom(100)}
+
+		Expect(download()).To(Succeed())
+		Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].Header.Get("Range")).To(BeEmpty())
+		Expect(requests[1].Header.Get("Range")).To(Equal("bytes=100-"))
+		Expect(requests[1].Header.Get("If-Range")).To(Equal(`"v1"`))
+		Expect(output).To(gbytes.Say("Resuming download of buildpack .* at 100B"))
+	})
+
+	It("starts over when the server sends the whole buildpack again", func() {
+		handlers = []http.HandlerFunc{breakAfter(100), serveFrom(0)}
+
+		Expect(download()).To(Succeed())
+		Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+	})
+
+	It("starts over when the server does not support ranges", func() {
+		handlers = []http.HandlerFunc{
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(zipContents)))
+				w.Write(zipContents[:100])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			},
+			serveFrom(0),
+		}
+
+		Expect(download()).To(Succeed())
+		Expect(requests[1].Header.Get("Range")).To(BeEmpty())
+	})
+
+	It("starts over when the server sends a range that was not asked for", func() {
+		handlers = []http.HandlerFunc{
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 100-%d/%d", len(zipContents)-1, len(zipContents)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(zipContents[100:])
+			},
+			serveFrom(0),
+		}
+
+		Expect(download()).To(Succeed())
+		Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[1].Header.Get("Range")).To(BeEmpty())
+	})
+
+	Context("with a timeout", func() {
+		BeforeEach(func() {
+			options.Timeout = 100 * time.Millisecond
+		})
+
+		It("retries attempts that take too long", func() {
+			handlers = []http.HandlerFunc{
+				func(w http.ResponseWriter, r *http.Request) {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+				},
+				serveFrom(0),
+			}
+
+			Expect(download()).To(Succeed())
+			Expect(requests).To(HaveLen(2))
+		})
+	})
+
+	It("redacts credentials from the output of failed attempts", func() {
+		handlers = []http.HandlerFunc{respondWith(http.StatusServiceUnavailable), serveFrom(0)}
+
+		u, err := url.Parse(server.URL + "/buildpack.zip")
+		Expect(err).NotTo(HaveOccurred())
+		u.User = url.UserPassword("user", "s3cr3t-token")
+		_, err = zipDownloader.DownloadAndExtract(u, destination)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(string(output.Contents())).To(ContainSubstring("http://***@"))
+		Expect(string(output.Contents())).NotTo(ContainSubstring("s3cr3t-token"))
+	})
+})
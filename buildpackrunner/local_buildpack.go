@@ -0,0 +1,158 @@
+package buildpackrunner
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LocalBuildpackPath returns the filesystem path of a file:// buildpack URL.
+// Only local files can be referred to, so the host must be empty or
+// localhost.
+func LocalBuildpackPath(u *url.URL) (string, error) {
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("Invalid local buildpack '%s': not a file:// URL", redactedURL(u))
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		return "", fmt.Errorf("Invalid local buildpack '%s': host must be empty or localhost", redactedURL(u))
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("Invalid local buildpack '%s': missing path", redactedURL(u))
+	}
+
+	localPath := u.Path
+	if runtime.GOOS == "windows" && len(localPath) >= 3 && localPath[0] == '/' && localPath[2] == ':' {
+		// file:///C:/buildpack
+		localPath = localPath[1:]
+	}
+	return filepath.FromSlash(localPath), nil
+}
+
+// CopyLocalBuildpack puts the buildpack at a file:// URL into destination,
+// returning its size. A directory is copied as is, while a zip file or
+// tarball is extracted the same way as a downloaded one, after verifying the
+// digest pinned in the URL fragment, if any, and within the given limits.
+func CopyLocalBuildpack(u *url.URL, destination string, limits ExtractionLimits) (uint64, error) {
+	digest, err := ParseBuildpackDigest(u)
+	if err != nil {
+		return 0, err
+	}
+
+	localPath, err := LocalBuildpackPath(u)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read local buildpack '%s': %s", redactedURL(u), err.Error())
+	}
+
+	if fi.IsDir() {
+		if digest != nil {
+			return 0, fmt.Errorf("Invalid local buildpack '%s': only archives can be pinned to a digest", redactedURL(u))
+		}
+
+		size, err := copyBuildpackDirectory(localPath, destination)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to copy buildpack '%s': %s", redactedURL(u), err.Error())
+		}
+		return size, nil
+	}
+
+	if digest != nil {
+		if err := verifyDigest(localPath, *digest); err != nil {
+			return 0, fmt.Errorf("Failed to verify buildpack '%s': %s", redactedURL(u), err.Error())
+		}
+	}
+
+	format := ArchiveFormatFromPath(localPath)
+	if format == "" {
+		format, err = sniffArchiveFormat(localPath)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to identify buildpack '%s': %w", redactedURL(u), err)
+		}
+	}
+
+	if err := extractArchive(localPath, format, destination, limits); err != nil {
+		return 0, fmt.Errorf("Failed to extract buildpack '%s': %s", redactedURL(u), err.Error())
+	}
+
+	return uint64(fi.Size()), nil
+}
+
+// copyBuildpackDirectory copies the contents of srcDir into destDir,
+// preserving permissions and symlinks, and returns the number of bytes
+// copied. When srcDir itself is a symlink, the directory it links to is
+// copied.
+func copyBuildpackDirectory(srcDir, destDir string) (uint64, error) {
+	var size uint64
+
+	srcDir, err := filepath.EvalSymlinks(srcDir)
+	if err != nil {
+		return 0, err
+	}
+
+	err = filepath.WalkDir(srcDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, relPath)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+
+		case entry.Type().IsRegular():
+			if err := copyBuildpackFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func copyBuildpackFile(src, dest string, mode os.FileMode) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, srcFile); err != nil {
+		return err
+	}
+	return destFile.Close()
+}
@@ -0,0 +1,172 @@
+package buildpackrunner_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LocalBuildpack", func() {
+	var (
+		sourceDir   string
+		destination string
+	)
+
+	fileURL := func(localPath string) *url.URL {
+		return &url.URL{Scheme: "file", Path: filepath.ToSlash(localPath)}
+	}
+
+	writeFile := func(path, contents string, mode os.FileMode) {
+		Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+		Expect(os.WriteFile(path, []byte(contents), mode)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		sourceDir = GinkgoT().TempDir()
+		destination = filepath.Join(GinkgoT().TempDir(), "buildpack")
+	})
+
+	Describe("LocalBuildpackPath", func() {
+		It("returns the path of a file:// URL", func() {
+			u, err := url.Parse("file:///var/vcap/buildpacks/ruby")
+			Expect(err).NotTo(HaveOccurred())
+
+			localPath, err := buildpackrunner.LocalBuildpackPath(u)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.ToSlash(localPath)).To(HaveSuffix("/var/vcap/buildpacks/ruby"))
+		})
+
+		It("accepts localhost", func() {
+			u, err := url.Parse("file://localhost/var/vcap/buildpacks/ruby")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = buildpackrunner.LocalBuildpackPath(u)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects other hosts", func() {
+			u, err := url.Parse("file://fileserver/buildpacks/ruby")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = buildpackrunner.LocalBuildpackPath(u)
+			Expect(err).To(MatchError(ContainSubstring("host must be empty or localhost")))
+		})
+	})
+
+	Describe("CopyLocalBuildpack", func() {
+		It("copies a directory", func() {
+			writeFile(filepath.Join(sourceDir, "bin", "detect"), "#!/bin/sh\n", 0755)
+			writeFile(filepath.Join(sourceDir, "VERSION"), "1.2.3", 0644)
+
+			size, err := buildpackrunner.CopyLocalBuildpack(fileURL(sourceDir), destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(size).To(Equal(uint64(len("#!/bin/sh\n") + len("1.2.3"))))
+
+			contents, err := os.ReadFile(filepath.Join(destination, "VERSION"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("1.2.3"))
+
+			if runtime.GOOS != "windows" {
+				fi, err := os.Stat(filepath.Join(destination, "bin", "detect"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0755)))
+			}
+		})
+
+		It("copies symlinks as links", func() {
+			if runtime.GOOS == "windows" {
+				Skip("links need privileges on Windows")
+			}
+
+			writeFile(filepath.Join(sourceDir, "bin", "detect"), "#!/bin/sh\n", 0755)
+			Expect(os.Symlink("detect", filepath.Join(sourceDir, "bin", "supply"))).To(Succeed())
+
+			_, err := buildpackrunner.CopyLocalBuildpack(fileURL(sourceDir), destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).NotTo(HaveOccurred())
+
+			target, err := os.Readlink(filepath.Join(destination, "bin", "supply"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("detect"))
+		})
+
+		It("copies the directory a symlinked path links to", func() {
+			if runtime.GOOS == "windows" {
+				Skip("links need privileges on Windows")
+			}
+
+			writeFile(filepath.Join(sourceDir, "bin", "detect"), "#!/bin/sh\n", 0755)
+			linkPath := filepath.Join(GinkgoT().TempDir(), "current")
+			Expect(os.Symlink(sourceDir, linkPath)).To(Succeed())
+
+			_, err := buildpackrunner.CopyLocalBuildpack(fileURL(linkPath), destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).NotTo(HaveOccurred())
+
+			fi, err := os.Lstat(destination)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fi.IsDir()).To(BeTrue())
+			Expect(filepath.Join(destination, "bin", "detect")).To(BeARegularFile())
+		})
+
+		It("refuses to pin a directory to a digest", func() {
+			u := fileURL(sourceDir)
+			u.Fragment = "sha256=" + hex.EncodeToString(make([]byte, sha256.Size))
+
+			_, err := buildpackrunner.CopyLocalBuildpack(u, destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).To(MatchError(ContainSubstring("only archives can be pinned to a digest")))
+		})
+
+		Context("with a zip file", func() {
+			var zipPath string
+
+			BeforeEach(func() {
+				zipPath = filepath.Join(sourceDir, "buildpack.zip")
+				Expect(os.WriteFile(zipPath, newZip(archiveEntry{name: "buildpack/VERSION", contents: "1.2.3"}), 0644)).To(Succeed())
+			})
+
+			It("extracts it", func() {
+				_, err := buildpackrunner.CopyLocalBuildpack(fileURL(zipPath), destination, buildpackrunner.ExtractionLimits{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(destination, "buildpack", "VERSION")).To(BeAnExistingFile())
+			})
+
+			It("extracts it without an extension", func() {
+				extensionless := filepath.Join(sourceDir, "buildpack")
+				Expect(os.Rename(zipPath, extensionless)).To(Succeed())
+
+				_, err := buildpackrunner.CopyLocalBuildpack(fileURL(extensionless), destination, buildpackrunner.ExtractionLimits{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(filepath.Join(destination, "buildpack", "VERSION")).To(BeAnExistingFile())
+			})
+
+			It("verifies a pinned digest", func() {
+				u := fileURL(zipPath)
+				u.Fragment = "sha256=" + hex.EncodeToString(make([]byte, sha256.Size))
+
+				_, err := buildpackrunner.CopyLocalBuildpack(u, destination, buildpackrunner.ExtractionLimits{})
+				Expect(err).To(MatchError(ContainSubstring("digest mismatch")))
+				Expect(destination).NotTo(BeADirectory())
+			})
+		})
+
+		It("fails for a file that is not an archive", func() {
+			notAnArchive := filepath.Join(sourceDir, "README")
+			writeFile(notAnArchive, "a buildpack", 0644)
+
+			_, err := buildpackrunner.CopyLocalBuildpack(fileURL(notAnArchive), destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).To(MatchError(buildpackrunner.ErrUnknownArchiveFormat))
+		})
+
+		It("fails for a missing path", func() {
+			_, err := buildpackrunner.CopyLocalBuildpack(fileURL(filepath.Join(sourceDir, "missing")), destination, buildpackrunner.ExtractionLimits{})
+			Expect(err).To(MatchError(ContainSubstring("Failed to read local buildpack")))
+		})
+	})
+})
@@ -0,0 +1,163 @@
+package buildpackrunner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+// BuildpackManifest is the part of a buildpack's manifest.yml that tells
+// which stacks it runs on.
+type BuildpackManifest struct {
+	Language string `yaml:"language"`
+	// Stack is set by buildpacks packaged for a single stack.
+	Stack        string                        `yaml:"stack"`
+	Dependencies []buildpackManifestDependency `yaml:"dependencies"`
+}
+
+type buildpackManifestDependency struct {
+	CFStacks []string `yaml:"cf_stacks"`
+}
+
+// ReadBuildpackManifest returns nil when the buildpack has no manifest.yml.
+func ReadBuildpackManifest(buildpackPath string) (*BuildpackManifest, error) {
+	contents, err := os.ReadFile(filepath.Join(buildpackPath, "manifest.yml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BuildpackManifest
+	if err := yaml.Unmarshal(contents, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest.yml: %s", err.Error())
+	}
+	return &manifest, nil
+}
+
+// Stacks returns the stack the buildpack is packaged for, or nil when the
+// manifest does not restrict the stacks.
+func (m *BuildpackManifest) Stacks() []string {
+	if m.Stack != "" {
+		return []string{m.Stack}
+	}
+	return nil
+}
+
+// DependencyStacks returns the stacks its dependencies are built for, in
+// lexical order. They tell which binaries the buildpack ships rather than
+// which stacks it supports, so they are only ever warned about.
+func (m *BuildpackManifest) DependencyStacks() []string {
+	stacks := map[string]bool{}
+	for _, dependency := range m.Dependencies {
+		for _, stack := range dependency.CFStacks {
+			stacks[stack] = true
+		}
+	}
+	if len(stacks) == 0 {
+		return nil
+	}
+
+	sortedStacks := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		sortedStacks = append(sortedStacks, stack)
+	}
+	sort.Strings(sortedStacks)
+	return sortedStacks
+}
+
+func (m *BuildpackManifest) SupportsStack(stack string) bool {
+	return containsStack(m.Stacks(), stack)
+}
+
+// HasDependenciesFor is false when the manifest lists dependencies for
+// stacks, but none for the given one.
+func (m *BuildpackManifest) HasDependenciesFor(stack string) bool {
+	return containsStack(m.DependencyStacks(), stack)
+}
+
+// containsStack treats a nil list as any stack.
+func containsStack(stacks []string, stack string) bool {
+	if stacks == nil {
+		return true
+	}
+	for _, s := range stacks {
+		if s == stack {
+			return true
+		}
+	}
+	return false
+}
+
+// readBuildpackVersion returns the contents of the VERSION file that
+// buildpacks ship next to their manifest, or "" if there is none.
+func readBuildpackVersion(buildpackPath string) string {
+	contents, err := os.ReadFile(filepath.Join(buildpackPath, "VERSION"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+// checkStack fails before any of the buildpack's scripts run when its
+// manifest declares that it does not support $CF_STACK, writing why to
+// errOutput. Buildpacks without a manifest, or with one the lifecycle cannot
+// read, are given the benefit of the doubt.
+func (runner *Runner) checkStack(buildpack, buildpackPath string, errOutput io.Writer) error {
+	manifest, err := ReadBuildpackManifest(buildpackPath)
+	if err != nil {
+		fmt.Fprintln(errOutput, buildpackapplifecycle.RedactCredentials(fmt.Sprintf("Warning: could not read the manifest of buildpack '%s': %s", buildpack, err.Error())))
+		return nil
+	}
+
+	if err := unsupportedStackError(buildpack, manifest, os.Getenv("CF_STACK")); err != nil {
+		fmt.Fprintln(errOutput, buildpackapplifecycle.RedactCredentials(err.Error()))
+		return newStagingError(err, buildpackapplifecycle.StackPhase, buildpack, buildpackapplifecycle.StackFailMsg)
+	}
+	if warning := missingDependenciesWarning(buildpack, manifest, os.Getenv("CF_STACK")); warning != "" {
+		fmt.Fprintln(errOutput, buildpackapplifecycle.RedactCredentials("Warning: "+warning))
+	}
+	return nil
+}
+
+// missingDependenciesWarning returns "" unless the manifest lists the stacks
+// the dependencies of the buildpack are built for, and the given one is not
+// among them. The buildpack may still work, for example on a compatible stack.
+func missingDependenciesWarning(buildpack string, manifest *BuildpackManifest, stack string) string {
+	if stack == "" || manifest == nil || manifest.HasDependenciesFor(stack) {
+		return ""
+	}
+	return fmt.Sprintf("buildpack '%s' has dependencies for %s but the stack is %s", buildpack, strings.Join(manifest.DependencyStacks(), ", "), stack)
+}
+
+// unsupportedStackError returns nil unless the manifest declares the stack
+// the buildpack is packaged for, and the given one is not it.
+func unsupportedStackError(buildpack string, manifest *BuildpackManifest, stack string) error {
+	if stack == "" || manifest == nil || manifest.SupportsStack(stack) {
+		return nil
+	}
+	return fmt.Errorf("buildpack '%s' supports %s but the stack is %s", buildpack, strings.Join(manifest.Stacks(), ", "), stack)
+}
+
+// checkStacks checks every buildpack that can be found, leaving those that
+// cannot to fail where they are run.
+func (runner *Runner) checkStacks(buildpacks []string) error {
+	for _, buildpack := range buildpacks {
+		buildpackPath, err := runner.buildpackPath(buildpack)
+		if err != nil {
+			continue
+		}
+		if err := runner.checkStack(buildpack, buildpackPath, os.Stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package buildpackrunner_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BuildpackManifest", func() {
+	var buildpackDir string
+
+	BeforeEach(func() {
+		buildpackDir = GinkgoT().TempDir()
+	})
+
+	readManifest := func(contents string) *buildpackrunner.BuildpackManifest {
+		Expect(os.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), []byte(contents), 0644)).To(Succeed())
+		manifest, err := buildpackrunner.ReadBuildpackManifest(buildpackDir)
+		Expect(err).NotTo(HaveOccurred())
+		return manifest
+	}
+
+	It("returns nil for a buildpack without a manifest", func() {
+		manifest, err := buildpackrunner.ReadBuildpackManifest(buildpackDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(manifest).To(BeNil())
+	})
+
+	It("fails for a manifest that is not YAML", func() {
+		Expect(os.WriteFile(filepath.Join(buildpackDir, "manifest.yml"), []byte("language: [ruby"), 0644)).To(Succeed())
+		_, err := buildpackrunner.ReadBuildpackManifest(buildpackDir)
+		Expect(err).To(MatchError(ContainSubstring("invalid manifest.yml")))
+	})
+
+	It("supports the stack the buildpack is packaged for", func() {
+		manifest := readManifest("language: ruby\nstack: cflinuxfs4\ndependencies:\n- cf_stacks: [cflinuxfs3]\n")
+		Expect(manifest.Language).To(Equal("ruby"))
+		Expect(manifest.Stacks()).To(Equal([]string{"cflinuxfs4"}))
+		Expect(manifest.SupportsStack("cflinuxfs4")).To(BeTrue())
+		Expect(manifest.SupportsStack("cflinuxfs3")).To(BeFalse())
+	})
+
+	It("supports any stack when only its dependencies list stacks", func() {
+		manifest := readManifest("dependencies:\n- cf_stacks: [cflinuxfs4]\n- cf_stacks: [cflinuxfs3, cflinuxfs4]\n")
+		Expect(manifest.Stacks()).To(BeNil())
+		Expect(manifest.SupportsStack("windows")).To(BeTrue())
+		Expect(manifest.DependencyStacks()).To(Equal([]string{"cflinuxfs3", "cflinuxfs4"}))
+		Expect(manifest.HasDependenciesFor("cflinuxfs3")).To(BeTrue())
+		Expect(manifest.HasDependenciesFor("windows")).To(BeFalse())
+	})
+
+	It("supports any stack when it lists none", func() {
+		manifest := readManifest("language: binary\ndependencies: []\n")
+		Expect(manifest.Stacks()).To(BeNil())
+		Expect(manifest.SupportsStack("cflinuxfs4")).To(BeTrue())
+		Expect(manifest.HasDependenciesFor("cflinuxfs4")).To(BeTrue())
+	})
+})
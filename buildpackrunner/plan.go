@@ -0,0 +1,254 @@
+package buildpackrunner
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+// The droplet contents directory is only created when staging starts, so a
+// plan refers to the directories inside it by these placeholders.
+const (
+	PlanDepsDir    = "<deps-dir>"
+	PlanProfileDir = "<profile-dir>"
+)
+
+// Plan describes what a staging with the current config would do, without
+// downloading buildpacks or running any of their scripts.
+type Plan struct {
+	SkipDetect bool            `json:"skip_detect"`
+	Buildpacks []PlanBuildpack `json:"buildpacks"`
+	Steps      []PlanStep      `json:"steps"`
+	Errors     []string        `json:"errors,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+}
+
+type PlanBuildpack struct {
+	Key         string `json:"key"`
+	Path        string `json:"path,omitempty"`
+	Download    bool   `json:"download,omitempty"`
+	Unchecked   bool   `json:"unchecked,omitempty"`
+	HasSupply   bool   `json:"has_supply"`
+	HasFinalize bool   `json:"has_finalize"`
+	Error       string `json:"error,omitempty"`
+}
+
+type PlanStep struct {
+	Step      string   `json:"step"`
+	Buildpack string   `json:"buildpack"`
+	Script    string   `json:"script"`
+	Args      []string `json:"args"`
+	CacheDir  string   `json:"cache_dir,omitempty"`
+	DepsIndex string   `json:"deps_index,omitempty"`
+	Timeout   string   `json:"timeout,omitempty"`
+	Condition string   `json:"condition,omitempty"`
+}
+
+// Plan resolves every buildpack in the order the same way staging does and
+// lists the scripts that would run, with their arguments. Problems that would
+// fail staging are collected in Errors rather than returned, and those staging
+// would only warn about in Warnings. Buildpacks that are not downloaded yet
+// are marked Unchecked and listed in Warnings. Credentials in buildpack URLs
+// are redacted.
+func (runner *Runner) Plan() *Plan {
+	plan := runner.plan()
+	plan.redactCredentials()
+	return plan
+}
+
+func (runner *Runner) plan() *Plan {
+	plan := &Plan{
+		SkipDetect: runner.config.SkipDetect(),
+		Buildpacks: []PlanBuildpack{},
+		Steps:      []PlanStep{},
+	}
+
+	buildpacks := map[string]PlanBuildpack{}
+	for _, key := range runner.config.BuildpackOrder() {
+		buildpack, warnings := runner.planBuildpack(key)
+		plan.Warnings = append(plan.Warnings, warnings...)
+		if buildpack.Error != "" {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: %s", key, buildpack.Error))
+		}
+		if buildpack.Unchecked {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s: not downloaded yet, its scripts can only be checked after download", key))
+		}
+		buildpacks[key] = buildpack
+		plan.Buildpacks = append(plan.Buildpacks, buildpack)
+	}
+
+	if runner.config.SkipDetect() {
+		runner.planSupplyBuildpacks(plan, buildpacks)
+
+		finalBuildpack := buildpacks[runner.config.BuildpackOrder()[len(runner.config.SupplyBuildpacks())]]
+		runner.planFinalBuildpack(plan, finalBuildpack, "")
+		return plan
+	}
+
+	for _, key := range runner.config.BuildpackOrder() {
+		plan.Steps = append(plan.Steps, PlanStep{
+			Step:      EventStepDetect,
+			Buildpack: key,
+			Script:    filepath.Join(buildpacks[key].Path, "bin", "detect"),
+			Args:      []string{runner.config.BuildDir()},
+			Timeout:   planTimeout(runner.config.BuildpackTimeout(key, runner.config.DetectTimeout())),
+			Condition: "until a buildpack detects the app",
+		})
+	}
+	for _, key := range runner.config.BuildpackOrder() {
+		runner.planFinalBuildpack(plan, buildpacks[key], fmt.Sprintf("if %s is the first buildpack to detect the app", key))
+	}
+
+	return plan
+}
+
+// planBuildpack also returns what staging would only warn about.
+func (runner *Runner) planBuildpack(key string) (PlanBuildpack, []string) {
+	buildpack := PlanBuildpack{Key: key}
+
+	if buildpackURL, err := url.Parse(key); err == nil && buildpackURL.IsAbs() {
+		buildpack.Download = true
+	}
+
+	path, err := runner.buildpackPath(key)
+	if err != nil {
+		buildpack.Path = runner.config.BuildpackPath(key)
+		if buildpack.Download {
+			buildpack.Unchecked = true
+		} else {
+			buildpack.Error = err.Error()
+		}
+		return buildpack, nil
+	}
+	buildpack.Path = path
+
+	if buildpack.HasSupply, err = hasSupply(path); err != nil {
+		buildpack.Error = err.Error()
+	}
+	if buildpack.HasFinalize, err = hasFinalize(path); err != nil {
+		buildpack.Error = err.Error()
+	}
+
+	var warnings []string
+	if manifest, err := ReadBuildpackManifest(path); err == nil {
+		if err := unsupportedStackError(key, manifest, os.Getenv("CF_STACK")); err != nil {
+			if runner.config.SkipDetect() {
+				buildpack.Error = err.Error()
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s: %s, so it is skipped during detect", key, err.Error()))
+			}
+		}
+		if warning := missingDependenciesWarning(key, manifest, os.Getenv("CF_STACK")); warning != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", key, warning))
+		}
+	}
+
+	return buildpack, warnings
+}
+
+func (runner *Runner) planSupplyBuildpacks(plan *Plan, buildpacks map[string]PlanBuildpack) {
+	for i, key := range runner.config.SupplyBuildpacks() {
+		buildpack := buildpacks[key]
+		if buildpack.Error == "" && !buildpack.Unchecked && !buildpack.HasSupply {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("%s: %s", key, buildpackapplifecycle.NoSupplyScriptFailMsg))
+		}
+
+		plan.Steps = append(plan.Steps, PlanStep{
+			Step:      EventStepSupply,
+			Buildpack: key,
+			Script:    filepath.Join(buildpack.Path, "bin", "supply"),
+			Args:      []string{runner.config.BuildDir(), runner.supplyCachePath(key), PlanDepsDir, runner.config.DepsIndex(i)},
+			CacheDir:  runner.supplyCachePath(key),
+			DepsIndex: runner.config.DepsIndex(i),
+			Timeout:   planTimeout(runner.config.BuildpackTimeout(key, runner.config.SupplyTimeout())),
+		})
+	}
+}
+
+// planFinalBuildpack mirrors runFinalize and ProcessFinalBuildpack
+func (runner *Runner) planFinalBuildpack(plan *Plan, buildpack PlanBuildpack, condition string) {
+	depsIdx := runner.config.DepsIndex(len(runner.config.SupplyBuildpacks()))
+	cacheDir := filepath.Join(runner.config.BuildArtifactsCacheDir(), "final")
+	bin := filepath.Join(buildpack.Path, "bin")
+
+	if buildpack.HasFinalize {
+		if buildpack.HasSupply {
+			plan.Steps = append(plan.Steps, PlanStep{
+				Step:      EventStepSupply,
+				Buildpack: buildpack.Key,
+				Script:    filepath.Join(bin, "supply"),
+				Args:      []string{runner.config.BuildDir(), cacheDir, PlanDepsDir, depsIdx},
+				CacheDir:  cacheDir,
+				DepsIndex: depsIdx,
+				Timeout:   planTimeout(runner.config.BuildpackTimeout(buildpack.Key, runner.config.SupplyTimeout())),
+				Condition: condition,
+			})
+		}
+
+		plan.Steps = append(plan.Steps, PlanStep{
+			Step:      EventStepFinalize,
+			Buildpack: buildpack.Key,
+			Script:    filepath.Join(bin, "finalize"),
+			Args:      []string{runner.config.BuildDir(), cacheDir, PlanDepsDir, depsIdx, PlanProfileDir},
+			CacheDir:  cacheDir,
+			DepsIndex: depsIdx,
+			Timeout:   planTimeout(runner.config.BuildpackTimeout(buildpack.Key, runner.config.FinalizeTimeout())),
+			Condition: condition,
+		})
+	} else {
+		if buildpack.Error == "" && !buildpack.Unchecked && len(runner.config.SupplyBuildpacks()) > 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s: %s", buildpack.Key, buildpackapplifecycle.MissingFinalizeWarnMsg))
+		}
+
+		plan.Steps = append(plan.Steps, PlanStep{
+			Step:      EventStepCompile,
+			Buildpack: buildpack.Key,
+			Script:    filepath.Join(bin, "compile"),
+			Args:      []string{runner.config.BuildDir(), cacheDir},
+			CacheDir:  cacheDir,
+			Timeout:   planTimeout(runner.config.BuildpackTimeout(buildpack.Key, runner.config.FinalizeTimeout())),
+			Condition: condition,
+		})
+	}
+
+	releaseCondition := "unless the buildpack writes a launch.yml"
+	if condition != "" {
+		releaseCondition = condition + ", " + releaseCondition
+	}
+	plan.Steps = append(plan.Steps, PlanStep{
+		Step:      EventStepRelease,
+		Buildpack: buildpack.Key,
+		Script:    filepath.Join(bin, "release"),
+		Args:      []string{runner.config.BuildDir()},
+		Timeout:   planTimeout(runner.config.BuildpackTimeout(buildpack.Key, runner.config.ReleaseTimeout())),
+		Condition: releaseCondition,
+	})
+}
+
+func (plan *Plan) redactCredentials() {
+	for i := range plan.Buildpacks {
+		plan.Buildpacks[i].Key = buildpackapplifecycle.RedactCredentials(plan.Buildpacks[i].Key)
+		plan.Buildpacks[i].Error = buildpackapplifecycle.RedactCredentials(plan.Buildpacks[i].Error)
+	}
+	for i := range plan.Steps {
+		plan.Steps[i].Buildpack = buildpackapplifecycle.RedactCredentials(plan.Steps[i].Buildpack)
+		plan.Steps[i].Condition = buildpackapplifecycle.RedactCredentials(plan.Steps[i].Condition)
+	}
+	for i := range plan.Errors {
+		plan.Errors[i] = buildpackapplifecycle.RedactCredentials(plan.Errors[i])
+	}
+	for i := range plan.Warnings {
+		plan.Warnings[i] = buildpackapplifecycle.RedactCredentials(plan.Warnings[i])
+	}
+}
+
+func planTimeout(timeout time.Duration) string {
+	if timeout == 0 {
+		return ""
+	}
+	return timeout.String()
+}
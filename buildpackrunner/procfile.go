@@ -0,0 +1,176 @@
+package buildpackrunner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxProcessTypeLength is the longest process type Cloud Foundry accepts.
+const maxProcessTypeLength = 255
+
+// procfileLine is a line of a Procfile in the format Heroku reads. Process
+// types are taken as they are, to be warned about rather than rejected, but
+// never start like a YAML sequence, quoted key or indented line.
+var procfileLine = regexp.MustCompile(`^([^\s:#"'-][^:]*):\s*(.*)$`)
+
+// validProcessType is a process type Cloud Foundry accepts.
+var validProcessType = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ProcfileError is a problem with a line of the app's Procfile.
+type ProcfileError struct {
+	Line    int
+	Message string
+}
+
+func (e ProcfileError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+type procfileEntry struct {
+	processType string
+	command     string
+	line        int
+}
+
+// ParseProcfile reads the process types of a Procfile. It is written either
+// as lines of "type: command", with comments starting with #, or as a YAML
+// mapping of process types to commands, which is only tried when the lines
+// do not fit. When neither fits, the problem on the earlier line is
+// reported. The warnings are about process types Cloud Foundry will reject,
+// about process types without a command, which are left out, and about
+// process types declared more than once, the last of which wins.
+func ParseProcfile(contents []byte) (map[string]string, []ProcfileError, error) {
+	entries, err := parseProcfileLines(contents)
+	if err != nil {
+		var yamlErr error
+		if entries, yamlErr = parseProcfileYAML(contents); yamlErr != nil {
+			return nil, nil, earlierProcfileError(err, yamlErr)
+		}
+	}
+
+	processes := map[string]string{}
+	lines := map[string]int{}
+	var warnings []ProcfileError
+	for _, entry := range entries {
+		if strings.TrimSpace(entry.command) == "" {
+			warnings = append(warnings, ProcfileError{entry.line, fmt.Sprintf("process type %q has no command, so it is left out", entry.processType)})
+			continue
+		}
+		if line, ok := lines[entry.processType]; ok {
+			warnings = append(warnings, ProcfileError{entry.line, fmt.Sprintf("process type %q is already declared on line %d, which this replaces", entry.processType, line)})
+		}
+		if message := processTypeProblem(entry.processType); message != "" {
+			warnings = append(warnings, ProcfileError{entry.line, message})
+		}
+
+		processes[entry.processType] = entry.command
+		lines[entry.processType] = entry.line
+	}
+	return processes, warnings, nil
+}
+
+// earlierProcfileError prefers the problem YAML finds with the value of a
+// process type, such as a list given as its command, over the line format
+// stumbling on the indented lines that follow it.
+func earlierProcfileError(linesErr, yamlErr error) error {
+	var linesProblem, yamlProblem ProcfileError
+	if errors.As(linesErr, &linesProblem) && errors.As(yamlErr, &yamlProblem) && yamlProblem.Line < linesProblem.Line {
+		return yamlErr
+	}
+	return linesErr
+}
+
+func parseProcfileLines(contents []byte) ([]procfileEntry, error) {
+	var entries []procfileEntry
+	lines := strings.Split(strings.TrimPrefix(string(contents), "\ufeff"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		match := procfileLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, ProcfileError{i + 1, fmt.Sprintf("expected a line of the form \"type: command\", not %q", line)}
+		}
+
+		entries = append(entries, procfileEntry{processType: match[1], command: unquoteCommand(match[2]), line: i + 1})
+	}
+	return entries, nil
+}
+
+// parseProcfileYAML reads the Procfiles that only YAML makes sense of, such
+// as those with commands spread over several lines.
+func parseProcfileYAML(contents []byte) ([]procfileEntry, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	mapping := document.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, ProcfileError{mapping.Line, "expected a mapping of process types to commands"}
+	}
+
+	var entries []procfileEntry
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+
+		var command string
+		if value.Kind != yaml.ScalarNode || value.Decode(&command) != nil {
+			return nil, ProcfileError{key.Line, fmt.Sprintf("process type %q has no command", key.Value)}
+		}
+		entries = append(entries, procfileEntry{processType: key.Value, command: command, line: key.Line})
+	}
+	return entries, nil
+}
+
+// unquoteCommand removes the quotes around a command that is quoted the way
+// YAML quotes strings, as Procfiles written for Cloud Foundry often are.
+// Commands that merely start and end with a quote are left alone.
+func unquoteCommand(command string) string {
+	if len(command) < 2 || (command[0] != '"' && command[0] != '\'') || command[len(command)-1] != command[0] || !quotedOnce(command) {
+		return command
+	}
+
+	var unquoted string
+	if err := yaml.Unmarshal([]byte(command), &unquoted); err != nil {
+		return command
+	}
+	return unquoted
+}
+
+// quotedOnce tells whether the quote that starts command is only closed at
+// its very end.
+func quotedOnce(command string) bool {
+	quote := command[0]
+	inner := command[1 : len(command)-1]
+	for i := 0; i < len(inner); i++ {
+		switch {
+		case quote == '"' && inner[i] == '\\':
+			i++
+		case quote == '\'' && inner[i] == '\'' && i+1 < len(inner) && inner[i+1] == '\'':
+			i++
+		case inner[i] == quote:
+			return false
+		}
+	}
+	return true
+}
+
+func processTypeProblem(processType string) string {
+	switch {
+	case len(processType) > maxProcessTypeLength:
+		return fmt.Sprintf("process type %q is longer than %d characters, which Cloud Foundry will reject", processType, maxProcessTypeLength)
+	case !validProcessType.MatchString(processType):
+		return fmt.Sprintf("process type %q may only contain letters, digits, '-' and '_', or Cloud Foundry will reject it", processType)
+	}
+	return ""
+}
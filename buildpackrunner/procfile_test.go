@@ -0,0 +1,78 @@
+package buildpackrunner_test
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseProcfile", func() {
+	DescribeTable("reads the process types",
+		func(contents string, expected map[string]string) {
+			processes, warnings, err := buildpackrunner.ParseProcfile([]byte(contents))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
+			Expect(processes).To(Equal(expected))
+		},
+		Entry("of lines of type and command", "web: bundle exec puma -C config/puma.rb\nworker: bundle exec sidekiq\n", map[string]string{"web": "bundle exec puma -C config/puma.rb", "worker": "bundle exec sidekiq"}),
+		Entry("with colons in commands", "web: gunicorn app:server --bind 0.0.0.0:$PORT\nclock: echo time: now\n", map[string]string{"web": "gunicorn app:server --bind 0.0.0.0:$PORT", "clock": "echo time: now"}),
+		Entry("skipping comments and blank lines", "# the app\n\nweb: serve\n  # not yet\n", map[string]string{"web": "serve"}),
+		Entry("keeping # in commands", "web: serve --color=#fff\n", map[string]string{"web": "serve --color=#fff"}),
+		Entry("with Windows line endings and a byte order mark", "\ufeffweb: serve\r\nworker: work\r\n", map[string]string{"web": "serve", "worker": "work"}),
+		Entry("with commands quoted as in YAML", "web: \"node server.js\"\nworker: 'it''s working'\n", map[string]string{"web": "node server.js", "worker": "it's working"}),
+		Entry("with quotes inside commands", "web: \"bin/run\" --name \"my app\"\n", map[string]string{"web": "\"bin/run\" --name \"my app\""}),
+		Entry("written as YAML", "web: >\n  bundle exec puma\n  -C config/puma.rb\n", map[string]string{"web": "bundle exec puma -C config/puma.rb\n"}),
+		Entry("that are empty", "", map[string]string{}),
+	)
+
+	DescribeTable("fails with the line at fault",
+		func(contents, message string) {
+			_, _, err := buildpackrunner.ParseProcfile([]byte(contents))
+			Expect(err).To(MatchError(message))
+		},
+		Entry("for lines that are not of type and command", "web: serve\nworker\n", `line 2: expected a line of the form "type: command", not "worker"`),
+		Entry("for YAML that is not a mapping", "- web: serve\n", `line 1: expected a line of the form "type: command", not "- web: serve"`),
+		Entry("for process types whose command is not a string", "web: serve\nworker:\n  - work\n", `line 2: process type "worker" has no command`),
+	)
+
+	It("warns about process types declared twice, and uses the last", func() {
+		processes, warnings, err := buildpackrunner.ParseProcfile([]byte("web: serve\nweb: serve --fast\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processes).To(Equal(map[string]string{"web": "serve --fast"}))
+		Expect(warnings).To(ConsistOf(buildpackrunner.ProcfileError{Line: 2, Message: `process type "web" is already declared on line 1, which this replaces`}))
+	})
+
+	It("warns about process types Cloud Foundry will reject", func() {
+		longType := strings.Repeat("w", 256)
+		processes, warnings, err := buildpackrunner.ParseProcfile([]byte("my worker: work\n" + longType + ": work\nclock.v2: tick --every 1s\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processes).To(Equal(map[string]string{"my worker": "work", longType: "work", "clock.v2": "tick --every 1s"}))
+		Expect(warnings).To(HaveLen(3))
+		Expect(warnings[0].Error()).To(Equal(`line 1: process type "my worker" may only contain letters, digits, '-' and '_', or Cloud Foundry will reject it`))
+		Expect(warnings[1].Line).To(Equal(2))
+		Expect(warnings[1].Message).To(ContainSubstring("is longer than 255 characters"))
+		Expect(warnings[2].Line).To(Equal(3))
+	})
+
+	It("warns about invalid process types in files YAML cannot read", func() {
+		processes, warnings, err := buildpackrunner.ParseProcfile([]byte("web: serve --bind 0.0.0.0:$PORT: now\nmy worker: work\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processes).To(Equal(map[string]string{"web": "serve --bind 0.0.0.0:$PORT: now", "my worker": "work"}))
+		Expect(warnings).To(ConsistOf(buildpackrunner.ProcfileError{Line: 2, Message: `process type "my worker" may only contain letters, digits, '-' and '_', or Cloud Foundry will reject it`}))
+	})
+
+	DescribeTable("warns about process types without a command, and leaves them out",
+		func(contents string, line int) {
+			processes, warnings, err := buildpackrunner.ParseProcfile([]byte(contents))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(processes).To(Equal(map[string]string{"web": "serve"}))
+			Expect(warnings).To(ConsistOf(buildpackrunner.ProcfileError{Line: line, Message: `process type "worker" has no command, so it is left out`}))
+		},
+		Entry("in lines", "web: serve\nworker:\n", 2),
+		Entry("in lines with a blank command", "web: serve\nworker: ''\n", 2),
+		Entry("in YAML", "web:\n  serve\nworker:\n", 3),
+	)
+})
@@ -1,48 +1,110 @@
 package resources
 
 import (
+	"sort"
+
 	"code.cloudfoundry.org/buildpackapplifecycle"
 )
 
+// sourceRanks orders the processes of a staging result by where they were
+// defined, after web.
+var sourceRanks = map[string]int{
+	buildpackapplifecycle.ProcessSourceLaunchYML: 0,
+	buildpackapplifecycle.ProcessSourceRelease:   1,
+	buildpackapplifecycle.ProcessSourceProcfile:  2,
+}
+
 type LaunchData struct {
 	Processes []Process `yaml:"processes"`
 }
 
 type Process struct {
-	Type      string `yaml:"type" json:"type"`
-	Command   string `yaml:"command" json:"command"`
-	Platforms struct {
+	Type             string                             `yaml:"type" json:"type"`
+	Command          string                             `yaml:"command" json:"command"`
+	HealthCheck      *buildpackapplifecycle.HealthCheck `yaml:"health_check" json:"health_check,omitempty"`
+	Instances        int                                `yaml:"instances" json:"instances,omitempty"`
+	ReadinessCommand string                             `yaml:"readiness_command" json:"readiness_command,omitempty"`
+	Env              map[string]string                  `yaml:"env" json:"env,omitempty"`
+	Platforms        struct {
 		Cloudfoundry struct {
 			SidecarFor []string `yaml:"sidecar_for" json:"sidecar_for"`
 		} `yaml:"cloudfoundry" json:"cloudfoundry"`
 	} `yaml:"platforms" json:"platforms"`
 	Limits struct {
 		Memory int `yaml:"memory" json:"memory"`
+		Disk   int `yaml:"disk" json:"disk"`
 	} `yaml:"limits" json:"limits"`
+	// Source is set by whoever reads the process, never by the launch.yml
+	Source *buildpackapplifecycle.ProcessSource `yaml:"-" json:"source,omitempty"`
+
+	// location is only known for processes read from a launch.yml
+	location launchYMLLocation
 }
 
 func (p *Process) Replaceable(otherProc Process) bool {
 	return p.Type == otherProc.Type
 }
 
-func ProcDataToProcesses(procData map[string]string) []Process {
+// inheritDefaults returns p with the health check, instances, disk quota,
+// readiness command and environment it leaves out taken from the process it
+// replaces, so that a Procfile can change the command of a process without
+// losing the defaults its buildpack declared.
+func (p Process) inheritDefaults(replaced Process) Process {
+	if p.HealthCheck == nil {
+		p.HealthCheck = replaced.HealthCheck
+	}
+	if p.Instances == 0 {
+		p.Instances = replaced.Instances
+	}
+	if p.Limits.Disk == 0 {
+		p.Limits.Disk = replaced.Limits.Disk
+	}
+	if p.ReadinessCommand == "" {
+		p.ReadinessCommand = replaced.ReadinessCommand
+	}
+	if p.Env == nil {
+		p.Env = replaced.Env
+	}
+	return p
+}
+
+// ProcDataToProcesses turns the process types of a release or Procfile into
+// processes, in the order of their types, each defined by source.
+func ProcDataToProcesses(procData map[string]string, source buildpackapplifecycle.ProcessSource) []Process {
+	procTypes := make([]string, 0, len(procData))
+	for procType := range procData {
+		procTypes = append(procTypes, procType)
+	}
+	sort.Strings(procTypes)
+
 	var result []Process
-	for procType, procCommand := range procData {
+	for _, procType := range procTypes {
+		processSource := source
 		result = append(result, Process{
 			Type:    procType,
-			Command: procCommand,
+			Command: procData[procType],
+			Source:  &processSource,
 		})
 	}
 	return result
 }
 
+// SetSource records that the processes were defined by source.
+func SetSource(processes []Process, source buildpackapplifecycle.ProcessSource) {
+	for i := range processes {
+		processSource := source
+		processes[i].Source = &processSource
+	}
+}
+
 func MergeProcesses(listA []Process, listB []Process) []Process {
 	result := listA
 	for _, procB := range listB {
 		replaced := false
 		for i, procA := range listA {
 			if procA.Replaceable(procB) {
-				result[i] = procB
+				result[i] = procB.inheritDefaults(procA)
+				result[i].Source = replacedSource(procB.Source, procA.Source)
 				replaced = true
 			}
 		}
@@ -53,6 +115,21 @@ func MergeProcesses(listA []Process, listB []Process) []Process {
 	return result
 }
 
+// replacedSource returns a copy of source that records it replaced the
+// definition from replaced.
+func replacedSource(source, replaced *buildpackapplifecycle.ProcessSource) *buildpackapplifecycle.ProcessSource {
+	if source == nil {
+		return nil
+	}
+	replacing := *source
+	replacing.Replaced = replaced
+	return &replacing
+}
+
+// ConvertToResult lists the processes with web first, then by where they
+// were defined, then by type, and the sidecars by where they were defined,
+// then by name, so that the result does not change from one staging to the
+// next.
 func ConvertToResult(data LaunchData) buildpackapplifecycle.StagingResult {
 	result := buildpackapplifecycle.StagingResult{}
 	result.ProcessTypes = map[string]string{}
@@ -62,8 +139,14 @@ func ConvertToResult(data LaunchData) buildpackapplifecycle.StagingResult {
 
 		if len(sidecarTargets) == 0 {
 			result.ProcessList = append(result.ProcessList, buildpackapplifecycle.Process{
-				Type:    process.Type,
-				Command: process.Command,
+				Type:             process.Type,
+				Command:          process.Command,
+				HealthCheck:      process.HealthCheck,
+				Instances:        process.Instances,
+				DiskQuota:        process.Limits.Disk,
+				ReadinessCommand: process.ReadinessCommand,
+				Env:              process.Env,
+				Source:           process.Source,
 			})
 
 			result.ProcessTypes[process.Type] = process.Command
@@ -73,9 +156,42 @@ func ConvertToResult(data LaunchData) buildpackapplifecycle.StagingResult {
 				ProcessTypes: sidecarTargets,
 				Command:      process.Command,
 				Memory:       process.Limits.Memory,
+				Env:          process.Env,
+				Source:       process.Source,
 			})
 		}
 
 	}
+
+	sort.SliceStable(result.ProcessList, func(i, j int) bool {
+		a, b := result.ProcessList[i], result.ProcessList[j]
+		if (a.Type == "web") != (b.Type == "web") {
+			return a.Type == "web"
+		}
+		if sourceRank(a.Source) != sourceRank(b.Source) {
+			return sourceRank(a.Source) < sourceRank(b.Source)
+		}
+		return a.Type < b.Type
+	})
+
+	sort.SliceStable(result.Sidecars, func(i, j int) bool {
+		a, b := result.Sidecars[i], result.Sidecars[j]
+		if sourceRank(a.Source) != sourceRank(b.Source) {
+			return sourceRank(a.Source) < sourceRank(b.Source)
+		}
+		return a.Name < b.Name
+	})
+
 	return result
 }
+
+// sourceRank puts processes of unknown origin last.
+func sourceRank(source *buildpackapplifecycle.ProcessSource) int {
+	if source == nil {
+		return len(sourceRanks)
+	}
+	if rank, ok := sourceRanks[source.Kind]; ok {
+		return rank
+	}
+	return len(sourceRanks)
+}
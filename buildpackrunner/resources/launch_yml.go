@@ -0,0 +1,326 @@
+package resources
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"code.cloudfoundry.org/buildpackapplifecycle"
+)
+
+// MaxProcessMemory is the largest memory limit, in MB, that a launch.yml may
+// give a process.
+const MaxProcessMemory = 1024 * 1024
+
+// MaxProcessDisk is the largest disk quota, in MB, that a launch.yml may give
+// a process.
+const MaxProcessDisk = 1024 * 1024
+
+var healthCheckTypes = []string{
+	buildpackapplifecycle.HealthCheckPort,
+	buildpackapplifecycle.HealthCheckProcess,
+	buildpackapplifecycle.HealthCheckHTTP,
+}
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LaunchYMLError is a problem with the launch.yml a buildpack wrote to its
+// deps directory. Line is 0 when the problem is not with a particular line.
+type LaunchYMLError struct {
+	Path           string
+	BuildpackIndex int
+	Line           int
+	Message        string
+}
+
+func (e LaunchYMLError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s (buildpack %d): %s", e.Path, e.BuildpackIndex, e.Message)
+	}
+	return fmt.Sprintf("%s:%d (buildpack %d): %s", e.Path, e.Line, e.BuildpackIndex, e.Message)
+}
+
+// launchYMLLocation is where in which launch.yml a process was declared.
+type launchYMLLocation struct {
+	path           string
+	buildpackIndex int
+	line           int
+}
+
+func (l launchYMLLocation) error(line int, format string, args ...interface{}) LaunchYMLError {
+	return LaunchYMLError{
+		Path:           l.path,
+		BuildpackIndex: l.buildpackIndex,
+		Line:           line,
+		Message:        fmt.Sprintf(format, args...),
+	}
+}
+
+// ReadLaunchYML reads the launch.yml at path, written by the buildpack at
+// buildpackIndex, and rejects keys it does not know, process types that are
+// empty or declared twice, empty commands, limits out of range, health checks
+// the platform cannot run, invalid environment variable names and defaults
+// declared for sidecars. Every problem found is returned, each as a
+// LaunchYMLError.
+func ReadLaunchYML(path string, buildpackIndex int) (LaunchData, error) {
+	location := launchYMLLocation{path: path, buildpackIndex: buildpackIndex}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return LaunchData{}, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return LaunchData{}, yamlError(location, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+
+	var launchData LaunchData
+	if err := decoder.Decode(&launchData); err != nil && err != io.EOF {
+		return LaunchData{}, yamlError(location, err)
+	}
+
+	processNodes := mappingValue(&document, "processes")
+
+	var errs []error
+	lines := map[string]int{}
+	for i := range launchData.Processes {
+		process := &launchData.Processes[i]
+
+		location.line = 0
+		var processNode *yaml.Node
+		if processNodes != nil && i < len(processNodes.Content) {
+			processNode = processNodes.Content[i]
+			location.line = processNode.Line
+		}
+		process.location = location
+
+		typeLine := valueLine(processNode, location.line, "type")
+		switch {
+		case process.Type == "":
+			errs = append(errs, location.error(typeLine, "process type must not be empty"))
+		case lines[process.Type] != 0:
+			errs = append(errs, location.error(typeLine, "process type %q is already declared on line %d", process.Type, lines[process.Type]))
+		default:
+			lines[process.Type] = typeLine
+		}
+
+		if strings.TrimSpace(process.Command) == "" {
+			errs = append(errs, location.error(valueLine(processNode, location.line, "command"), "command of process type %q must not be empty", process.Type))
+		}
+
+		if memory := process.Limits.Memory; memory < 0 || memory > MaxProcessMemory {
+			memoryLine := valueLine(mappingValue(processNode, "limits"), location.line, "memory")
+			errs = append(errs, location.error(memoryLine, "memory limit of process type %q must be between 0 and %d MB, not %d", process.Type, MaxProcessMemory, memory))
+		}
+
+		if disk := process.Limits.Disk; disk < 0 || disk > MaxProcessDisk {
+			diskLine := valueLine(mappingValue(processNode, "limits"), location.line, "disk")
+			errs = append(errs, location.error(diskLine, "disk quota of process type %q must be between 0 and %d MB, not %d", process.Type, MaxProcessDisk, disk))
+		}
+
+		if process.Instances < 0 {
+			errs = append(errs, location.error(valueLine(processNode, location.line, "instances"), "instances of process type %q must not be negative, not %d", process.Type, process.Instances))
+		}
+
+		if mappingValue(processNode, "readiness_command") != nil && strings.TrimSpace(process.ReadinessCommand) == "" {
+			errs = append(errs, location.error(valueLine(processNode, location.line, "readiness_command"), "readiness command of process type %q must not be empty", process.Type))
+		}
+
+		errs = append(errs, envErrors(location, mappingValue(processNode, "env"), process)...)
+
+		if process.HealthCheck != nil {
+			errs = append(errs, healthCheckErrors(location, mappingValue(processNode, "health_check"), process)...)
+		}
+
+		if len(process.Platforms.Cloudfoundry.SidecarFor) > 0 {
+			for _, key := range []string{"health_check", "instances", "readiness_command"} {
+				if mappingValue(processNode, key) != nil {
+					errs = append(errs, location.error(valueLine(processNode, location.line, key), "sidecar %q cannot declare %s", process.Type, key))
+				}
+			}
+			if mappingValue(mappingValue(processNode, "limits"), "disk") != nil {
+				errs = append(errs, location.error(valueLine(mappingValue(processNode, "limits"), location.line, "disk"), "sidecar %q cannot declare disk", process.Type))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return LaunchData{}, errors.Join(errs...)
+	}
+	return launchData, nil
+}
+
+// healthCheckErrors checks that the platform can run the health check of a
+// process: it must be of a known type, and only http health checks have an
+// endpoint, which is a path.
+func healthCheckErrors(location launchYMLLocation, healthCheckNode *yaml.Node, process *Process) []error {
+	defaultLine := location.line
+	if healthCheckNode != nil {
+		defaultLine = healthCheckNode.Line
+	}
+	healthCheck := process.HealthCheck
+
+	var errs []error
+	if !containsString(healthCheckTypes, healthCheck.Type) {
+		errs = append(errs, location.error(valueLine(healthCheckNode, defaultLine, "type"), "health check type of process type %q must be one of %s, not %q", process.Type, strings.Join(healthCheckTypes, ", "), healthCheck.Type))
+	}
+
+	endpointLine := valueLine(healthCheckNode, defaultLine, "endpoint")
+	switch {
+	case healthCheck.Endpoint == "":
+	case healthCheck.Type != buildpackapplifecycle.HealthCheckHTTP:
+		errs = append(errs, location.error(endpointLine, "health check endpoint of process type %q is only for http health checks", process.Type))
+	case !strings.HasPrefix(healthCheck.Endpoint, "/"):
+		errs = append(errs, location.error(endpointLine, "health check endpoint of process type %q must start with /, not %q", process.Type, healthCheck.Endpoint))
+	}
+
+	if healthCheck.Timeout < 0 {
+		errs = append(errs, location.error(valueLine(healthCheckNode, defaultLine, "timeout"), "health check timeout of process type %q must not be negative, not %d", process.Type, healthCheck.Timeout))
+	}
+	return errs
+}
+
+// envErrors rejects environment variables that a shell could not export.
+func envErrors(location launchYMLLocation, envNode *yaml.Node, process *Process) []error {
+	if envNode == nil || envNode.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var errs []error
+	for i := 0; i+1 < len(envNode.Content); i += 2 {
+		if name := envNode.Content[i]; !envName.MatchString(name.Value) {
+			errs = append(errs, location.error(name.Line, "environment variable %q of process type %q is not a valid name", name.Value, process.Type))
+		}
+	}
+	return errs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateSidecars checks that every sidecar is for process types that
+// exist, once the processes of all launch.yml files, the release and the
+// Procfile are merged. The web process always exists, as its command may
+// come from the app manifest or be given when the app is pushed. As the
+// launcher recognises sidecars by their command, a sidecar that declares
+// environment variables must not share its command with the processes it
+// runs alongside, and no two sidecars for the same process type may share
+// a command when either declares environment variables.
+func ValidateSidecars(processes []Process) error {
+	processTypes := map[string]bool{"web": true}
+	for _, process := range processes {
+		if len(process.Platforms.Cloudfoundry.SidecarFor) == 0 {
+			processTypes[process.Type] = true
+		}
+	}
+
+	var errs []error
+	for _, process := range processes {
+		for _, processType := range process.Platforms.Cloudfoundry.SidecarFor {
+			if !processTypes[processType] {
+				errs = append(errs, process.location.error(process.location.line, "sidecar %q is for process type %q, which does not exist", process.Type, processType))
+			}
+		}
+	}
+
+	for i, process := range processes {
+		sidecarFor := process.Platforms.Cloudfoundry.SidecarFor
+		if len(sidecarFor) == 0 {
+			continue
+		}
+
+		for j, other := range processes {
+			if i == j || other.Command != process.Command {
+				continue
+			}
+
+			otherSidecarFor := other.Platforms.Cloudfoundry.SidecarFor
+			switch {
+			case len(otherSidecarFor) == 0:
+				if len(process.Env) > 0 && containsString(sidecarFor, other.Type) {
+					errs = append(errs, process.location.error(process.location.line, "sidecar %q declares env but has the same command as process type %q, so the launcher cannot tell them apart", process.Type, other.Type))
+				}
+			case j < i:
+				if (len(process.Env) > 0 || len(other.Env) > 0) && sharesString(sidecarFor, otherSidecarFor) {
+					errs = append(errs, process.location.error(process.location.line, "sidecar %q has the same command as sidecar %q for the same process type, so the launcher cannot tell which env to set", process.Type, other.Type))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sharesString(a, b []string) bool {
+	for _, s := range a {
+		if containsString(b, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlError turns the errors of the YAML decoder, which carry their line in
+// the message, into LaunchYMLErrors.
+func yamlError(location launchYMLLocation, err error) error {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	var errs []error
+	for _, message := range messages {
+		line := 0
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+			message = match[2]
+		}
+		errs = append(errs, location.error(line, "%s", message))
+	}
+	return errors.Join(errs...)
+}
+
+// mappingValue returns the node of the value of key in a mapping, or in the
+// mapping of a document, or nil if there is none.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// valueLine returns the line of the value of key in a mapping, or
+// defaultLine if it has no such key.
+func valueLine(node *yaml.Node, defaultLine int, key string) int {
+	if value := mappingValue(node, key); value != nil {
+		return value.Line
+	}
+	return defaultLine
+}
@@ -0,0 +1,179 @@
+package resources_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner/resources"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ReadLaunchYML", func() {
+	var launchPath string
+
+	BeforeEach(func() {
+		launchPath = filepath.Join(GinkgoT().TempDir(), "launch.yml")
+	})
+
+	readLaunchYML := func(contents string) (resources.LaunchData, error) {
+		Expect(os.WriteFile(launchPath, []byte(contents), 0644)).To(Succeed())
+		return resources.ReadLaunchYML(launchPath, 2)
+	}
+
+	It("reads the processes and sidecars", func() {
+		launchData, err := readLaunchYML("processes:\n- type: web\n  command: serve\n  env:\n    JAVA_OPTS: -Xmx1g\n- type: agent\n  command: watch\n  limits:\n    memory: 64\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(launchData.Processes).To(HaveLen(2))
+		Expect(launchData.Processes[0].Type).To(Equal("web"))
+		Expect(launchData.Processes[0].Env).To(Equal(map[string]string{"JAVA_OPTS": "-Xmx1g"}))
+		Expect(launchData.Processes[1].Limits.Memory).To(Equal(64))
+		Expect(launchData.Processes[1].Platforms.Cloudfoundry.SidecarFor).To(Equal([]string{"web"}))
+	})
+
+	It("accepts an empty file", func() {
+		launchData, err := readLaunchYML("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(launchData.Processes).To(BeEmpty())
+	})
+
+	It("fails for a file that cannot be read", func() {
+		_, err := resources.ReadLaunchYML(launchPath, 2)
+		Expect(err).To(HaveOccurred())
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	DescribeTable("rejects invalid files with the line at fault",
+		func(contents string, line int, message string) {
+			_, err := readLaunchYML(contents)
+
+			var launchYMLErr resources.LaunchYMLError
+			Expect(errors.As(err, &launchYMLErr)).To(BeTrue())
+			Expect(launchYMLErr.Path).To(Equal(launchPath))
+			Expect(launchYMLErr.BuildpackIndex).To(Equal(2))
+			Expect(launchYMLErr.Line).To(Equal(line))
+			Expect(launchYMLErr.Message).To(ContainSubstring(message))
+		},
+		Entry("invalid YAML", "processes:\n- type: web\n command: serve\n", 2, "did not find expected key"),
+		Entry("unknown top-level keys", "process:\n- type: web\n  command: serve\n", 1, "field process not found"),
+		Entry("unknown process keys", "processes:\n- type: web\n  command: serve\n  sidecar-for: [web]\n", 4, "field sidecar-for not found"),
+		Entry("unknown platform keys", "processes:\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecars_for: [web]\n", 6, "field sidecars_for not found"),
+		Entry("values of the wrong type", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: lots\n", 5, "cannot unmarshal"),
+		Entry("empty process types", "processes:\n- command: serve\n", 2, "process type must not be empty"),
+		Entry("duplicate process types", "processes:\n- type: web\n  command: serve\n- type: web\n  command: serve again\n", 4, `process type "web" is already declared on line 2`),
+		Entry("missing commands", "processes:\n- type: web\n", 2, `command of process type "web" must not be empty`),
+		Entry("blank commands", "processes:\n- type: web\n  command: ' '\n", 3, `command of process type "web" must not be empty`),
+		Entry("negative memory", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: -1\n", 5, `memory limit of process type "web" must be between 0 and 1048576 MB, not -1`),
+		Entry("too much memory", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: 1048577\n", 5, `memory limit of process type "web" must be between 0 and 1048576 MB, not 1048577`),
+		Entry("negative disk quotas", "processes:\n- type: web\n  command: serve\n  limits:\n    disk: -1\n", 5, `disk quota of process type "web" must be between 0 and 1048576 MB, not -1`),
+		Entry("too large disk quotas", "processes:\n- type: web\n  command: serve\n  limits:\n    disk: 1048577\n", 5, `disk quota of process type "web" must be between 0 and 1048576 MB, not 1048577`),
+		Entry("negative instances", "processes:\n- type: web\n  command: serve\n  instances: -1\n", 4, `instances of process type "web" must not be negative, not -1`),
+		Entry("empty readiness commands", "processes:\n- type: web\n  command: serve\n  readiness_command: ''\n", 4, `readiness command of process type "web" must not be empty`),
+		Entry("unknown health check types", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: tcp\n", 5, `health check type of process type "web" must be one of port, process, http, not "tcp"`),
+		Entry("health checks without a type", "processes:\n- type: web\n  command: serve\n  health_check:\n    timeout: 5\n", 5, `health check type of process type "web" must be one of port, process, http, not ""`),
+		Entry("endpoints for health checks other than http", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: port\n    endpoint: /health\n", 6, `health check endpoint of process type "web" is only for http health checks`),
+		Entry("health check endpoints that are not paths", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: http\n    endpoint: health\n", 6, `health check endpoint of process type "web" must start with /, not "health"`),
+		Entry("negative health check timeouts", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: port\n    timeout: -5\n", 6, `health check timeout of process type "web" must not be negative, not -5`),
+		Entry("environment variable names with dashes", "processes:\n- type: web\n  command: serve\n  env:\n    JAVA-HOME: /opt/java\n", 5, `environment variable "JAVA-HOME" of process type "web" is not a valid name`),
+		Entry("environment variable names starting with a digit", "processes:\n- type: web\n  command: serve\n  env:\n    1PATH: /bin\n", 5, `environment variable "1PATH" of process type "web" is not a valid name`),
+		Entry("instances for sidecars", "processes:\n- type: agent\n  command: watch\n  instances: 2\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n", 4, `sidecar "agent" cannot declare instances`),
+		Entry("disk quotas for sidecars", "processes:\n- type: agent\n  command: watch\n  limits:\n    disk: 64\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n", 5, `sidecar "agent" cannot declare disk`),
+	)
+
+	DescribeTable("accepts limits at the ends of their ranges",
+		func(contents string) {
+			_, err := readLaunchYML(contents)
+			Expect(err).NotTo(HaveOccurred())
+		},
+		Entry("no memory limit", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: 0\n"),
+		Entry("the most memory", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: 1048576\n"),
+		Entry("no disk quota", "processes:\n- type: web\n  command: serve\n  limits:\n    disk: 0\n"),
+		Entry("the largest disk quota", "processes:\n- type: web\n  command: serve\n  limits:\n    disk: 1048576\n"),
+	)
+
+	It("reports every problem in the file", func() {
+		_, err := readLaunchYML("processes:\n- type: web\n  command: ''\n- type: web\n  command: serve\n  instances: -1\n")
+		Expect(err).To(MatchError(ContainSubstring(launchPath + `:3 (buildpack 2): command of process type "web" must not be empty`)))
+		Expect(err).To(MatchError(ContainSubstring(launchPath + `:4 (buildpack 2): process type "web" is already declared on line 2`)))
+		Expect(err).To(MatchError(ContainSubstring(launchPath + `:6 (buildpack 2): instances of process type "web" must not be negative, not -1`)))
+	})
+})
+
+var _ = Describe("LaunchYMLError", func() {
+	It("includes the line when there is one", func() {
+		err := resources.LaunchYMLError{Path: "/deps/0/launch.yml", BuildpackIndex: 0, Line: 3, Message: "bad"}
+		Expect(err.Error()).To(Equal("/deps/0/launch.yml:3 (buildpack 0): bad"))
+	})
+
+	It("leaves out the line when there is none", func() {
+		err := resources.LaunchYMLError{Path: "/deps/0/launch.yml", BuildpackIndex: 0, Message: "bad"}
+		Expect(err.Error()).To(Equal("/deps/0/launch.yml (buildpack 0): bad"))
+	})
+})
+
+var _ = Describe("ValidateSidecars", func() {
+	var launchPath string
+
+	BeforeEach(func() {
+		launchPath = filepath.Join(GinkgoT().TempDir(), "launch.yml")
+	})
+
+	readProcesses := func(contents string) []resources.Process {
+		Expect(os.WriteFile(launchPath, []byte(contents), 0644)).To(Succeed())
+		launchData, err := resources.ReadLaunchYML(launchPath, 1)
+		Expect(err).NotTo(HaveOccurred())
+		return launchData.Processes
+	}
+
+	It("accepts sidecars for process types that exist", func() {
+		processes := readProcesses("processes:\n- type: worker\n  command: work\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [worker]\n")
+		Expect(resources.ValidateSidecars(processes)).To(Succeed())
+	})
+
+	It("accepts sidecars for web without a web process, as its command can be given at runtime", func() {
+		processes := readProcesses("processes:\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n")
+		Expect(resources.ValidateSidecars(processes)).To(Succeed())
+	})
+
+	It("accepts processes from elsewhere", func() {
+		processes := readProcesses("processes:\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [worker]\n")
+		processes = append(processes, resources.Process{Type: "worker", Command: "work"})
+		Expect(resources.ValidateSidecars(processes)).To(Succeed())
+	})
+
+	It("rejects sidecars for process types that do not exist, at the line of the sidecar", func() {
+		processes := readProcesses("processes:\n- type: web\n  command: serve\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web, wrker]\n")
+
+		err := resources.ValidateSidecars(processes)
+		var launchYMLErr resources.LaunchYMLError
+		Expect(errors.As(err, &launchYMLErr)).To(BeTrue())
+		Expect(launchYMLErr.Line).To(Equal(4))
+		Expect(launchYMLErr.BuildpackIndex).To(Equal(1))
+		Expect(launchYMLErr.Message).To(Equal(`sidecar "agent" is for process type "wrker", which does not exist`))
+	})
+
+	It("rejects sidecars with env that share their command with a process they run alongside", func() {
+		processes := readProcesses("processes:\n- type: worker\n  command: work\n- type: agent\n  command: work\n  env:\n    MODE: agent\n  platforms:\n    cloudfoundry:\n      sidecar_for: [worker]\n")
+		Expect(resources.ValidateSidecars(processes)).To(MatchError(ContainSubstring(`:4 (buildpack 1): sidecar "agent" declares env but has the same command as process type "worker"`)))
+	})
+
+	It("rejects sidecars for the same process type that share a command when either declares env", func() {
+		processes := readProcesses("processes:\n- type: agent\n  command: watch\n  env:\n    MODE: agent\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n- type: other-agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web, worker]\n- type: worker\n  command: work\n")
+		err := resources.ValidateSidecars(processes)
+		Expect(err).To(MatchError(ContainSubstring(`:9 (buildpack 1): sidecar "other-agent" has the same command as sidecar "agent" for the same process type`)))
+		Expect(strings.Count(err.Error(), "same command")).To(Equal(1))
+	})
+
+	It("accepts sidecars sharing a command when the launcher need not tell them apart", func() {
+		processes := readProcesses("processes:\n- type: worker\n  command: watch\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web, worker]\n- type: other-agent\n  command: watch\n  env:\n    MODE: other\n  platforms:\n    cloudfoundry:\n      sidecar_for: [clock]\n- type: clock\n  command: tick\n")
+		Expect(resources.ValidateSidecars(processes)).To(Succeed())
+	})
+
+	It("does not count sidecars as process types", func() {
+		processes := readProcesses("processes:\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n- type: helper\n  command: help\n  platforms:\n    cloudfoundry:\n      sidecar_for: [agent]\n")
+		Expect(resources.ValidateSidecars(processes)).To(MatchError(ContainSubstring(`sidecar "helper" is for process type "agent", which does not exist`)))
+	})
+})
@@ -2,6 +2,7 @@ package buildpackrunner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,14 +10,16 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner/resources"
@@ -26,26 +29,51 @@ import (
 const DOWNLOAD_TIMEOUT = 10 * time.Minute
 
 type Runner struct {
+	ctx         context.Context
 	config      *buildpackapplifecycle.LifecycleBuilderConfig
 	depsDir     string
 	contentsDir string
 	profileDir  string
+	events      *eventWriter
+	// commits checked out for git buildpacks, by buildpack key
+	gitCommits  map[string]string
+	credentials *Credentials
 }
 
 type descriptiveError struct {
-	message string
-	err     error
+	message      string
+	err          error
+	phase        string
+	buildpackKey string
+	exitCode     int
 }
 
 type Release struct {
 	DefaultProcessTypes buildpackapplifecycle.ProcessTypes `yaml:"default_process_types"`
 }
 
+// buildpack keys may be URLs with credentials, which must not be logged
 func (e descriptiveError) Error() string {
 	if e.err == nil {
-		return e.message
+		return buildpackapplifecycle.RedactCredentials(e.message)
 	}
-	return fmt.Sprintf("%s: %s", e.message, e.err.Error())
+	return buildpackapplifecycle.RedactCredentials(fmt.Sprintf("%s: %s", e.message, e.err.Error()))
+}
+
+func (e descriptiveError) Unwrap() error {
+	return e.err
+}
+
+func (e descriptiveError) Phase() string {
+	return e.phase
+}
+
+func (e descriptiveError) BuildpackKey() string {
+	return buildpackapplifecycle.RedactCredentials(e.buildpackKey)
+}
+
+func (e descriptiveError) ExitCode() int {
+	return e.exitCode
 }
 
 func newDescriptiveError(err error, message string, args ...interface{}) error {
@@ -55,9 +83,68 @@ func newDescriptiveError(err error, message string, args ...interface{}) error {
 	return descriptiveError{message: fmt.Sprintf(message, args...), err: err}
 }
 
+// newStagingError attributes a failure to a staging phase and buildpack, so
+// that the exit code and result.json failure no longer depend on the message.
+func newStagingError(err error, phase, buildpack, message string) error {
+	exitCode := buildpackapplifecycle.PhaseExitCode(phase)
+
+	var timeoutErr scriptTimeoutError
+	if errors.As(err, &timeoutErr) {
+		exitCode = buildpackapplifecycle.TIMEOUT_FAIL_CODE
+	}
+
+	var launchYMLErr resources.LaunchYMLError
+	if errors.As(err, &launchYMLErr) {
+		exitCode = buildpackapplifecycle.LAUNCH_YML_FAIL_CODE
+	}
+
+	return descriptiveError{
+		message:      message,
+		err:          err,
+		phase:        phase,
+		buildpackKey: buildpack,
+		exitCode:     exitCode,
+	}
+}
+
+// finalBuildpackError keeps the phase and message of a failure of the final
+// buildpack, while exiting with the code staging has always used for it.
+func finalBuildpackError(err error, buildpack string) error {
+	var stagingErr descriptiveError
+	if !errors.As(err, &stagingErr) || stagingErr.phase == "" {
+		return newStagingError(err, buildpackapplifecycle.CompilePhase, buildpack, buildpackapplifecycle.CompileFailMsg)
+	}
+
+	if stagingErr.exitCode != buildpackapplifecycle.TIMEOUT_FAIL_CODE && stagingErr.exitCode != buildpackapplifecycle.LAUNCH_YML_FAIL_CODE {
+		stagingErr.exitCode = buildpackapplifecycle.COMPILE_FAIL_CODE
+	}
+	return stagingErr
+}
+
+// scriptWaitDelay bounds how long a killed buildpack script may hold on to its
+// output pipes before the runner stops waiting for it.
+const scriptWaitDelay = 10 * time.Second
+
+type scriptTimeoutError struct {
+	script  string
+	timeout time.Duration
+}
+
+func (e scriptTimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s exceeded %s", buildpackapplifecycle.TimeoutFailMsg, e.script, e.timeout)
+}
+
 func New(config *buildpackapplifecycle.LifecycleBuilderConfig) *Runner {
+	return NewWithContext(context.Background(), config)
+}
+
+// NewWithContext returns a Runner whose buildpack scripts are killed once ctx
+// is done.
+func NewWithContext(ctx context.Context, config *buildpackapplifecycle.LifecycleBuilderConfig) *Runner {
 	return &Runner{
-		config: config,
+		ctx:        ctx,
+		config:     config,
+		gitCommits: map[string]string{},
 	}
 }
 
@@ -73,28 +160,27 @@ func (runner *Runner) ProcessYML(selectedBuildpacks []string) (resources.LaunchD
 	var launchYML resources.LaunchData
 	var err error
 
-	for index := range selectedBuildpacks {
-		if launchYML, err = runner.MergeLaunchYML(index, launchYML); err != nil {
-			return resources.LaunchData{}, err
+	for index, buildpack := range selectedBuildpacks {
+		if launchYML, err = runner.MergeLaunchYML(index, buildpack, launchYML); err != nil {
+			return resources.LaunchData{}, newStagingError(err, buildpackapplifecycle.ReleasePhase, buildpack, buildpackapplifecycle.LaunchYMLFailMsg)
 		}
 	}
 	return launchYML, nil
 }
 
-func (runner *Runner) MergeLaunchYML(buildpackIndex int, procMap resources.LaunchData) (resources.LaunchData, error) {
+func (runner *Runner) MergeLaunchYML(buildpackIndex int, buildpack string, procMap resources.LaunchData) (resources.LaunchData, error) {
 	if runner.launchYMLExists(buildpackIndex) {
 		launchYMLPath := filepath.Join(runner.depsDir, strconv.Itoa(buildpackIndex), "launch.yml")
 
-		data, err := os.ReadFile(launchYMLPath)
+		buildPackLaunchYML, err := resources.ReadLaunchYML(launchYMLPath, buildpackIndex)
 		if err != nil {
 			return resources.LaunchData{}, err
 		}
 
-		var buildPackLaunchYML resources.LaunchData
-		if err := yaml.Unmarshal(data, &buildPackLaunchYML); err != nil {
-			return resources.LaunchData{}, err
-		}
-
+		resources.SetSource(buildPackLaunchYML.Processes, buildpackapplifecycle.ProcessSource{
+			Kind:      buildpackapplifecycle.ProcessSourceLaunchYML,
+			Buildpack: buildpackapplifecycle.RedactCredentials(buildpack),
+		})
 		procMap.Processes = resources.MergeProcesses(procMap.Processes, buildPackLaunchYML.Processes)
 	}
 	return procMap, nil
@@ -106,31 +192,41 @@ func (runner *Runner) ProcessFinalBuildpack(detectedBuildpack, detectedBuildpack
 
 	if runner.launchYMLExists(buildpackIndex) {
 		var err error
-		if procMap, err = runner.MergeLaunchYML(buildpackIndex, procMap); err != nil {
-			return resources.LaunchData{}, err
+		if procMap, err = runner.MergeLaunchYML(buildpackIndex, detectedBuildpack, procMap); err != nil {
+			return resources.LaunchData{}, newStagingError(err, buildpackapplifecycle.ReleasePhase, detectedBuildpack, buildpackapplifecycle.LaunchYMLFailMsg)
 		}
 	} else {
-		releaseInfo, err := runner.release(detectedBuildpackDir, map[string]string{})
+		releaseInfo, err := runner.release(detectedBuildpack, detectedBuildpackDir, map[string]string{})
 		if err != nil {
-			return resources.LaunchData{}, newDescriptiveError(err, buildpackapplifecycle.ReleaseFailMsg)
+			return resources.LaunchData{}, newStagingError(err, buildpackapplifecycle.ReleasePhase, detectedBuildpack, buildpackapplifecycle.ReleaseFailMsg)
 		}
 
 		procMap.Processes = resources.MergeProcesses(
 			procMap.Processes,
-			resources.ProcDataToProcesses(releaseInfo.DefaultProcessTypes),
+			resources.ProcDataToProcesses(releaseInfo.DefaultProcessTypes, buildpackapplifecycle.ProcessSource{
+				Kind:      buildpackapplifecycle.ProcessSourceRelease,
+				Buildpack: buildpackapplifecycle.RedactCredentials(detectedBuildpack),
+			}),
 		)
 	}
 
 	startCommands, err := runner.readProcfile()
+	runner.emitProcfileEvent(startCommands, err)
 	if err != nil {
 		return resources.LaunchData{}, newDescriptiveError(err, "Failed to read command from Procfile")
 	}
 
 	procMap.Processes = resources.MergeProcesses(
 		procMap.Processes,
-		resources.ProcDataToProcesses(startCommands),
+		resources.ProcDataToProcesses(startCommands, buildpackapplifecycle.ProcessSource{
+			Kind: buildpackapplifecycle.ProcessSourceProcfile,
+		}),
 	)
 
+	if err := resources.ValidateSidecars(procMap.Processes); err != nil {
+		return resources.LaunchData{}, newStagingError(err, buildpackapplifecycle.ReleasePhase, runner.launchYMLBuildpack(err, detectedBuildpack), buildpackapplifecycle.LaunchYMLFailMsg)
+	}
+
 	return procMap, nil
 }
 
@@ -147,11 +243,32 @@ func (runner *Runner) WriteStagingInfoYML(resultData buildpackapplifecycle.Stagi
 		lastBuildpack = buildpacks[len(buildpacks)-1]
 	}
 
-	err = json.NewEncoder(stagingInfoFile).Encode(DeaStagingInfo{
+	stagingInfo := DeaStagingInfo{
 		DetectedBuildpack: lastBuildpack.Name,
 		StartCommand:      resultData.ProcessTypes["web"],
 		Config:            lastBuildpack.Config,
-	})
+	}
+	for _, process := range resultData.ProcessList {
+		if len(process.Env) == 0 {
+			continue
+		}
+		if stagingInfo.ProcessEnv == nil {
+			stagingInfo.ProcessEnv = map[string]map[string]string{}
+		}
+		stagingInfo.ProcessEnv[process.Type] = process.Env
+	}
+	for _, sidecar := range resultData.Sidecars {
+		if len(sidecar.Env) > 0 {
+			stagingInfo.SidecarEnv = append(stagingInfo.SidecarEnv, SidecarEnv{
+				Name:         sidecar.Name,
+				Command:      sidecar.Command,
+				ProcessTypes: sidecar.ProcessTypes,
+				Env:          sidecar.Env,
+			})
+		}
+	}
+
+	err = json.NewEncoder(stagingInfoFile).Encode(stagingInfo)
 	if err != nil {
 		return "", err
 	}
@@ -168,6 +285,7 @@ func (runner *Runner) WriteResultJSON(resultData buildpackapplifecycle.StagingRe
 		BuildpackKey:      lastBuildpack.Key,
 		DetectedBuildpack: lastBuildpack.Name,
 		Buildpacks:        buildpacks,
+		Compression:       runner.config.Compression(),
 	})
 
 	resultPath := runner.config.OutputMetadata()
@@ -214,10 +332,24 @@ func (runner *Runner) WriteStartCommands(detectedBuildpackDir, detectedBuildpack
 }
 
 func (runner *Runner) Setup() error {
+	events, err := openEventWriter(runner.config.OutputEvents())
+	if err != nil {
+		return newDescriptiveError(err, "Failed to open staging events output")
+	}
+	runner.events = events
+
 	if err := runner.makeDirectories(); err != nil {
 		return newDescriptiveError(err, "Failed to set up filesystem when generating droplet")
 	}
 
+	credentials, err := LoadCredentials(runner.config.BuildpackCredentialsFile())
+	if err != nil {
+		return newDescriptiveError(err, "Failed to load buildpack credentials")
+	}
+	runner.credentials = credentials
+	// buildpack scripts have no business with the credentials
+	os.Unsetenv(BuildpackCredentialsEnv)
+
 	if err := runner.downloadBuildpacks(); err != nil {
 		return err
 	}
@@ -230,41 +362,54 @@ func (runner *Runner) GoLikeLightning() (string, string, error) {
 
 	if runner.config.SkipDetect() {
 		var err error
+		buildpackKeys = runner.config.BuildpackOrder()
+		if err := runner.checkStacks(buildpackKeys); err != nil {
+			runner.writeFailureResultJSON(buildpackKeys, err)
+			return "", "", err
+		}
 		detectedBuildpack, detectedBuildpackDir, err = runner.runSupplyBuildpacks()
 		if err != nil {
+			runner.writeFailureResultJSON(buildpackKeys, err)
 			return "", "", err
 		}
-		buildpackKeys = runner.config.BuildpackOrder()
 	} else {
-		var ok bool
-		detectedBuildpack, detectedBuildpackDir, detectOutput, ok = runner.detect()
-		if !ok {
-			return "", "", newDescriptiveError(nil, buildpackapplifecycle.DetectFailMsg)
+		var err error
+		detectedBuildpack, detectedBuildpackDir, detectOutput, err = runner.detect()
+		if err != nil {
+			runner.writeFailureResultJSON([]string{}, err)
+			return "", "", err
 		}
 		buildpackKeys = []string{detectedBuildpack}
 	}
 
 	resultJSONPath, stagingInfoYMLPath, err := runner.build(detectedBuildpack, detectedBuildpackDir, detectOutput)
 	if err != nil {
-		// write result json even if build fails to capture buildpack metadata
-		buildpacks := runner.buildpacksMetadata(buildpackKeys)
-		runner.WriteResultJSON(
-			buildpackapplifecycle.StagingResult{
-				LifecycleType: "buildpack",
-			}, buildpacks) //nolint:errcheck
+		runner.writeFailureResultJSON(buildpackKeys, err)
 		return "", "", err
 	}
 
 	if err := runner.packageDroplet(); err != nil {
+		runner.writeFailureResultJSON(buildpackKeys, err)
 		return "", "", err
 	}
 
 	return resultJSONPath, stagingInfoYMLPath, nil
 }
 
+// write result json even if staging fails to capture buildpack metadata and
+// a machine-readable description of the failure
+func (runner *Runner) writeFailureResultJSON(buildpackKeys []string, err error) {
+	buildpacks := runner.buildpacksMetadata(buildpackKeys)
+	runner.WriteResultJSON(
+		buildpackapplifecycle.StagingResult{
+			LifecycleType: "buildpack",
+			Failure:       buildpackapplifecycle.NewStagingFailure(err),
+		}, buildpacks) //nolint:errcheck
+}
+
 func (runner *Runner) build(detectedBuildpack, detectedBuildpackDir, detectOutput string) (string, string, error) {
-	if err := runner.runFinalize(detectedBuildpackDir); err != nil {
-		return "", "", newDescriptiveError(err, buildpackapplifecycle.CompileFailMsg)
+	if err := runner.runFinalize(detectedBuildpack, detectedBuildpackDir); err != nil {
+		return "", "", finalBuildpackError(err, detectedBuildpack)
 	}
 
 	procMap, err := runner.ProcessYML(runner.config.SupplyBuildpacks())
@@ -281,6 +426,14 @@ func (runner *Runner) build(detectedBuildpack, detectedBuildpackDir, detectOutpu
 }
 
 func (runner *Runner) packageDroplet() error {
+	if err := runner.step(EventStepPackageDroplet, "", runner.packageDropletContents); err != nil {
+		return err
+	}
+
+	return runner.step(EventStepPackageCache, "", runner.packageBuildArtifactsCache)
+}
+
+func (runner *Runner) packageDropletContents() error {
 	for _, name := range []string{"tmp", "logs"} {
 		if err := os.MkdirAll(filepath.Join(runner.contentsDir, name), 0755); err != nil {
 			return newDescriptiveError(err, "Failed to set up droplet filesystem")
@@ -292,22 +445,43 @@ func (runner *Runner) packageDroplet() error {
 		return newDescriptiveError(err, "Failed to copy compiled droplet")
 	}
 
-	tarPath, err := runner.findTar()
+	manifest := &buildpackapplifecycle.DropletManifest{Files: []buildpackapplifecycle.DropletManifestFile{}}
+	if err := writeArchive(runner.contentsDir, runner.config.OutputDroplet(), runner.config.Compression(), runner.config.CompressionLevel(), manifest); err != nil {
+		return newDescriptiveError(err, "Failed to compress droplet filesystem")
+	}
+
+	if err := runner.writeDropletManifest(manifest); err != nil {
+		return newDescriptiveError(err, "Failed to write droplet manifest")
+	}
+
+	return nil
+}
+
+func (runner *Runner) writeDropletManifest(manifest *buildpackapplifecycle.DropletManifest) error {
+	if err := os.MkdirAll(filepath.Dir(runner.config.OutputDropletManifest()), 0755); err != nil {
+		return err
+	}
+
+	manifestFile, err := os.Create(runner.config.OutputDropletManifest())
 	if err != nil {
-		return newDescriptiveError(err, "Unable to find tar executable")
+		return err
 	}
+	defer manifestFile.Close()
 
-	if output, err := exec.Command(tarPath, "-czf", runner.config.OutputDroplet(), "-C", runner.contentsDir, ".").CombinedOutput(); err != nil {
-		return newDescriptiveError(err, "Failed to compress droplet filesystem: %s", string(output))
+	if err := json.NewEncoder(manifestFile).Encode(manifest); err != nil {
+		return err
 	}
+	return manifestFile.Close()
+}
 
+func (runner *Runner) packageBuildArtifactsCache() error {
 	//prepare the build artifacts cache output directory
 	if err := os.MkdirAll(filepath.Dir(runner.config.OutputBuildArtifactsCache()), 0755); err != nil {
 		return newDescriptiveError(err, "Failed to create output build artifacts cache dir")
 	}
 
-	if output, err := exec.Command(tarPath, "-czf", runner.config.OutputBuildArtifactsCache(), "-C", runner.config.BuildArtifactsCacheDir(), ".").CombinedOutput(); err != nil {
-		return newDescriptiveError(err, "Failed to compress build artifacts: %s", string(output))
+	if err := writeArchive(runner.config.BuildArtifactsCacheDir(), runner.config.OutputBuildArtifactsCache(), runner.config.Compression(), runner.config.CompressionLevel(), nil); err != nil {
+		return newDescriptiveError(err, "Failed to compress build artifacts")
 	}
 
 	return nil
@@ -323,12 +497,26 @@ func (runner *Runner) Run() (string, error) {
 }
 
 func (runner *Runner) CleanUp() error {
+	if err := runner.events.Close(); err != nil {
+		return err
+	}
+
 	if runner.contentsDir == "" {
 		return nil
 	}
 	return os.RemoveAll(runner.contentsDir)
 }
 
+// launchYMLBuildpack returns the buildpack that wrote the launch.yml a
+// LaunchYMLError is about.
+func (runner *Runner) launchYMLBuildpack(err error, finalBuildpack string) string {
+	var launchYMLErr resources.LaunchYMLError
+	if errors.As(err, &launchYMLErr) && launchYMLErr.BuildpackIndex < len(runner.config.SupplyBuildpacks()) {
+		return runner.config.SupplyBuildpacks()[launchYMLErr.BuildpackIndex]
+	}
+	return finalBuildpack
+}
+
 func (runner *Runner) launchYMLExists(index int) bool {
 	launchYMLPath := filepath.Join(runner.depsDir, strconv.Itoa(index), "launch.yml")
 	if _, err := os.Stat(launchYMLPath); err == nil {
@@ -349,6 +537,25 @@ func (runner *Runner) buildpacksMetadata(buildpackKeyList []string) []buildpacka
 			yaml.Unmarshal(contents, &metadata) //nolint:errcheck
 		}
 
+		// downloads fail unless a pinned digest matches, so a pinned digest
+		// is always the verified one
+		if buildpackURL, err := url.Parse(key); err == nil && buildpackURL.IsAbs() && runner.gitCommits[key] == "" {
+			if digest, err := ParseBuildpackDigest(buildpackURL); err == nil && digest != nil {
+				metadata.Digest = digest.String()
+			}
+		}
+		metadata.Commit = runner.gitCommits[key]
+
+		if buildpackPath, err := runner.buildpackPath(key); err == nil {
+			if manifest, err := ReadBuildpackManifest(buildpackPath); err == nil && manifest != nil {
+				metadata.Language = manifest.Language
+			}
+			if metadata.Version == "" {
+				metadata.Version = readBuildpackVersion(buildpackPath)
+			}
+		}
+		metadata.Key = buildpackapplifecycle.RedactCredentials(metadata.Key)
+
 		buildpacksMetadataList = append(buildpacksMetadataList, metadata)
 	}
 
@@ -396,37 +603,95 @@ func (runner *Runner) makeDirectories() error {
 	return nil
 }
 
-func (runner *Runner) downloadBuildpacks() error {
-	// Do we have a custom buildpack?
-	for _, buildpackName := range runner.config.BuildpackOrder() {
-		buildpackURL, err := url.Parse(buildpackName)
+func (runner *Runner) downloadBuildpack(buildpackName string, buildpackURL *url.URL, destination string, cache *DownloadCache, output io.Writer) (string, error) {
+	authenticatedURL := runner.credentials.Apply(buildpackURL)
+
+	// local repositories are cloned like remote ones, as only they can
+	// resolve the branch or commit in the fragment
+	if buildpackURL.Scheme == "file" && !isGitFragment(buildpackURL.Fragment) {
+		size, err := CopyLocalBuildpack(buildpackURL, destination, runner.extractionLimits())
 		if err != nil {
-			return fmt.Errorf("Invalid buildpack url (%s): %s", buildpackName, err.Error())
+			return "", err
 		}
-		if !buildpackURL.IsAbs() {
-			continue
+		fmt.Fprintf(output, "Copied buildpack `%s` (%s)\n", redactedURL(buildpackURL), bytefmt.ByteSize(size))
+		return "", nil
+	}
+
+	if mayBeArchive(buildpackURL) {
+		zipDownloader, err := NewZipDownloaderWithOptions(runner.downloadOptions(output), cache)
+		if err != nil {
+			return "", newDescriptiveError(err, "Failed to set up the connection for buildpack downloads")
+		}
+		size, err := zipDownloader.DownloadAndExtract(authenticatedURL, destination)
+		if err == nil {
+			fmt.Fprintf(output, "Downloaded buildpack `%s` (%s)\n", redactedURL(buildpackURL), bytefmt.ByteSize(size))
+			return "", nil
+		}
+		if !errors.Is(err, ErrUnknownArchiveFormat) {
+			return "", err
 		}
+	}
 
-		destination := runner.config.BuildpackPath(buildpackName)
+	return GitCloneWithOptions(*authenticatedURL, destination, runner.transportOptions())
+}
 
-		var downloadErr error
-		if IsZipFile(buildpackURL.Path) {
-			var size uint64
+// mayBeArchive tells archives by their extension, and leaves extensionless
+// HTTP(S) URLs to be identified on download. URLs of git repositories, which
+// end in .git or carry a fragment, are never probed.
+func mayBeArchive(buildpackURL *url.URL) bool {
+	if ArchiveFormatFromPath(buildpackURL.Path) != "" {
+		return true
+	}
+	if buildpackURL.Scheme != "http" && buildpackURL.Scheme != "https" {
+		return false
+	}
+	return buildpackURL.Fragment == "" && path.Ext(buildpackURL.Path) == ""
+}
 
-			zipDownloader := NewZipDownloader(runner.config.SkipCertVerify())
-			size, downloadErr = zipDownloader.DownloadAndExtract(buildpackURL, destination)
-			if downloadErr == nil {
-				fmt.Printf("Downloaded buildpack `%s` (%s)\n", buildpackURL.String(), bytefmt.ByteSize(size))
-			}
-		} else {
-			downloadErr = GitClone(*buildpackURL, destination)
-		}
-		if downloadErr != nil {
-			return downloadErr
-		}
+// isGitFragment is true for fragments only understood by GitClone, and false
+// for those that may pin the digest of an archive
+func isGitFragment(fragment string) bool {
+	return fragment != "" && !strings.HasPrefix(fragment, "sha256=")
+}
+
+func (runner *Runner) downloadOptions(output io.Writer) DownloadOptions {
+	return DownloadOptions{
+		Attempts:         runner.config.BuildpackDownloadAttempts(),
+		RetryDelay:       runner.config.BuildpackDownloadRetryDelay(),
+		Timeout:          runner.config.BuildpackDownloadTimeout(),
+		ConnectTimeout:   runner.config.BuildpackDownloadConnectTimeout(),
+		TransportOptions: runner.transportOptions(),
+		Limits:           runner.extractionLimits(),
+		Output:           output,
 	}
+}
 
-	return nil
+func (runner *Runner) extractionLimits() ExtractionLimits {
+	return ExtractionLimits{
+		MaxSize:    runner.config.BuildpackMaxExtractedSize(),
+		MaxEntries: runner.config.BuildpackMaxArchiveEntries(),
+	}
+}
+
+func (runner *Runner) transportOptions() TransportOptions {
+	return TransportOptions{
+		SkipSSLVerification: runner.config.SkipCertVerify(),
+		CACertsPath:         runner.config.BuildpackCACerts(),
+		ClientCertPath:      runner.config.BuildpackClientCert(),
+		ClientKeyPath:       runner.config.BuildpackClientKey(),
+		Proxy:               runner.config.BuildpackProxy(),
+		NoProxy:             runner.config.BuildpackNoProxy(),
+	}
+}
+
+// downloadCache returns nil when no persistent download cache is configured,
+// in which case every buildpack is downloaded again.
+func (runner *Runner) downloadCache() *DownloadCache {
+	cacheDir := runner.config.BuildpackDownloadCacheDir()
+	if cacheDir == "" {
+		return nil
+	}
+	return NewDownloadCache(cacheDir, runner.config.BuildpackDownloadCacheMaxSize())
 }
 
 func (runner *Runner) cleanCacheDir() error {
@@ -520,19 +785,21 @@ func (runner *Runner) runSupplyBuildpacks() (string, string, error) {
 		buildpackPath, err := runner.buildpackPath(buildpack)
 		if err != nil {
 			printError(err.Error())
-			return "", "", newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			return "", "", newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 		}
 
-		err = runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir(), runner.supplyCachePath(buildpack), runner.depsDir, runner.config.DepsIndex(i)), os.Stdout)
+		err = runner.step(EventStepSupply, buildpack, func() error {
+			return runner.runScript(buildpack, runner.config.SupplyTimeout(), os.Stdout, filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir(), runner.supplyCachePath(buildpack), runner.depsDir, runner.config.DepsIndex(i))
+		})
 		if err != nil {
-			return "", "", newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			return "", "", newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 		}
 	}
 
 	finalBuildpack := runner.config.BuildpackOrder()[len(runner.config.SupplyBuildpacks())]
 	finalPath, err := runner.buildpackPath(finalBuildpack)
 	if err != nil {
-		return "", "", newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+		return "", "", newStagingError(err, buildpackapplifecycle.SupplyPhase, finalBuildpack, buildpackapplifecycle.SupplyFailMsg)
 	}
 
 	return finalBuildpack, finalPath, nil
@@ -543,41 +810,45 @@ func (runner *Runner) validateSupplyBuildpacks() error {
 		buildpackPath, err := runner.buildpackPath(buildpack)
 		if err != nil {
 			printError(err.Error())
-			return newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			return newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 		}
 
 		if hasSupply, err := hasSupply(buildpackPath); err != nil {
-			return newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			return newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 		} else if !hasSupply {
-			return newDescriptiveError(err, buildpackapplifecycle.NoSupplyScriptFailMsg)
+			return newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.NoSupplyScriptFailMsg)
 		}
 	}
 	return nil
 }
 
-func (runner *Runner) runFinalize(buildpackPath string) error {
+func (runner *Runner) runFinalize(buildpack, buildpackPath string) error {
 	depsIdx := runner.config.DepsIndex(len(runner.config.SupplyBuildpacks()))
 	cacheDir := filepath.Join(runner.config.BuildArtifactsCacheDir(), "final")
 
 	hasFinalize, err := hasFinalize(buildpackPath)
 	if err != nil {
-		return newDescriptiveError(err, buildpackapplifecycle.FinalizeFailMsg)
+		return newStagingError(err, buildpackapplifecycle.FinalizePhase, buildpack, buildpackapplifecycle.FinalizeFailMsg)
 	}
 
 	if hasFinalize {
 		hasSupply, err := hasSupply(buildpackPath)
 		if err != nil {
-			return newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			return newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 		}
 
 		if hasSupply {
-			if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir(), cacheDir, runner.depsDir, depsIdx), os.Stdout); err != nil {
-				return newDescriptiveError(err, buildpackapplifecycle.SupplyFailMsg)
+			if err := runner.step(EventStepSupply, buildpack, func() error {
+				return runner.runScript(buildpack, runner.config.SupplyTimeout(), os.Stdout, filepath.Join(buildpackPath, "bin", "supply"), runner.config.BuildDir(), cacheDir, runner.depsDir, depsIdx)
+			}); err != nil {
+				return newStagingError(err, buildpackapplifecycle.SupplyPhase, buildpack, buildpackapplifecycle.SupplyFailMsg)
 			}
 		}
 
-		if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "finalize"), runner.config.BuildDir(), cacheDir, runner.depsDir, depsIdx, runner.profileDir), os.Stdout); err != nil {
-			return newDescriptiveError(err, buildpackapplifecycle.FinalizeFailMsg)
+		if err := runner.step(EventStepFinalize, buildpack, func() error {
+			return runner.runScript(buildpack, runner.config.FinalizeTimeout(), os.Stdout, filepath.Join(buildpackPath, "bin", "finalize"), runner.config.BuildDir(), cacheDir, runner.depsDir, depsIdx, runner.profileDir)
+		}); err != nil {
+			return newStagingError(err, buildpackapplifecycle.FinalizePhase, buildpack, buildpackapplifecycle.FinalizeFailMsg)
 		}
 	} else {
 		if len(runner.config.SupplyBuildpacks()) > 0 {
@@ -586,19 +857,26 @@ func (runner *Runner) runFinalize(buildpackPath string) error {
 
 		// remove unused deps sub dir
 		if err := os.RemoveAll(filepath.Join(runner.depsDir, depsIdx)); err != nil {
-			return newDescriptiveError(err, buildpackapplifecycle.CompileFailMsg)
+			return newStagingError(err, buildpackapplifecycle.CompilePhase, buildpack, buildpackapplifecycle.CompileFailMsg)
 		}
 
-		if err := runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "compile"), runner.config.BuildDir(), cacheDir), os.Stdout); err != nil {
-			return newDescriptiveError(err, buildpackapplifecycle.CompileFailMsg)
+		if err := runner.step(EventStepCompile, buildpack, func() error {
+			return runner.runScript(buildpack, runner.config.FinalizeTimeout(), os.Stdout, filepath.Join(buildpackPath, "bin", "compile"), runner.config.BuildDir(), cacheDir)
+		}); err != nil {
+			return newStagingError(err, buildpackapplifecycle.CompilePhase, buildpack, buildpackapplifecycle.CompileFailMsg)
 		}
 	}
 
 	return nil
 }
 
-// returns buildpack name,  buildpack path, buildpack detect output, ok
-func (runner *Runner) detect() (string, string, string, bool) {
+// returns buildpack name,  buildpack path, buildpack detect output
+func (runner *Runner) detect() (string, string, string, error) {
+	if runner.config.DetectConcurrency() > 1 && !runner.config.SkipDetect() {
+		return runner.detectConcurrently()
+	}
+
+	var stackErrs []error
 	for _, buildpack := range runner.config.BuildpackOrder() {
 
 		buildpackPath, err := runner.buildpackPath(buildpack)
@@ -608,23 +886,57 @@ func (runner *Runner) detect() (string, string, string, bool) {
 		}
 
 		if runner.config.SkipDetect() {
-			return buildpack, buildpackPath, "", true
+			return buildpack, buildpackPath, "", nil
 		}
 
-		if err := runner.warnIfDetectNotExecutable(buildpackPath); err != nil {
+		// buildpacks for other stacks are skipped without running their
+		// detect, so that a later one can still apply
+		if err := runner.checkStack(buildpack, buildpackPath, os.Stderr); err != nil {
+			stackErrs = append(stackErrs, err)
+			continue
+		}
+
+		if err := runner.warnIfDetectNotExecutable(buildpackPath, os.Stdout); err != nil {
 			printError(err.Error())
 			continue
 		}
 
 		output := new(bytes.Buffer)
-		err = runner.run(exec.Command(filepath.Join(buildpackPath, "bin", "detect"), runner.config.BuildDir()), output)
+		err = runner.step(EventStepDetect, buildpack, func() error {
+			return runner.runScript(buildpack, runner.config.DetectTimeout(), output, filepath.Join(buildpackPath, "bin", "detect"), runner.config.BuildDir())
+		})
 
 		if err == nil {
-			return buildpack, buildpackPath, strings.TrimRight(output.String(), "\r\n"), true
+			return buildpack, buildpackPath, strings.TrimRight(output.String(), "\r\n"), nil
+		}
+
+		if runner.detectShouldAbort(err) {
+			return "", "", "", newStagingError(err, buildpackapplifecycle.DetectPhase, buildpack, buildpackapplifecycle.DetectFailMsg)
 		}
 	}
 
-	return "", "", "", false
+	return "", "", "", runner.noBuildpackDetectedError(stackErrs)
+}
+
+// noBuildpackDetectedError reports the stack mismatch rather than a failed
+// detect when every buildpack was skipped for the stack, as none of them
+// could have applied.
+func (runner *Runner) noBuildpackDetectedError(stackErrs []error) error {
+	switch {
+	case len(stackErrs) == 0 || len(stackErrs) < len(runner.config.BuildpackOrder()):
+		return newStagingError(nil, buildpackapplifecycle.DetectPhase, "", buildpackapplifecycle.DetectFailMsg)
+	case len(stackErrs) == 1:
+		return stackErrs[0]
+	default:
+		return newStagingError(errors.Join(stackErrs...), buildpackapplifecycle.StackPhase, "", buildpackapplifecycle.StackFailMsg)
+	}
+}
+
+// a hung detect script fails staging rather than being mistaken for a
+// buildpack that does not apply
+func (runner *Runner) detectShouldAbort(err error) bool {
+	var timeoutErr scriptTimeoutError
+	return errors.As(err, &timeoutErr) || runner.ctx.Err() != nil
 }
 
 func (runner *Runner) readProcfile() (map[string]string, error) {
@@ -640,19 +952,39 @@ func (runner *Runner) readProcfile() (map[string]string, error) {
 		return processes, err
 	}
 
-	err = yaml.Unmarshal(procFile, &processes)
+	processes, warnings, err := ParseProcfile(procFile)
 	if err != nil {
-		// clobber yaml parsing  error
-		return processes, errors.New("invalid YAML")
+		return nil, err
+	}
+	for _, warning := range warnings {
+		printError(fmt.Sprintf("Warning: Procfile %s", warning.Error()))
 	}
 
 	return processes, nil
 }
 
-func (runner *Runner) release(buildpackDir string, startCommands map[string]string) (Release, error) {
+func (runner *Runner) emitProcfileEvent(processes map[string]string, err error) {
+	event := Event{Step: EventStepProcfile, Status: EventStatusSucceeded}
+	if err != nil {
+		event.Status = EventStatusFailed
+		event.Error = err.Error()
+	} else {
+		processTypes := make([]string, 0, len(processes))
+		for processType := range processes {
+			processTypes = append(processTypes, processType)
+		}
+		sort.Strings(processTypes)
+		event.Details = map[string]any{"process_types": processTypes}
+	}
+	runner.events.emit(event)
+}
+
+func (runner *Runner) release(buildpack, buildpackDir string, startCommands map[string]string) (Release, error) {
 	output := new(bytes.Buffer)
 
-	err := runner.run(exec.Command(filepath.Join(buildpackDir, "bin", "release"), runner.config.BuildDir()), output)
+	err := runner.step(EventStepRelease, buildpack, func() error {
+		return runner.runScript(buildpack, runner.config.ReleaseTimeout(), output, filepath.Join(buildpackDir, "bin", "release"), runner.config.BuildDir())
+	})
 	if err != nil {
 		return Release{}, err
 	}
@@ -677,6 +1009,46 @@ func (runner *Runner) release(buildpackDir string, startCommands map[string]stri
 	return parsedRelease, nil
 }
 
+// runScript runs a buildpack script in its own process group, killing the
+// whole group when the timeout (if any) expires or the runner is cancelled.
+// A timeout and environment configured for the buildpack take precedence.
+func (runner *Runner) runScript(buildpack string, timeout time.Duration, output io.Writer, script string, args ...string) error {
+	return runner.runScriptContext(runner.ctx, buildpack, timeout, output, os.Stderr, script, args...)
+}
+
+func (runner *Runner) runScriptContext(parent context.Context, buildpack string, timeout time.Duration, output, errOutput io.Writer, script string, args ...string) error {
+	timeout = runner.config.BuildpackTimeout(buildpack, timeout)
+
+	ctx := parent
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, script, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = scriptWaitDelay
+	if env := runner.config.BuildpackEnv(buildpack); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	cmd.Stdout = output
+	cmd.Stderr = errOutput
+
+	err := cmd.Run()
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+		return scriptTimeoutError{script: script, timeout: timeout}
+	}
+	if err != nil && parent.Err() != nil {
+		return fmt.Errorf("%s cancelled: %w", script, parent.Err())
+	}
+	return err
+}
+
 func (runner *Runner) run(cmd *exec.Cmd, output io.Writer) error {
 	cmd.Stdout = output
 	cmd.Stderr = os.Stderr
@@ -1,17 +1,27 @@
 package buildpackrunner_test
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/buildpackapplifecycle"
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
-	"code.cloudfoundry.org/buildpackapplifecycle/test_helpers"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/gexec"
@@ -52,7 +62,9 @@ var _ = Describe("Runner", func() {
 					Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
 
 					Expect(actualStagingResult.ProcessTypes).To(Equal(buildpackapplifecycle.ProcessTypes{"web": defaultStartCommandFromFixtures}))
-					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{{Type: "web", Command: defaultStartCommandFromFixtures}}))
+					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
+						{Type: "web", Command: defaultStartCommandFromFixtures, Source: releaseSource("bash-buildpack", nil)},
+					}))
 				})
 			})
 
@@ -117,13 +129,13 @@ processes:
 					}))
 
 					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
-						{Type: "web", Command: "do something else forever"},
-						{Type: "worker", Command: "do something and then quit"},
+						{Type: "web", Command: "do something else forever", Source: launchYMLSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil))},
+						{Type: "worker", Command: "do something and then quit", Source: launchYMLSource("haskell-buildpack", nil)},
 					}))
 
 					Expect(actualStagingResult.Sidecars).To(Equal([]buildpackapplifecycle.Sidecar{
-						{Name: "newrelic", ProcessTypes: []string{"web", "worker"}, Command: "run new relic"},
-						{Name: "oldrelic", ProcessTypes: []string{"web"}, Command: "run new relic", Memory: 10},
+						{Name: "newrelic", ProcessTypes: []string{"web", "worker"}, Command: "run new relic", Source: launchYMLSource("haskell-buildpack", nil)},
+						{Name: "oldrelic", ProcessTypes: []string{"web"}, Command: "run new relic", Memory: 10, Source: launchYMLSource("bash-buildpack", nil)},
 					}))
 
 				})
@@ -158,7 +170,9 @@ processes:
 					Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
 
 					Expect(actualStagingResult.ProcessTypes).To(Equal(buildpackapplifecycle.ProcessTypes{"web": "gunicorn server:app"}))
-					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{{Type: "web", Command: "gunicorn server:app"}}))
+					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
+						{Type: "web", Command: "gunicorn server:app", Source: procfileSource(releaseSource("bash-buildpack", nil))},
+					}))
 				})
 			})
 
@@ -208,13 +222,13 @@ processes:
 					}))
 
 					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
-						{Type: "web", Command: defaultStartCommandFromFixtures},
-						{Type: "worker", Command: "do something and then quit"},
-						{Type: "lightning", Command: "go forth"},
+						{Type: "web", Command: defaultStartCommandFromFixtures, Source: releaseSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil))},
+						{Type: "lightning", Command: "go forth", Source: launchYMLSource("haskell-buildpack", nil)},
+						{Type: "worker", Command: "do something and then quit", Source: launchYMLSource("haskell-buildpack", nil)},
 					}))
 
 					Expect(actualStagingResult.Sidecars).To(Equal([]buildpackapplifecycle.Sidecar{
-						{Name: "newrelic", ProcessTypes: []string{"web"}, Command: "run new relic"},
+						{Name: "newrelic", ProcessTypes: []string{"web"}, Command: "run new relic", Source: launchYMLSource("haskell-buildpack", nil)},
 					}))
 				})
 			})
@@ -285,17 +299,175 @@ processes:
 					}))
 
 					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
-						{Type: "web", Command: "gunicorn server:app"},
-						{Type: "worker", Command: "do something else forever"},
-						{Type: "lightning", Command: "go forth"},
+						{Type: "web", Command: "gunicorn server:app", Source: procfileSource(launchYMLSource("haskell-buildpack", nil))},
+						{Type: "lightning", Command: "go forth", Source: launchYMLSource("haskell-buildpack", nil)},
+						{Type: "worker", Command: "do something else forever", Source: launchYMLSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil))},
 					}))
 
 					Expect(actualStagingResult.Sidecars).To(Equal([]buildpackapplifecycle.Sidecar{
-						{Name: "newrelic", ProcessTypes: []string{"web"}, Command: "run new relic"},
-						{Name: "oldrelic", ProcessTypes: []string{"worker"}, Command: "run new relic", Memory: 10},
+						{Name: "newrelic", ProcessTypes: []string{"web"}, Command: "run new relic", Source: launchYMLSource("haskell-buildpack", nil)},
+						{Name: "oldrelic", ProcessTypes: []string{"worker"}, Command: "run new relic", Memory: 10, Source: launchYMLSource("bash-buildpack", nil)},
+					}))
+				})
+			})
+
+			When("a launch.yml declares defaults for its processes", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(filepath.Join(builderConfig.BuildDir(), "Procfile"), []byte("web: serve --fast\n"), os.ModePerm)).To(Succeed())
+
+					for index, launchContents := range []string{`
+processes:
+- type: "web"
+  command: "serve"
+  instances: 2
+  readiness_command: "curl -f localhost:8080/ready"
+  health_check:
+    type: "http"
+    endpoint: "/health"
+    timeout: 30
+  limits:
+    disk: 512
+- type: "worker"
+  command: "work"
+  health_check:
+    type: "process"
+`, `
+processes:
+- type: "worker"
+  command: "work harder"
+  instances: 3
+`} {
+						depsIdxPath := filepath.Join(runner.GetDepsDir(), strconv.Itoa(index))
+						Expect(os.MkdirAll(depsIdxPath, os.ModePerm)).To(Succeed())
+						Expect(os.WriteFile(filepath.Join(depsIdxPath, "launch.yml"), []byte(launchContents), os.ModePerm)).To(Succeed())
+					}
+				})
+
+				It("writes them to the result, keeping those that the processes replacing them leave out", func() {
+					resultsJSON, _, err := runner.GoLikeLightning()
+					Expect(err).NotTo(HaveOccurred())
+
+					resultsJSONContents, err := os.ReadFile(resultsJSON)
+					Expect(err).ToNot(HaveOccurred())
+
+					actualStagingResult := buildpackapplifecycle.StagingResult{}
+					Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
+						{
+							Type:             "web",
+							Command:          "serve --fast",
+							HealthCheck:      &buildpackapplifecycle.HealthCheck{Type: "http", Endpoint: "/health", Timeout: 30},
+							Instances:        2,
+							DiskQuota:        512,
+							ReadinessCommand: "curl -f localhost:8080/ready",
+							Source:           procfileSource(launchYMLSource("haskell-buildpack", nil)),
+						},
+						{
+							Type:        "worker",
+							Command:     "work harder",
+							HealthCheck: &buildpackapplifecycle.HealthCheck{Type: "process"},
+							Instances:   3,
+							Source:      launchYMLSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil)),
+						},
 					}))
 				})
 			})
+
+			When("a launch.yml declares environment variables for its processes and sidecars", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(filepath.Join(builderConfig.BuildDir(), "Procfile"), []byte("web: serve --fast\n"), os.ModePerm)).To(Succeed())
+
+					depsIdxPath := filepath.Join(runner.GetDepsDir(), "0")
+					Expect(os.MkdirAll(depsIdxPath, os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(depsIdxPath, "launch.yml"), []byte(`
+processes:
+- type: "web"
+  command: "serve"
+  env:
+    JAVA_OPTS: "-Xmx1g"
+- type: "worker"
+  command: "work"
+  env:
+    JAVA_OPTS: "-Xmx4g"
+    THREADS: 8
+- type: "agent"
+  command: "watch"
+  env:
+    AGENT_MODE: "quiet"
+  platforms:
+    cloudfoundry:
+      sidecar_for: [ "web", "worker" ]
+`), os.ModePerm)).To(Succeed())
+				})
+
+				It("records them in the result and in staging_info.yml", func() {
+					resultsJSON, stagingInfo, err := runner.GoLikeLightning()
+					Expect(err).NotTo(HaveOccurred())
+
+					resultsJSONContents, err := os.ReadFile(resultsJSON)
+					Expect(err).ToNot(HaveOccurred())
+
+					actualStagingResult := buildpackapplifecycle.StagingResult{}
+					Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+					Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
+						{Type: "web", Command: "serve --fast", Env: map[string]string{"JAVA_OPTS": "-Xmx1g"}, Source: procfileSource(releaseSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil)))},
+						{Type: "worker", Command: "work", Env: map[string]string{"JAVA_OPTS": "-Xmx4g", "THREADS": "8"}, Source: launchYMLSource("haskell-buildpack", nil)},
+					}))
+					Expect(actualStagingResult.Sidecars).To(Equal([]buildpackapplifecycle.Sidecar{
+						{Name: "agent", ProcessTypes: []string{"web", "worker"}, Command: "watch", Env: map[string]string{"AGENT_MODE": "quiet"}, Source: launchYMLSource("haskell-buildpack", nil)},
+					}))
+
+					stagingInfoContents, err := os.ReadFile(stagingInfo)
+					Expect(err).ToNot(HaveOccurred())
+
+					actualStagingInfo := buildpackrunner.DeaStagingInfo{}
+					Expect(json.Unmarshal(stagingInfoContents, &actualStagingInfo)).To(Succeed())
+					Expect(actualStagingInfo.GetEnv("worker", "work")).To(Equal(map[string]string{"JAVA_OPTS": "-Xmx4g", "THREADS": "8"}))
+					Expect(actualStagingInfo.GetEnv("web", "serve --fast")).To(Equal(map[string]string{"JAVA_OPTS": "-Xmx1g"}))
+					Expect(actualStagingInfo.GetEnv("web", "watch")).To(Equal(map[string]string{"AGENT_MODE": "quiet"}))
+				})
+			})
+
+			When("the processes come from a launch.yml, the release and a Procfile", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(filepath.Join(builderConfig.BuildDir(), "Procfile"), []byte("worker: work\nclock: tick\nweb: serve\n"), os.ModePerm)).To(Succeed())
+
+					depsIdxPath := filepath.Join(runner.GetDepsDir(), "0")
+					Expect(os.MkdirAll(depsIdxPath, os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(filepath.Join(depsIdxPath, "launch.yml"), []byte(`
+processes:
+- type: "zebra"
+  command: "stripes"
+- type: "web"
+  command: "do something forever"
+- type: "alpha"
+  command: "begin"
+`), os.ModePerm)).To(Succeed())
+				})
+
+				It("lists them web first, then by where they were defined, then by type, and records what each replaced", func() {
+					for i := 0; i < 3; i++ {
+						resultsJSON, _, err := runner.GoLikeLightning()
+						Expect(err).NotTo(HaveOccurred())
+
+						resultsJSONContents, err := os.ReadFile(resultsJSON)
+						Expect(err).ToNot(HaveOccurred())
+
+						actualStagingResult := buildpackapplifecycle.StagingResult{}
+						Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+						Expect(actualStagingResult.ProcessList).To(Equal([]buildpackapplifecycle.Process{
+							{Type: "web", Command: "serve", Source: procfileSource(releaseSource("bash-buildpack", launchYMLSource("haskell-buildpack", nil)))},
+							{Type: "alpha", Command: "begin", Source: launchYMLSource("haskell-buildpack", nil)},
+							{Type: "zebra", Command: "stripes", Source: launchYMLSource("haskell-buildpack", nil)},
+							{Type: "clock", Command: "tick", Source: procfileSource(nil)},
+							{Type: "worker", Command: "work", Source: procfileSource(nil)},
+						}))
+					}
+				})
+			})
 		})
 	})
 
@@ -314,7 +486,7 @@ processes:
 			It("should write result.json with buildpack metadata on failure", func() {
 				_, _, err := runner.GoLikeLightning()
 				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(ContainSubstring("Failed to compile droplet"))
+				Expect(err.Error()).To(ContainSubstring(buildpackapplifecycle.FinalizeFailMsg))
 
 				resultsJSONPath := builderConfig.OutputMetadata()
 				Expect(resultsJSONPath).To(BeAnExistingFile())
@@ -331,6 +503,89 @@ processes:
 				Expect(actualStagingResult.LifecycleMetadata.Buildpacks[0].Name).To(Equal("failing-buildpack"))
 				Expect(actualStagingResult.LifecycleMetadata.Buildpacks[0].Version).To(Equal("1.2.3"))
 			})
+
+			It("should write a machine-readable failure to result.json", func() {
+				_, _, err := runner.GoLikeLightning()
+				Expect(err).To(HaveOccurred())
+
+				var stagingErr buildpackapplifecycle.StagingError
+				Expect(errors.As(err, &stagingErr)).To(BeTrue())
+				Expect(stagingErr.Phase()).To(Equal(buildpackapplifecycle.FinalizePhase))
+				Expect(stagingErr.BuildpackKey()).To(Equal("failing-buildpack"))
+				Expect(buildpackapplifecycle.ExitCodeFromError(err)).To(Equal(buildpackapplifecycle.COMPILE_FAIL_CODE))
+
+				resultsJSONContents, err := os.ReadFile(builderConfig.OutputMetadata())
+				Expect(err).ToNot(HaveOccurred())
+
+				actualStagingResult := buildpackapplifecycle.StagingResult{}
+				Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+				Expect(actualStagingResult.Failure).NotTo(BeNil())
+				Expect(actualStagingResult.Failure.Phase).To(Equal(buildpackapplifecycle.FinalizePhase))
+				Expect(actualStagingResult.Failure.BuildpackKey).To(Equal("failing-buildpack"))
+				Expect(actualStagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.COMPILE_FAIL_CODE))
+				Expect(actualStagingResult.Failure.Message).To(ContainSubstring(buildpackapplifecycle.FinalizeFailMsg))
+			})
+		})
+
+		When("the droplet cannot be packaged", func() {
+			BeforeEach(func() {
+				buildpacks := []string{"haskell-buildpack"}
+				builderConfig = makeBuilderConfig(buildpacks, fakeBuildpackDir())
+				Expect(builderConfig.Set("outputDroplet", GinkgoT().TempDir())).To(Succeed())
+				runner = buildpackrunner.New(&builderConfig)
+				Expect(runner.Setup()).To(Succeed())
+			})
+
+			It("should write the failure to result.json", func() {
+				_, _, err := runner.GoLikeLightning()
+				Expect(err).To(HaveOccurred())
+
+				resultsJSONContents, err := os.ReadFile(builderConfig.OutputMetadata())
+				Expect(err).ToNot(HaveOccurred())
+
+				actualStagingResult := buildpackapplifecycle.StagingResult{}
+				Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+				Expect(actualStagingResult.Failure).NotTo(BeNil())
+				Expect(actualStagingResult.Failure.ExitCode).To(Equal(1))
+				Expect(actualStagingResult.LifecycleMetadata.Buildpacks).To(HaveLen(1))
+				Expect(actualStagingResult.LifecycleMetadata.Buildpacks[0].Key).To(Equal("haskell-buildpack"))
+			})
+		})
+
+		When("the supply script of the final buildpack fails", func() {
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("the failing supply script is a shell script")
+				}
+
+				buildpacks := []string{"failing-buildpack"}
+				builderConfig = makeBuilderConfig(buildpacks, fakeFailingBuildpackDir())
+				supply := filepath.Join(builderConfig.BuildpackPath("failing-buildpack"), "bin", "supply")
+				Expect(os.WriteFile(supply, []byte("#!/usr/bin/env bash\nexit 1\n"), 0755)).To(Succeed())
+
+				runner = buildpackrunner.New(&builderConfig)
+				Expect(runner.Setup()).To(Succeed())
+			})
+
+			It("reports the supply phase in result.json", func() {
+				_, _, err := runner.GoLikeLightning()
+				Expect(err).To(HaveOccurred())
+				Expect(buildpackapplifecycle.ExitCodeFromError(err)).To(Equal(buildpackapplifecycle.COMPILE_FAIL_CODE))
+
+				resultsJSONContents, err := os.ReadFile(builderConfig.OutputMetadata())
+				Expect(err).ToNot(HaveOccurred())
+
+				actualStagingResult := buildpackapplifecycle.StagingResult{}
+				Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+
+				Expect(actualStagingResult.Failure).NotTo(BeNil())
+				Expect(actualStagingResult.Failure.Phase).To(Equal(buildpackapplifecycle.SupplyPhase))
+				Expect(actualStagingResult.Failure.BuildpackKey).To(Equal("failing-buildpack"))
+				Expect(actualStagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.COMPILE_FAIL_CODE))
+				Expect(actualStagingResult.Failure.Message).To(ContainSubstring(buildpackapplifecycle.SupplyFailMsg))
+			})
 		})
 
 		When("staging fails with multiple buildpacks", func() {
@@ -367,14 +622,488 @@ processes:
 			})
 		})
 	})
+
+	Describe("launch.yml validation", func() {
+		var runner *buildpackrunner.Runner
+		var builderConfig buildpackapplifecycle.LifecycleBuilderConfig
+		var launchPath string
+
+		writeLaunchYML := func(contents string) {
+			Expect(os.WriteFile(launchPath, []byte(contents), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			builderConfig = makeBuilderConfig([]string{"haskell-buildpack", "bash-buildpack"}, fakeBuildpackDir())
+			runner = buildpackrunner.New(&builderConfig)
+			Expect(runner.Setup()).To(Succeed())
+
+			launchPath = filepath.Join(runner.GetDepsDir(), "0", "launch.yml")
+			Expect(os.MkdirAll(filepath.Dir(launchPath), 0755)).To(Succeed())
+		})
+
+		DescribeTable("rejects invalid launch.yml files with the line at fault",
+			func(contents, message string) {
+				writeLaunchYML(contents)
+
+				_, _, err := runner.GoLikeLightning()
+				Expect(err).To(MatchError(ContainSubstring(buildpackapplifecycle.LaunchYMLFailMsg)))
+				Expect(err).To(MatchError(ContainSubstring(launchPath + message)))
+			},
+			Entry("unknown keys", "processes:\n- type: web\n  command: serve\n  sidecar-for: [web]\n", `:4 (buildpack 0): field sidecar-for not found`),
+			Entry("values of the wrong type", "processes:\n- type: web\n  command: serve\n  limits:\n    memory: lots\n", `:5 (buildpack 0): cannot unmarshal`),
+			Entry("invalid YAML", "processes:\n- type: web\n command: serve\n", `:2 (buildpack 0): did not find expected key`),
+			Entry("duplicate process types", "processes:\n- type: web\n  command: serve\n- type: web\n  command: serve again\n", `:4 (buildpack 0): process type "web" is already declared on line 2`),
+			Entry("empty process types", "processes:\n- command: serve\n", `:2 (buildpack 0): process type must not be empty`),
+			Entry("empty commands", "processes:\n- type: web\n  command: ' '\n", `:3 (buildpack 0): command of process type "web" must not be empty`),
+			Entry("negative memory", "processes:\n- type: web\n  command: serve\n- type: agent\n  command: watch\n  limits:\n    memory: -1\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n", `:7 (buildpack 0): memory limit of process type "agent" must be between 0 and 1048576 MB, not -1`),
+			Entry("unknown health check types", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: tcp\n", `:5 (buildpack 0): health check type of process type "web" must be one of port, process, http, not "tcp"`),
+			Entry("endpoints for health checks other than http", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: port\n    endpoint: /health\n", `:6 (buildpack 0): health check endpoint of process type "web" is only for http health checks`),
+			Entry("health check endpoints that are not paths", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: http\n    endpoint: health\n", `:6 (buildpack 0): health check endpoint of process type "web" must start with /, not "health"`),
+			Entry("negative health check timeouts", "processes:\n- type: web\n  command: serve\n  health_check:\n    type: port\n    timeout: -5\n", `:6 (buildpack 0): health check timeout of process type "web" must not be negative, not -5`),
+			Entry("negative instances", "processes:\n- type: web\n  command: serve\n  instances: -1\n", `:4 (buildpack 0): instances of process type "web" must not be negative, not -1`),
+			Entry("disk quotas out of range", "processes:\n- type: web\n  command: serve\n  limits:\n    disk: 2000000\n", `:5 (buildpack 0): disk quota of process type "web" must be between 0 and 1048576 MB, not 2000000`),
+			Entry("empty readiness commands", "processes:\n- type: web\n  command: serve\n  readiness_command: ''\n", `:4 (buildpack 0): readiness command of process type "web" must not be empty`),
+			Entry("defaults for sidecars", "processes:\n- type: web\n  command: serve\n- type: agent\n  command: watch\n  instances: 2\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n", `:6 (buildpack 0): sidecar "agent" cannot declare instances`),
+			Entry("invalid environment variable names", "processes:\n- type: web\n  command: serve\n  env:\n    JAVA_OPTS: -Xmx1g\n    JAVA-HOME: /opt/java\n", `:6 (buildpack 0): environment variable "JAVA-HOME" of process type "web" is not a valid name`),
+			Entry("sidecars with env sharing the command of their process", "processes:\n- type: worker\n  command: work\n- type: agent\n  command: work\n  env:\n    MODE: agent\n  platforms:\n    cloudfoundry:\n      sidecar_for: [worker]\n", `:4 (buildpack 0): sidecar "agent" declares env but has the same command as process type "worker"`),
+			Entry("sidecars for missing process types", "processes:\n- type: web\n  command: serve\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web, wrker]\n", `:4 (buildpack 0): sidecar "agent" is for process type "wrker", which does not exist`),
+		)
+
+		It("accepts sidecars for web when no web process is staged, as its command can be given at runtime", func() {
+			launchPath = filepath.Join(runner.GetDepsDir(), "1", "launch.yml")
+			Expect(os.MkdirAll(filepath.Dir(launchPath), 0755)).To(Succeed())
+			writeLaunchYML("processes:\n- type: agent\n  command: watch\n  platforms:\n    cloudfoundry:\n      sidecar_for: [web]\n")
+
+			_, _, err := runner.GoLikeLightning()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("reports every problem in the file", func() {
+			writeLaunchYML("processes:\n- type: web\n  command: ''\n- type: web\n  command: serve\n")
+
+			_, _, err := runner.GoLikeLightning()
+			Expect(err).To(MatchError(ContainSubstring(`:3 (buildpack 0): command of process type "web" must not be empty`)))
+			Expect(err).To(MatchError(ContainSubstring(`:4 (buildpack 0): process type "web" is already declared on line 2`)))
+		})
+
+		It("fails with its own exit code, attributed to the buildpack that wrote the file", func() {
+			writeLaunchYML("processes:\n- type: web\n  command: ''\n")
+
+			_, _, err := runner.GoLikeLightning()
+			Expect(buildpackapplifecycle.ExitCodeFromError(err)).To(Equal(buildpackapplifecycle.LAUNCH_YML_FAIL_CODE))
+
+			resultsJSONContents, err := os.ReadFile(builderConfig.OutputMetadata())
+			Expect(err).ToNot(HaveOccurred())
+
+			actualStagingResult := buildpackapplifecycle.StagingResult{}
+			Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+			Expect(actualStagingResult.Failure.Phase).To(Equal(buildpackapplifecycle.ReleasePhase))
+			Expect(actualStagingResult.Failure.BuildpackKey).To(Equal("haskell-buildpack"))
+			Expect(actualStagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.LAUNCH_YML_FAIL_CODE))
+		})
+	})
+
+	Describe("buildpack script timeouts", func() {
+		var runner *buildpackrunner.Runner
+		var builderConfig buildpackapplifecycle.LifecycleBuilderConfig
+
+		BeforeEach(func() {
+			builderConfig = makeBuilderConfig([]string{"hanging-buildpack"}, fakeHangingBuildpackDir())
+		})
+
+		When("a script exceeds its phase timeout", func() {
+			BeforeEach(func() {
+				Expect(builderConfig.Set("finalizeTimeout", "500ms")).To(Succeed())
+				runner = buildpackrunner.New(&builderConfig)
+				Expect(runner.Setup()).To(Succeed())
+			})
+
+			It("kills the script and reports a timeout", func() {
+				start := time.Now()
+				_, _, err := runner.GoLikeLightning()
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(buildpackapplifecycle.TimeoutFailMsg))
+				Expect(buildpackapplifecycle.ExitCodeFromError(err)).To(Equal(buildpackapplifecycle.TIMEOUT_FAIL_CODE))
+
+				resultsJSONContents, err := os.ReadFile(builderConfig.OutputMetadata())
+				Expect(err).ToNot(HaveOccurred())
+
+				actualStagingResult := buildpackapplifecycle.StagingResult{}
+				Expect(json.Unmarshal(resultsJSONContents, &actualStagingResult)).To(Succeed())
+				Expect(actualStagingResult.Failure.ExitCode).To(Equal(buildpackapplifecycle.TIMEOUT_FAIL_CODE))
+			})
+		})
+
+		When("the runner's context is cancelled", func() {
+			It("kills the running script", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				runner = buildpackrunner.NewWithContext(ctx, &builderConfig)
+				Expect(runner.Setup()).To(Succeed())
+
+				time.AfterFunc(500*time.Millisecond, cancel)
+				start := time.Now()
+				_, _, err := runner.GoLikeLightning()
+				Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+				Expect(err).To(MatchError(ContainSubstring("cancelled")))
+				Expect(buildpackapplifecycle.ExitCodeFromError(err)).To(Equal(buildpackapplifecycle.COMPILE_FAIL_CODE))
+			})
+		})
+	})
+
+	Describe("staging events", func() {
+		var runner *buildpackrunner.Runner
+		var builderConfig buildpackapplifecycle.LifecycleBuilderConfig
+		var eventsPath string
+
+		readEvents := func() []buildpackrunner.Event {
+			contents, err := os.ReadFile(eventsPath)
+			Expect(err).NotTo(HaveOccurred())
+
+			events := []buildpackrunner.Event{}
+			for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+				var event buildpackrunner.Event
+				Expect(json.Unmarshal([]byte(line), &event)).To(Succeed())
+				events = append(events, event)
+			}
+			return events
+		}
+
+		stepsOf := func(events []buildpackrunner.Event) []string {
+			steps := []string{}
+			for _, event := range events {
+				steps = append(steps, fmt.Sprintf("%s %s %s", event.Step, event.Status, event.Buildpack))
+			}
+			return steps
+		}
+
+		setupRunner := func(buildpacks []string, testdataDir string) {
+			builderConfig = makeBuilderConfig(buildpacks, testdataDir)
+			eventsDir, err := os.MkdirTemp(os.TempDir(), "events")
+			Expect(err).NotTo(HaveOccurred())
+			eventsPath = filepath.Join(eventsDir, "events.jsonl")
+			Expect(builderConfig.Set("outputEvents", eventsPath)).To(Succeed())
+
+			runner = buildpackrunner.New(&builderConfig)
+			Expect(runner.Setup()).To(Succeed())
+		}
+
+		AfterEach(func() {
+			Expect(runner.CleanUp()).To(Succeed())
+		})
+
+		It("writes one JSON event per lifecycle step", func() {
+			setupRunner([]string{"haskell-buildpack", "bash-buildpack"}, fakeBuildpackDir())
+
+			_, _, err := runner.GoLikeLightning()
+			Expect(err).NotTo(HaveOccurred())
+
+			events := readEvents()
+			Expect(stepsOf(events)).To(Equal([]string{
+				"supply started haskell-buildpack",
+				"supply succeeded haskell-buildpack",
+				"supply started bash-buildpack",
+				"supply succeeded bash-buildpack",
+				"finalize started bash-buildpack",
+				"finalize succeeded bash-buildpack",
+				"release started bash-buildpack",
+				"release succeeded bash-buildpack",
+				"procfile succeeded ",
+				"package_droplet started ",
+				"package_droplet succeeded ",
+				"package_build_artifacts_cache started ",
+				"package_build_artifacts_cache succeeded ",
+			}))
+
+			for _, event := range events {
+				Expect(event.Timestamp).NotTo(BeZero())
+				if event.Status == buildpackrunner.EventStatusSucceeded && event.Step != buildpackrunner.EventStepProcfile {
+					Expect(event.Duration).NotTo(BeNil())
+				}
+			}
+			Expect(*events[1].ExitCode).To(Equal(0))
+			Expect(events[8].Details).To(HaveKeyWithValue("process_types", BeEmpty()))
+		})
+
+		It("reports the exit code of a failing buildpack script", func() {
+			setupRunner([]string{"failing-buildpack"}, fakeFailingBuildpackDir())
+
+			_, _, err := runner.GoLikeLightning()
+			Expect(err).To(HaveOccurred())
+
+			events := readEvents()
+			last := events[len(events)-1]
+			Expect(last.Step).To(Equal(buildpackrunner.EventStepFinalize))
+			Expect(last.Status).To(Equal(buildpackrunner.EventStatusFailed))
+			Expect(last.ExitCode).NotTo(BeNil())
+			Expect(*last.ExitCode).To(Equal(1))
+			Expect(last.Error).NotTo(BeEmpty())
+		})
+	})
+
+	Describe("Plan", func() {
+		It("plans detect for every buildpack and the build of whichever detects first", func() {
+			builderConfig := makeBuilderConfig([]string{"haskell-buildpack", "bash-buildpack"}, fakeBuildpackDir())
+			Expect(builderConfig.Set("skipDetect", "false")).To(Succeed())
+
+			plan := buildpackrunner.New(&builderConfig).Plan()
+			Expect(plan.Errors).To(BeEmpty())
+			Expect(plan.Buildpacks).To(HaveLen(2))
+			Expect(plan.Buildpacks[0].Path).To(Equal(builderConfig.BuildpackPath("haskell-buildpack")))
+			Expect(plan.Buildpacks[0].HasSupply).To(BeTrue())
+			Expect(plan.Buildpacks[0].HasFinalize).To(BeTrue())
+
+			steps := []string{}
+			for _, step := range plan.Steps {
+				steps = append(steps, step.Step+" "+step.Buildpack)
+			}
+			Expect(steps).To(Equal([]string{
+				"detect haskell-buildpack",
+				"detect bash-buildpack",
+				"supply haskell-buildpack",
+				"finalize haskell-buildpack",
+				"release haskell-buildpack",
+				"supply bash-buildpack",
+				"finalize bash-buildpack",
+				"release bash-buildpack",
+			}))
+			Expect(plan.Steps[2].Condition).To(ContainSubstring("haskell-buildpack is the first buildpack to detect"))
+			Expect(plan.Steps[2].DepsIndex).To(Equal("0"))
+		})
+
+		It("reports buildpacks that cannot be found", func() {
+			builderConfig := makeBuilderConfig([]string{"bash-buildpack"}, fakeBuildpackDir())
+			Expect(builderConfig.Set("buildpackOrder", "missing-buildpack,bash-buildpack")).To(Succeed())
+
+			plan := buildpackrunner.New(&builderConfig).Plan()
+			Expect(plan.Errors).To(ConsistOf(HavePrefix("missing-buildpack: ")))
+		})
+
+		It("warns about buildpacks that are not downloaded yet without failing", func() {
+			buildpackURL := "https://example.com/buildpacks/remote-buildpack.zip"
+			builderConfig := makeBuilderConfig([]string{"bash-buildpack"}, fakeBuildpackDir())
+			Expect(builderConfig.Set("buildpackOrder", buildpackURL+",bash-buildpack")).To(Succeed())
+			Expect(builderConfig.Set("skipDetect", "false")).To(Succeed())
+
+			plan := buildpackrunner.New(&builderConfig).Plan()
+			Expect(plan.Errors).To(BeEmpty())
+			Expect(plan.Warnings).To(ConsistOf(HavePrefix(buildpackURL + ": not downloaded yet")))
+			Expect(plan.Buildpacks[0].Download).To(BeTrue())
+			Expect(plan.Buildpacks[0].Unchecked).To(BeTrue())
+			Expect(plan.Buildpacks[0].Error).To(BeEmpty())
+		})
+	})
+
+	Describe("packaging the droplet", func() {
+		var compression string
+
+		BeforeEach(func() {
+			compression = buildpackapplifecycle.CompressionGzip
+		})
+
+		stage := func(prepareApp func(buildDir string)) buildpackapplifecycle.LifecycleBuilderConfig {
+			builderConfig := makeBuilderConfig([]string{"haskell-buildpack", "bash-buildpack"}, fakeBuildpackDir())
+			Expect(builderConfig.Set("compression", compression)).To(Succeed())
+			prepareApp(builderConfig.BuildDir())
+
+			runner := buildpackrunner.New(&builderConfig)
+			Expect(runner.Setup()).To(Succeed())
+			_, _, err := runner.GoLikeLightning()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runner.CleanUp()).To(Succeed())
+
+			return builderConfig
+		}
+
+		readHeaders := func(archive string) []*tar.Header {
+			file, err := os.Open(archive)
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+
+			var reader io.Reader = file
+			switch compression {
+			case buildpackapplifecycle.CompressionGzip:
+				reader, err = gzip.NewReader(file)
+				Expect(err).NotTo(HaveOccurred())
+			case buildpackapplifecycle.CompressionZstd:
+				zstdReader, err := zstd.NewReader(file)
+				Expect(err).NotTo(HaveOccurred())
+				defer zstdReader.Close()
+				reader = zstdReader
+			}
+
+			headers := []*tar.Header{}
+			tarReader := tar.NewReader(reader)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				headers = append(headers, header)
+			}
+			return headers
+		}
+
+		writeApp := func(buildDir string) {
+			Expect(os.WriteFile(filepath.Join(buildDir, "app.sh"), []byte("echo hello"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(buildDir, "lib"), 0755)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(buildDir, "lib", "data"), []byte("data"), 0644)).To(Succeed())
+		}
+
+		It("writes entries in order with normalized timestamps and ownership", func() {
+			builderConfig := stage(writeApp)
+
+			names := []string{}
+			for _, header := range readHeaders(builderConfig.OutputDroplet()) {
+				names = append(names, header.Name)
+				Expect(header.ModTime.UTC()).To(Equal(time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)))
+				Expect(header.Uid).To(BeZero())
+				Expect(header.Gid).To(BeZero())
+				Expect(header.Uname).To(BeEmpty())
+				Expect(header.Gname).To(BeEmpty())
+			}
+
+			Expect(names).To(ContainElements("./", "./app/", "./app/app.sh", "./app/lib/", "./app/lib/data", "./logs/", "./tmp/"))
+			Expect(sort.StringsAreSorted(names)).To(BeTrue())
+		})
+
+		It("produces identical droplets for identical app contents", func() {
+			first := stage(writeApp)
+			second := stage(func(buildDir string) {
+				writeApp(buildDir)
+				later := time.Now().Add(time.Hour)
+				Expect(os.Chtimes(filepath.Join(buildDir, "app.sh"), later, later)).To(Succeed())
+			})
+
+			firstDroplet, err := os.ReadFile(first.OutputDroplet())
+			Expect(err).NotTo(HaveOccurred())
+			secondDroplet, err := os.ReadFile(second.OutputDroplet())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(secondDroplet).To(Equal(firstDroplet))
+		})
+
+		DescribeTable("compressing with the requested codec",
+			func(codec string) {
+				compression = codec
+				builderConfig := stage(writeApp)
+
+				names := []string{}
+				for _, header := range readHeaders(builderConfig.OutputDroplet()) {
+					names = append(names, header.Name)
+				}
+				Expect(names).To(ContainElement("./app/app.sh"))
+
+				resultContents, err := os.ReadFile(builderConfig.OutputMetadata())
+				Expect(err).NotTo(HaveOccurred())
+				var result buildpackapplifecycle.StagingResult
+				Expect(json.Unmarshal(resultContents, &result)).To(Succeed())
+				Expect(result.LifecycleMetadata.Compression).To(Equal(codec))
+			},
+			Entry("gzip", buildpackapplifecycle.CompressionGzip),
+			Entry("zstd", buildpackapplifecycle.CompressionZstd),
+			Entry("none", buildpackapplifecycle.CompressionNone),
+		)
+
+		It("writes a manifest of every file in the droplet", func() {
+			builderConfig := stage(writeApp)
+
+			contents, err := os.ReadFile(builderConfig.OutputDropletManifest())
+			Expect(err).NotTo(HaveOccurred())
+			var manifest buildpackapplifecycle.DropletManifest
+			Expect(json.Unmarshal(contents, &manifest)).To(Succeed())
+
+			files := map[string]buildpackapplifecycle.DropletManifestFile{}
+			for _, file := range manifest.Files {
+				files[file.Path] = file
+			}
+			Expect(files).To(HaveKey("app/lib/data"))
+			Expect(files).To(HaveKey("staging_info.yml"))
+			Expect(files).NotTo(HaveKey("app/lib"))
+
+			dataSum := sha256.Sum256([]byte("data"))
+			Expect(files["app/lib/data"].SHA256).To(Equal(hex.EncodeToString(dataSum[:])))
+			Expect(files["app/lib/data"].Size).To(Equal(int64(4)))
+			if runtime.GOOS != "windows" {
+				Expect(files["app/lib/data"].Mode).To(Equal("0644"))
+				Expect(files["app/app.sh"].Mode).To(Equal("0755"))
+			}
+
+			Expect(manifest.Digest).To(HavePrefix("sha256:"))
+			expected := manifest
+			Expect(expected.ComputeDigest()).To(Succeed())
+			Expect(manifest.Digest).To(Equal(expected.Digest))
+		})
+
+		It("gives identical droplets the same manifest digest", func() {
+			readDigest := func(builderConfig buildpackapplifecycle.LifecycleBuilderConfig) string {
+				contents, err := os.ReadFile(builderConfig.OutputDropletManifest())
+				Expect(err).NotTo(HaveOccurred())
+				var manifest buildpackapplifecycle.DropletManifest
+				Expect(json.Unmarshal(contents, &manifest)).To(Succeed())
+				return manifest.Digest
+			}
+
+			first := stage(writeApp)
+			second := stage(writeApp)
+			third := stage(func(buildDir string) {
+				writeApp(buildDir)
+				Expect(os.WriteFile(filepath.Join(buildDir, "unexpected"), []byte("surprise"), 0644)).To(Succeed())
+			})
+
+			Expect(readDigest(second)).To(Equal(readDigest(first)))
+			Expect(readDigest(third)).NotTo(Equal(readDigest(first)))
+		})
+
+		It("archives symlinks and hardlinks as links", func() {
+			if runtime.GOOS == "windows" {
+				Skip("links are not archived as links on Windows")
+			}
+
+			builderConfig := stage(func(buildDir string) {
+				writeApp(buildDir)
+				Expect(os.Symlink("lib/data", filepath.Join(buildDir, "symlink"))).To(Succeed())
+				Expect(os.Link(filepath.Join(buildDir, "lib", "data"), filepath.Join(buildDir, "zz-hardlink"))).To(Succeed())
+			})
+
+			headers := map[string]*tar.Header{}
+			for _, header := range readHeaders(builderConfig.OutputDroplet()) {
+				headers[header.Name] = header
+			}
+
+			Expect(headers).To(HaveKey("./app/symlink"))
+			Expect(headers["./app/symlink"].Typeflag).To(Equal(byte(tar.TypeSymlink)))
+			Expect(headers["./app/symlink"].Linkname).To(Equal("lib/data"))
+
+			Expect(headers).To(HaveKey("./app/zz-hardlink"))
+			Expect(headers["./app/zz-hardlink"].Typeflag).To(Equal(byte(tar.TypeLink)))
+			Expect(headers["./app/zz-hardlink"].Linkname).To(Equal("./app/lib/data"))
+		})
+	})
 })
 
+func launchYMLSource(buildpack string, replaced *buildpackapplifecycle.ProcessSource) *buildpackapplifecycle.ProcessSource {
+	return &buildpackapplifecycle.ProcessSource{Kind: buildpackapplifecycle.ProcessSourceLaunchYML, Buildpack: buildpack, Replaced: replaced}
+}
+
+func releaseSource(buildpack string, replaced *buildpackapplifecycle.ProcessSource) *buildpackapplifecycle.ProcessSource {
+	return &buildpackapplifecycle.ProcessSource{Kind: buildpackapplifecycle.ProcessSourceRelease, Buildpack: buildpack, Replaced: replaced}
+}
+
+func procfileSource(replaced *buildpackapplifecycle.ProcessSource) *buildpackapplifecycle.ProcessSource {
+	return &buildpackapplifecycle.ProcessSource{Kind: buildpackapplifecycle.ProcessSourceProcfile, Replaced: replaced}
+}
+
 func makeBuilderConfig(buildpacks []string, testdataDir string) buildpackapplifecycle.LifecycleBuilderConfig {
 	skipDetect := true
 	builderConfig := buildpackapplifecycle.NewLifecycleBuilderConfig(buildpacks, skipDetect, false)
 	outputMetadataPath, err := os.MkdirTemp(os.TempDir(), "results")
 	Expect(err).ToNot(HaveOccurred())
 	Expect(builderConfig.Set("outputMetadata", filepath.Join(outputMetadataPath, "results.json"))).To(Succeed())
+	Expect(builderConfig.Set("outputDropletManifest", filepath.Join(outputMetadataPath, "droplet-manifest.json"))).To(Succeed())
 
 	buildDirPath, err := os.MkdirTemp(os.TempDir(), "app")
 	Expect(err).ToNot(HaveOccurred())
@@ -392,11 +1121,6 @@ func makeBuilderConfig(buildpacks []string, testdataDir string) buildpackapplife
 	err = os.MkdirAll(builderConfig.BuildDir(), os.ModePerm)
 	Expect(err).ToNot(HaveOccurred())
 
-	if runtime.GOOS == "windows" {
-		copyDst := filepath.Join(filepath.Dir(builderConfig.Path()), "tar.exe")
-		test_helpers.CopyFile(tmpTarPath, copyDst)
-	}
-
 	return builderConfig
 }
 
@@ -439,3 +1163,10 @@ func fakeFailingBuildpackDir() string {
 	}
 	return "fake_unix_bp_failing"
 }
+
+func fakeHangingBuildpackDir() string {
+	if runtime.GOOS == "windows" {
+		return "fake_windows_bp_hanging"
+	}
+	return "fake_unix_bp_hanging"
+}
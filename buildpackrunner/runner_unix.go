@@ -5,9 +5,11 @@ package buildpackrunner
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 )
 
 func hasFinalize(buildpackPath string) (bool, error) {
@@ -22,15 +24,26 @@ func (runner *Runner) copyApp(buildDir, stageDir string) error {
 	return runner.run(exec.Command("cp", "-a", buildDir, stageDir), os.Stdout)
 }
 
-func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string) error {
+func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string, output io.Writer) error {
 	fileInfo, err := os.Stat(filepath.Join(buildpackPath, "bin", "detect"))
 	if err != nil {
 		return err
 	}
 
 	if fileInfo.Mode()&0111 != 0111 {
-		fmt.Println("WARNING: buildpack script '/bin/detect' is not executable")
+		fmt.Fprintln(output, "WARNING: buildpack script '/bin/detect' is not executable")
 	}
 
 	return nil
 }
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
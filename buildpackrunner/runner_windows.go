@@ -4,7 +4,9 @@ import (
 	"errors"
 	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 )
 
 func hasFinalize(buildpackPath string) (bool, error) {
@@ -37,7 +39,21 @@ func (runner *Runner) copyApp(buildDir, stageDir string) error {
 	return copyDirectory(buildDir, stageDir)
 }
 
-func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string) error {
+func (runner *Runner) warnIfDetectNotExecutable(buildpackPath string, output io.Writer) error {
+	return nil
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Windows has no process groups to signal, so the script's process tree is
+// killed with taskkill instead.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+		return cmd.Process.Kill()
+	}
 	return nil
 }
 
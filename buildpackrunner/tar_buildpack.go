@@ -0,0 +1,179 @@
+package buildpackrunner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveFormat is the format of a buildpack that is downloaded rather than
+// cloned.
+type ArchiveFormat string
+
+const (
+	ArchiveZip     ArchiveFormat = "zip"
+	ArchiveTar     ArchiveFormat = "tar"
+	ArchiveTarGzip ArchiveFormat = "tar.gz"
+	ArchiveTarZstd ArchiveFormat = "tar.zst"
+)
+
+// ErrUnknownArchiveFormat is returned when a buildpack URL without a known
+// extension does not lead to an archive, in which case it is cloned instead.
+var ErrUnknownArchiveFormat = errors.New("could not determine the archive format")
+
+var archiveExtensions = []struct {
+	suffix string
+	format ArchiveFormat
+}{
+	{".zip", ArchiveZip},
+	{".tar.gz", ArchiveTarGzip},
+	{".tgz", ArchiveTarGzip},
+	{".tar.zst", ArchiveTarZstd},
+	{".tzst", ArchiveTarZstd},
+	{".tar", ArchiveTar},
+}
+
+var archiveContentTypes = map[string]ArchiveFormat{
+	"application/zip":                   ArchiveZip,
+	"application/x-zip-compressed":      ArchiveZip,
+	"application/gzip":                  ArchiveTarGzip,
+	"application/x-gzip":                ArchiveTarGzip,
+	"application/x-gtar":                ArchiveTarGzip,
+	"application/x-tgz":                 ArchiveTarGzip,
+	"application/x-compressed-tar":      ArchiveTarGzip,
+	"application/x-tar":                 ArchiveTar,
+	"application/zstd":                  ArchiveTarZstd,
+	"application/x-zstd":                ArchiveTarZstd,
+	"application/x-zstd-compressed-tar": ArchiveTarZstd,
+}
+
+// ArchiveFormatFromPath returns the format of a buildpack by the extension of
+// its URL path, or "" if the extension is not that of an archive.
+func ArchiveFormatFromPath(urlPath string) ArchiveFormat {
+	lowerPath := strings.ToLower(urlPath)
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(lowerPath, extension.suffix) {
+			return extension.format
+		}
+	}
+	return ""
+}
+
+// archiveFormatFromContentType returns "" for content types that do not
+// identify an archive, such as application/octet-stream.
+func archiveFormatFromContentType(contentType string) ArchiveFormat {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return archiveContentTypes[mediaType]
+}
+
+// sniffArchiveFormat identifies an archive by its magic bytes.
+func sniffArchiveFormat(archivePath string) (ArchiveFormat, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return ArchiveZip, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return ArchiveTarGzip, nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ArchiveTarZstd, nil
+	case len(header) >= 262 && string(header[257:262]) == "ustar":
+		return ArchiveTar, nil
+	}
+
+	return "", ErrUnknownArchiveFormat
+}
+
+// extractTar extracts a, possibly compressed, tarball.
+func extractTar(archivePath string, format ArchiveFormat, e *extraction) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	switch format {
+	case ArchiveTarGzip:
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+
+	case ArchiveTarZstd:
+		zstdReader, err := zstd.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer zstdReader.Close()
+		r = zstdReader
+
+	case ArchiveTar:
+
+	default:
+		return fmt.Errorf("unsupported archive format: %s", format)
+	}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return e.finish()
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := e.entry(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(name, header.FileInfo().Mode().Perm())
+
+		case tar.TypeReg:
+			err = e.writeFile(name, tarReader, header.FileInfo().Mode().Perm())
+
+		case tar.TypeSymlink:
+			err = e.symlink(name, header.Linkname)
+
+		case tar.TypeLink:
+			err = e.link(name, header.Linkname)
+
+		default:
+			// devices, fifos and the like have no place in a buildpack
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package buildpackrunner_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+	"github.com/klauspost/compress/zstd"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TarBuildpack", func() {
+	gzipped := func(contents []byte) []byte {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	zstdCompressed := func(contents []byte) []byte {
+		buf := &bytes.Buffer{}
+		w, err := zstd.NewWriter(buf)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write(contents)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Close()).To(Succeed())
+		return buf.Bytes()
+	}
+
+	buildpackTar := func() []byte {
+		return newTar(
+			archiveEntry{name: "buildpack/"},
+			archiveEntry{name: "buildpack/bin/detect", mode: 0755, contents: "#!/bin/sh\n"},
+			archiveEntry{name: "buildpack/VERSION", contents: "1.2.3"},
+		)
+	}
+
+	Describe("ArchiveFormatFromPath", func() {
+		DescribeTable("formats",
+			func(path string, expected buildpackrunner.ArchiveFormat) {
+				Expect(buildpackrunner.ArchiveFormatFromPath(path)).To(Equal(expected))
+			},
+			Entry("zip", "/buildpack.zip", buildpackrunner.ArchiveZip),
+			Entry("tgz", "/buildpack.tgz", buildpackrunner.ArchiveTarGzip),
+			Entry("tar.gz", "/buildpack-v1.2.TAR.GZ", buildpackrunner.ArchiveTarGzip),
+			Entry("tar.zst", "/buildpack.tar.zst", buildpackrunner.ArchiveTarZstd),
+			Entry("tzst", "/buildpack.tzst", buildpackrunner.ArchiveTarZstd),
+			Entry("tar", "/buildpack.tar", buildpackrunner.ArchiveTar),
+			Entry("a git repository", "/buildpack.git", buildpackrunner.ArchiveFormat("")),
+			Entry("no extension", "/releases/latest", buildpackrunner.ArchiveFormat("")),
+		)
+	})
+
+	Describe("DownloadAndExtract", func() {
+		var (
+			destination   string
+			server        *httptest.Server
+			responses     map[string][]byte
+			contentTypes  map[string]string
+			requests      []string
+			rejectHead    bool
+			zipDownloader *buildpackrunner.ZipDownloader
+		)
+
+		download := func(path string) (uint64, error) {
+			u, err := url.Parse(server.URL + path)
+			Expect(err).NotTo(HaveOccurred())
+			return zipDownloader.DownloadAndExtract(u, destination)
+		}
+
+		BeforeEach(func() {
+			destination = GinkgoT().TempDir()
+			responses = map[string][]byte{}
+			contentTypes = map[string]string{}
+			requests = nil
+			rejectHead = false
+
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				if rejectHead && r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				contents, ok := responses[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if contentType, ok := contentTypes[r.URL.Path]; ok {
+					w.Header().Set("Content-Type", contentType)
+				}
+				w.Write(contents)
+			}))
+
+			zipDownloader = buildpackrunner.NewZipDownloader(false)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		DescribeTable("extracting tarballs by their extension",
+			func(path string, compress func([]byte) []byte) {
+				responses[path] = compress(buildpackTar())
+
+				size, err := download(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(size).To(Equal(uint64(len(responses[path]))))
+
+				contents, err := os.ReadFile(filepath.Join(destination, "buildpack", "VERSION"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("1.2.3"))
+
+				if runtime.GOOS != "windows" {
+					fi, err := os.Stat(filepath.Join(destination, "buildpack", "bin", "detect"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0755)))
+				}
+			},
+			Entry("tgz", "/buildpack.tgz", gzipped),
+			Entry("tar.gz", "/buildpack.tar.gz", gzipped),
+			Entry("tar.zst", "/buildpack.tar.zst", zstdCompressed),
+			Entry("tar", "/buildpack.tar", func(contents []byte) []byte { return contents }),
+		)
+
+		It("identifies an extensionless tarball by its Content-Type", func() {
+			responses["/releases/latest"] = zstdCompressed(buildpackTar())
+			contentTypes["/releases/latest"] = "application/zstd"
+
+			_, err := download("/releases/latest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(destination, "buildpack", "VERSION")).To(BeAnExistingFile())
+		})
+
+		It("identifies an extensionless tarball by its contents", func() {
+			responses["/releases/latest"] = gzipped(buildpackTar())
+			contentTypes["/releases/latest"] = "application/octet-stream"
+
+			_, err := download("/releases/latest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(destination, "buildpack", "VERSION")).To(BeAnExistingFile())
+		})
+
+		It("identifies an extensionless tarball served without a Content-Type by its contents", func() {
+			responses["/releases/latest"] = buildpackTar()
+			contentTypes["/releases/latest"] = ""
+
+			_, err := download("/releases/latest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(destination, "buildpack", "VERSION")).To(BeAnExistingFile())
+		})
+
+		It("fails with ErrUnknownArchiveFormat for contents that are not archives", func() {
+			responses["/releases/latest"] = []byte("not an archive")
+			contentTypes["/releases/latest"] = "application/octet-stream"
+
+			_, err := download("/releases/latest")
+			Expect(err).To(MatchError(buildpackrunner.ErrUnknownArchiveFormat))
+		})
+
+		It("fails with ErrUnknownArchiveFormat without downloading anything else", func() {
+			responses["/org/buildpack"] = []byte("<html>a repository</html>")
+			contentTypes["/org/buildpack"] = "text/html; charset=utf-8"
+
+			_, err := download("/org/buildpack")
+			Expect(err).To(MatchError(buildpackrunner.ErrUnknownArchiveFormat))
+			Expect(requests).To(Equal([]string{"HEAD /org/buildpack"}))
+		})
+
+		It("fails with ErrUnknownArchiveFormat without downloading when an extensionless url cannot be found", func() {
+			_, err := download("/org/missing")
+			Expect(err).To(MatchError(buildpackrunner.ErrUnknownArchiveFormat))
+			Expect(requests).To(Equal([]string{"HEAD /org/missing"}))
+		})
+
+		It("fails with ErrUnknownArchiveFormat without downloading when the server rejects HEAD", func() {
+			responses["/releases/latest"] = gzipped(buildpackTar())
+			rejectHead = true
+
+			_, err := download("/releases/latest")
+			Expect(err).To(MatchError(buildpackrunner.ErrUnknownArchiveFormat))
+			Expect(requests).To(Equal([]string{"HEAD /releases/latest"}))
+		})
+
+		It("extracts links", func() {
+			if runtime.GOOS == "windows" {
+				Skip("links need privileges on Windows")
+			}
+
+			responses["/buildpack.tar"] = newTar(
+				archiveEntry{name: "bin/detect", mode: 0755, contents: "#!/bin/sh\n"},
+				archiveEntry{name: "bin/supply", symlink: "detect"},
+				archiveEntry{name: "bin/finalize", hardlink: "bin/detect"},
+			)
+
+			_, err := download("/buildpack.tar")
+			Expect(err).NotTo(HaveOccurred())
+
+			target, err := os.Readlink(filepath.Join(destination, "bin", "supply"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal("detect"))
+
+			detect, err := os.Stat(filepath.Join(destination, "bin", "detect"))
+			Expect(err).NotTo(HaveOccurred())
+			finalize, err := os.Stat(filepath.Join(destination, "bin", "finalize"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.SameFile(detect, finalize)).To(BeTrue())
+		})
+
+		It("rejects entries outside of the destination", func() {
+			responses["/buildpack.tar"] = newTar(archiveEntry{name: "../escaped", contents: "nope"})
+
+			_, err := download("/buildpack.tar")
+			Expect(err).To(MatchError(ContainSubstring("illegal path in archive: ../escaped")))
+			Expect(filepath.Join(filepath.Dir(destination), "escaped")).NotTo(BeAnExistingFile())
+		})
+
+		It("fails for a corrupt tarball", func() {
+			responses["/buildpack.tgz"] = []byte("not gzip")
+
+			_, err := download("/buildpack.tgz")
+			Expect(err).To(MatchError(ContainSubstring("Failed to extract buildpack")))
+		})
+	})
+})
@@ -0,0 +1,2 @@
+@echo off
+ping -n 600 127.0.0.1 >nul
@@ -0,0 +1,4 @@
+@echo off
+echo ---
+echo default_process_types:
+echo   web: This is the start command for the 'web' default process type in testdata/fake_{unix,windows}_bp/bin/release{,.bat}
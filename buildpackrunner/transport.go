@@ -0,0 +1,210 @@
+package buildpackrunner
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// systemCABundles are the usual locations of the system's CA bundle, which
+// git has to be given along with any additional certificates.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// TransportOptions configure the connections over which buildpacks are
+// fetched, by the zip downloader as well as by git.
+type TransportOptions struct {
+	SkipSSLVerification bool
+
+	// CACertsPath is a PEM bundle, or a directory of .crt and .pem files,
+	// whose certificate authorities are trusted in addition to the system's.
+	CACertsPath string
+
+	// ClientCertPath and ClientKeyPath hold the PEM certificate and key
+	// presented to servers that require mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+
+	// Proxy is the URL of the proxy for both HTTP and HTTPS, overriding the
+	// proxy environment variables. NoProxy is a comma-separated list of
+	// hosts, domains and CIDRs that are connected to directly.
+	Proxy   string
+	NoProxy string
+}
+
+func (o TransportOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.SkipSSLVerification}
+
+	if o.CACertsPath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		certs, err := o.caCerts()
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(certs) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CACertsPath)
+		}
+		config.RootCAs = pool
+	}
+
+	if o.ClientCertPath != "" || o.ClientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertPath, o.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// caCerts returns the PEM contents of the CA bundle, or of the certificate
+// files in the CA directory in lexical order.
+func (o TransportOptions) caCerts() ([]byte, error) {
+	fi, err := os.Stat(o.CACertsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA certificates: %s", err.Error())
+	}
+	if !fi.IsDir() {
+		contents, err := os.ReadFile(o.CACertsPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificates: %s", err.Error())
+		}
+		return contents, nil
+	}
+
+	files, err := os.ReadDir(o.CACertsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA certificates: %s", err.Error())
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && (strings.HasSuffix(file.Name(), ".crt") || strings.HasSuffix(file.Name(), ".pem")) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var certs bytes.Buffer
+	for _, name := range names {
+		contents, err := os.ReadFile(filepath.Join(o.CACertsPath, name))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA certificates: %s", err.Error())
+		}
+		certs.Write(contents)
+		certs.WriteString("\n")
+	}
+	return certs.Bytes(), nil
+}
+
+// proxy returns the proxy for a request, taken from the environment unless
+// the options override it.
+func (o TransportOptions) proxy() func(*http.Request) (*url.URL, error) {
+	if o.Proxy == "" && o.NoProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	config := httpproxy.FromEnvironment()
+	if o.Proxy != "" {
+		config.HTTPProxy = o.Proxy
+		config.HTTPSProxy = o.Proxy
+	}
+	if o.NoProxy != "" {
+		config.NoProxy = o.NoProxy
+	}
+
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// gitEnv returns the environment that makes git honour the options. The
+// returned function removes the CA bundle written for git.
+func (o TransportOptions) gitEnv() ([]string, func(), error) {
+	env := []string{}
+	cleanup := func() {}
+
+	if o.SkipSSLVerification {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+
+	if o.CACertsPath != "" {
+		// git trusts either its bundle or ours, so ours has to include the
+		// system's certificate authorities too
+		caInfo, err := o.writeGitCABundle()
+		if err != nil {
+			return nil, cleanup, err
+		}
+		cleanup = func() { os.Remove(caInfo) }
+		env = append(env, "GIT_SSL_CAINFO="+caInfo)
+	}
+
+	if o.ClientCertPath != "" {
+		env = append(env, "GIT_SSL_CERT="+o.ClientCertPath)
+	}
+	if o.ClientKeyPath != "" {
+		env = append(env, "GIT_SSL_KEY="+o.ClientKeyPath)
+	}
+
+	if o.Proxy != "" {
+		env = append(env, "http_proxy="+o.Proxy, "https_proxy="+o.Proxy, "HTTPS_PROXY="+o.Proxy)
+	}
+	if o.NoProxy != "" {
+		env = append(env, "no_proxy="+o.NoProxy, "NO_PROXY="+o.NoProxy)
+	}
+
+	return env, cleanup, nil
+}
+
+func (o TransportOptions) writeGitCABundle() (string, error) {
+	certs, err := o.caCerts()
+	if err != nil {
+		return "", err
+	}
+
+	var bundle bytes.Buffer
+	systemBundles := systemCABundles
+	if sslCertFile := os.Getenv("SSL_CERT_FILE"); sslCertFile != "" {
+		systemBundles = []string{sslCertFile}
+	}
+	for _, systemBundle := range systemBundles {
+		if contents, err := os.ReadFile(systemBundle); err == nil {
+			bundle.Write(contents)
+			bundle.WriteString("\n")
+			break
+		}
+	}
+	bundle.Write(certs)
+
+	file, err := os.CreateTemp("", "buildpack-ca-certs")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(bundle.Bytes()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
@@ -0,0 +1,236 @@
+package buildpackrunner_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var (
+		certDir     string
+		destination string
+		zipContents []byte
+		options     buildpackrunner.DownloadOptions
+	)
+
+	writePEM := func(name, blockType string, contents []byte) string {
+		path := filepath.Join(certDir, name)
+		Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: contents}), 0600)).To(Succeed())
+		return path
+	}
+
+	// newClientCert returns the paths of a self-signed client certificate
+	// and its key, along with the certificate to trust it by
+	newClientCert := func() (string, string, *x509.Certificate) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "staging"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+
+		return writePEM("client.crt", "CERTIFICATE", der), writePEM("client.key", "EC PRIVATE KEY", keyDER), cert
+	}
+
+	download := func(rawURL string) error {
+		u, err := url.Parse(rawURL)
+		Expect(err).NotTo(HaveOccurred())
+
+		zipDownloader, err := buildpackrunner.NewZipDownloaderWithOptions(options, nil)
+		if err != nil {
+			return err
+		}
+		_, err = zipDownloader.DownloadAndExtract(u, destination)
+		return err
+	}
+
+	serveZip := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zipContents)
+	})
+
+	BeforeEach(func() {
+		certDir = GinkgoT().TempDir()
+		destination = GinkgoT().TempDir()
+
+		zipContents = newZip(archiveEntry{name: "contents", contents: "stuff"})
+
+		options = buildpackrunner.DefaultDownloadOptions()
+		options.Attempts = 1
+	})
+
+	Context("with a server certified by a custom CA", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(serveZip)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("does not trust the server by default", func() {
+			Expect(download(server.URL + "/buildpack.zip")).To(MatchError(ContainSubstring("certificate")))
+		})
+
+		It("trusts the server with a CA bundle", func() {
+			options.CACertsPath = writePEM("ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+			Expect(download(server.URL + "/buildpack.zip")).To(Succeed())
+			Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+		})
+
+		It("trusts the server with a directory of certificates", func() {
+			writePEM("ca.crt", "CERTIFICATE", server.Certificate().Raw)
+			writePEM("README", "NOT A CERTIFICATE", []byte("ignored"))
+			options.CACertsPath = certDir
+
+			Expect(download(server.URL + "/buildpack.zip")).To(Succeed())
+		})
+
+		It("fails when the CA bundle holds no certificates", func() {
+			options.CACertsPath = writePEM("ca.pem", "NOT A CERTIFICATE", []byte("garbage"))
+
+			Expect(download(server.URL + "/buildpack.zip")).To(MatchError(ContainSubstring("no certificates found in")))
+		})
+
+		It("clones git repositories trusting the CA bundle", func() {
+			server.Close()
+			server = httptest.NewTLSServer(http.FileServer(http.Dir(tmpDir)))
+			options.CACertsPath = writePEM("ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+			repo, err := url.Parse(server.URL + gitUrl.Path)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = buildpackrunner.GitClone(*repo, filepath.Join(destination, "untrusted"))
+			Expect(err).To(HaveOccurred())
+
+			_, err = buildpackrunner.GitCloneWithOptions(*repo, filepath.Join(destination, "trusted"), options.TransportOptions)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(destination, "trusted", "content")).To(BeAnExistingFile())
+		})
+	})
+
+	Context("with a server that requires a client certificate", func() {
+		var (
+			server     *httptest.Server
+			clientCert string
+			clientKey  string
+		)
+
+		BeforeEach(func() {
+			var cert *x509.Certificate
+			clientCert, clientKey, cert = newClientCert()
+
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(cert)
+
+			server = httptest.NewUnstartedServer(serveZip)
+			server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+			server.StartTLS()
+
+			options.CACertsPath = writePEM("ca.pem", "CERTIFICATE", server.Certificate().Raw)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("fails without one", func() {
+			Expect(download(server.URL + "/buildpack.zip")).To(HaveOccurred())
+		})
+
+		It("presents the client certificate", func() {
+			options.ClientCertPath = clientCert
+			options.ClientKeyPath = clientKey
+
+			Expect(download(server.URL + "/buildpack.zip")).To(Succeed())
+			Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+		})
+
+		It("fails when the key does not load", func() {
+			options.ClientCertPath = clientCert
+			options.ClientKeyPath = filepath.Join(certDir, "missing.key")
+
+			Expect(download(server.URL + "/buildpack.zip")).To(MatchError(ContainSubstring("Failed to load client certificate")))
+		})
+	})
+
+	Context("with a proxy", func() {
+		var (
+			proxy        *httptest.Server
+			proxiedHosts atomic.Value
+		)
+
+		BeforeEach(func() {
+			proxiedHosts.Store([]string{})
+			fileServer := http.FileServer(http.Dir(tmpDir))
+			proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxiedHosts.Store(append(proxiedHosts.Load().([]string), r.Host))
+				if filepath.Ext(r.URL.Path) == ".zip" {
+					serveZip(w, r)
+					return
+				}
+				fileServer.ServeHTTP(w, r)
+			}))
+			options.Proxy = proxy.URL
+		})
+
+		AfterEach(func() {
+			proxy.Close()
+		})
+
+		It("downloads through the proxy", func() {
+			Expect(download("http://buildpacks.example.com/buildpack.zip")).To(Succeed())
+			Expect(proxiedHosts.Load()).To(ConsistOf("buildpacks.example.com"))
+		})
+
+		It("bypasses the proxy for hosts it excludes", func() {
+			options.NoProxy = "example.com"
+
+			Expect(download("http://buildpacks.example.com/buildpack.zip")).To(HaveOccurred())
+			Expect(proxiedHosts.Load()).To(BeEmpty())
+		})
+
+		It("clones git repositories through the proxy", func() {
+			repo := url.URL{Scheme: "http", Host: "git.example.com", Path: gitUrl.Path}
+
+			_, err := buildpackrunner.GitCloneWithOptions(repo, destination, options.TransportOptions)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(destination, "content")).To(BeAnExistingFile())
+			Expect(proxiedHosts.Load()).To(ContainElement("git.example.com"))
+		})
+	})
+})
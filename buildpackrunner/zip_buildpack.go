@@ -1,66 +1,300 @@
 package buildpackrunner
 
 import (
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"code.cloudfoundry.org/archiver/extractor"
-	"code.cloudfoundry.org/cacheddownloader"
-	"code.cloudfoundry.org/lager/v3"
+	"code.cloudfoundry.org/buildpackapplifecycle"
 )
 
+// ZipDownloader downloads and extracts buildpack archives: zip files and
+// tarballs, either uncompressed or compressed with gzip or zstd.
 type ZipDownloader struct {
-	downloader *cacheddownloader.Downloader
+	http  *httpDownloader
+	cache *DownloadCache
+}
+
+// BuildpackDigest is a content digest pinned in the fragment of a buildpack
+// URL, e.g. https://example.com/buildpack.zip#sha256=<hex>
+type BuildpackDigest struct {
+	Algorithm string
+	Value     string
+}
+
+func (d BuildpackDigest) String() string {
+	return d.Algorithm + ":" + d.Value
 }
 
 func IsZipFile(filename string) bool {
 	return strings.HasSuffix(filename, ".zip")
 }
 
+// ParseBuildpackDigest returns the digest pinned in the URL fragment, or nil
+// if the URL does not pin one.
+func ParseBuildpackDigest(u *url.URL) (*BuildpackDigest, error) {
+	if u.Fragment == "" {
+		return nil, nil
+	}
+
+	algorithm, value, found := strings.Cut(u.Fragment, "=")
+	if !found || algorithm != "sha256" {
+		return nil, fmt.Errorf("Invalid buildpack digest '%s': expected sha256=<hex>", u.Fragment)
+	}
+
+	value = strings.ToLower(value)
+	if decoded, err := hex.DecodeString(value); err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("Invalid buildpack digest '%s': not a sha256 hex digest", u.Fragment)
+	}
+
+	return &BuildpackDigest{Algorithm: algorithm, Value: value}, nil
+}
+
 func NewZipDownloader(skipSSLVerification bool) *ZipDownloader {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: skipSSLVerification,
+	return NewCachingZipDownloader(skipSSLVerification, nil)
+}
+
+// NewCachingZipDownloader returns a ZipDownloader that reuses archives from
+// the given cache, or always downloads when the cache is nil.
+func NewCachingZipDownloader(skipSSLVerification bool, cache *DownloadCache) *ZipDownloader {
+	options := DefaultDownloadOptions()
+	options.SkipSSLVerification = skipSSLVerification
+
+	// without certificates to load there is nothing that can fail
+	zipDownloader, _ := NewZipDownloaderWithOptions(options, cache)
+	return zipDownloader
+}
+
+// NewZipDownloaderWithOptions returns a ZipDownloader that connects, retries
+// and times out downloads as configured, and reuses archives from the given
+// cache unless it is nil. It fails when the configured certificates cannot
+// be loaded.
+func NewZipDownloaderWithOptions(options DownloadOptions, cache *DownloadCache) (*ZipDownloader, error) {
+	httpDownloader, err := newHTTPDownloader(options)
+	if err != nil {
+		return nil, err
 	}
 
 	return &ZipDownloader{
-		downloader: cacheddownloader.NewDownloader(DOWNLOAD_TIMEOUT, 1, tlsConfig),
-	}
+		http:  httpDownloader,
+		cache: cache,
+	}, nil
 }
 
+// DownloadAndExtract downloads the buildpack archive at u and extracts it
+// into destination, returning the size of the archive. The format is taken
+// from the extension of the URL, then from the Content-Type the server
+// reports, and finally, only when the server does not tell what it serves,
+// from the contents of the download. When none of them identify an archive
+// the error wraps ErrUnknownArchiveFormat.
 func (z *ZipDownloader) DownloadAndExtract(u *url.URL, destination string) (uint64, error) {
-	zipFile, err := os.CreateTemp("", filepath.Base(u.Path))
+	digest, err := ParseBuildpackDigest(u)
+	if err != nil {
+		return 0, err
+	}
+
+	format := ArchiveFormatFromPath(u.Path)
+	if format == "" {
+		var sniff bool
+		format, sniff = z.probeFormat(u)
+		if format == "" && !sniff {
+			return 0, fmt.Errorf("%w: '%s' does not serve an archive", ErrUnknownArchiveFormat, redactedURL(u))
+		}
+	}
+
+	downloader := z
+	if format == "" {
+		// whatever is downloaded may not be a buildpack, so it is not cached
+		downloader = &ZipDownloader{http: z.http}
+	}
+
+	archivePath, err := downloader.fetch(u, digest)
+	if err != nil {
+		if format == "" {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownArchiveFormat, err.Error())
+		}
+		return 0, err
+	}
+	if downloader.cache == nil {
+		defer os.Remove(archivePath)
+	} else {
+		defer downloader.cache.release(archivePath)
+	}
+
+	if format == "" {
+		format, err = sniffArchiveFormat(archivePath)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to identify buildpack '%s': %w", redactedURL(u), err)
+		}
+	}
+
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to obtain the size of the buildpack '%s': %s", redactedURL(u), err.Error())
+	}
+
+	if err := extractArchive(archivePath, format, destination, z.http.options.Limits); err != nil {
+		return 0, fmt.Errorf("Failed to extract buildpack '%s': %s", redactedURL(u), err.Error())
+	}
+
+	return uint64(fi.Size()), nil
+}
+
+// probeFormat asks the server for the Content-Type of an HTTP(S) URL without
+// downloading it. When that does not identify an archive, it reports whether
+// the contents are still worth sniffing, which they are only when the server
+// does not tell what it serves. Anything else, such as the page of a git
+// repository, is not downloaded at all.
+func (z *ZipDownloader) probeFormat(u *url.URL) (ArchiveFormat, bool) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+
+	probeURL := *u
+	probeURL.Fragment = ""
+	resp, err := z.http.head(&probeURL)
 	if err != nil {
-		return 0, fmt.Errorf("Could not create zip file: %s", err.Error())
-	}
-	defer os.Remove(zipFile.Name())
-
-	_, _, err = z.downloader.Download(
-		lager.NewLogger("noop"),
-		u,
-		func() (*os.File, error) {
-			return os.OpenFile(zipFile.Name(), os.O_WRONLY, 0644)
-		},
-		cacheddownloader.CachingInfoType{},
-		cacheddownloader.ChecksumInfoType{},
-		make(chan struct{}),
+		return "", false
+	}
+
+	// servers that reject HEAD or fail it are not trusted to serve an
+	// archive either
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return "", false
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if format := archiveFormatFromContentType(contentType); format != "" {
+		return format, false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return "", contentType == "" || mediaType == "application/octet-stream"
+}
+
+// fetch returns the path of the archive for u, whose digest has been verified
+// if one is pinned. Without a cache the caller owns the returned file.
+func (z *ZipDownloader) fetch(u *url.URL, digest *BuildpackDigest) (string, error) {
+	downloadURL := *u
+	downloadURL.Fragment = ""
+
+	// credentials are not part of what is downloaded, and must not be
+	// written to the cache metadata
+	cacheURL := downloadURL
+	cacheURL.User = nil
+
+	var (
+		cached      cachingInfo
+		cachedEntry *downloadCacheEntry
+		cachedPath  string
+		reused      bool
 	)
+	if z.cache != nil {
+		var found bool
+		cachedEntry, cachedPath, found = z.cache.lookup(cacheURL.String(), digest)
+		if found {
+			// the cached archive cannot be evicted by concurrent downloads
+			// until it is released, which is left to the caller only when
+			// it is the archive returned
+			defer func() {
+				if !reused {
+					z.cache.release(cachedPath)
+				}
+			}()
+		}
+		if found && digest != nil {
+			// a pinned archive cannot change, so there is nothing to ask the
+			// server; a corrupted entry is dropped and downloaded again
+			if verifyDigest(cachedPath, *digest) == nil {
+				err := z.cache.touch(cachedEntry)
+				reused = err == nil
+				return cachedPath, err
+			}
+			cachedEntry = nil
+		}
+		if found && cachedEntry != nil {
+			cached = cachingInfo{
+				ETag:         cachedEntry.ETag,
+				LastModified: cachedEntry.LastModified,
+			}
+		}
+	}
+
+	zipFile, err := z.createTemp(filepath.Base(u.Path))
 	if err != nil {
-		return 0, fmt.Errorf("Failed to download buildpack '%s': %s", u.String(), err.Error())
+		return "", fmt.Errorf("Could not create buildpack archive file: %s", err.Error())
+	}
+	zipFile.Close()
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		os.Remove(zipFile.Name())
+		return "", fmt.Errorf("Failed to download buildpack '%s': unsupported scheme %s", redactedURL(u), u.Scheme)
 	}
 
-	fi, err := zipFile.Stat()
+	info, notModified, err := z.http.download(&downloadURL, zipFile.Name(), cached)
 	if err != nil {
-		return 0, fmt.Errorf("Failed to obtain the size of the buildpack '%s': %s", u.String(), err.Error())
+		os.Remove(zipFile.Name())
+		return "", fmt.Errorf("Failed to download buildpack '%s': %s", redactedURL(u), buildpackapplifecycle.RedactCredentials(err.Error()))
 	}
 
-	err = extractor.NewZip().Extract(zipFile.Name(), destination)
+	if notModified {
+		os.Remove(zipFile.Name())
+		err = z.cache.touch(cachedEntry)
+		reused = err == nil
+		return cachedPath, err
+	}
+
+	if digest != nil {
+		if err := verifyDigest(zipFile.Name(), *digest); err != nil {
+			os.Remove(zipFile.Name())
+			return "", fmt.Errorf("Failed to verify buildpack '%s': %s", redactedURL(u), err.Error())
+		}
+	}
+
+	if z.cache == nil {
+		return zipFile.Name(), nil
+	}
+
+	zipPath, err := z.cache.store(cacheURL.String(), digest, info.ETag, info.LastModified, zipFile.Name())
 	if err != nil {
-		return 0, fmt.Errorf("Failed to extract buildpack '%s': %s", u.String(), err.Error())
+		return "", fmt.Errorf("Failed to cache buildpack '%s': %s", redactedURL(u), err.Error())
 	}
+	return zipPath, nil
+}
 
-	return uint64(fi.Size()), nil
+// downloads land next to the cache so that storing them is a rename
+func (z *ZipDownloader) createTemp(pattern string) (*os.File, error) {
+	if z.cache == nil {
+		return os.CreateTemp("", pattern)
+	}
+	return z.cache.createTemp(pattern)
+}
+
+func redactedURL(u *url.URL) string {
+	return buildpackapplifecycle.RedactCredentials(u.String())
+}
+
+func verifyDigest(path string, digest BuildpackDigest) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	actual := BuildpackDigest{Algorithm: digest.Algorithm, Value: hex.EncodeToString(hash.Sum(nil))}
+	if actual != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, actual)
+	}
+	return nil
 }
@@ -2,12 +2,16 @@ package buildpackrunner_test
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 
 	"code.cloudfoundry.org/buildpackapplifecycle/buildpackrunner"
 
@@ -38,6 +42,34 @@ var _ = Describe("ZipBuildpack", func() {
 		})
 	})
 
+	Describe("ParseBuildpackDigest", func() {
+		It("returns nil when the url has no fragment", func() {
+			u, _ := url.Parse("https://example.com/buildpack.zip")
+			digest, err := buildpackrunner.ParseBuildpackDigest(u)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest).To(BeNil())
+		})
+
+		It("parses a sha256 digest", func() {
+			u, _ := url.Parse("https://example.com/buildpack.zip#sha256=" + strings.Repeat("AB", 32))
+			digest, err := buildpackrunner.ParseBuildpackDigest(u)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(digest.String()).To(Equal("sha256:" + strings.Repeat("ab", 32)))
+		})
+
+		It("rejects unsupported algorithms", func() {
+			u, _ := url.Parse("https://example.com/buildpack.zip#md5=d41d8cd98f00b204e9800998ecf8427e")
+			_, err := buildpackrunner.ParseBuildpackDigest(u)
+			Expect(err).To(MatchError(ContainSubstring("Invalid buildpack digest")))
+		})
+
+		It("rejects malformed digests", func() {
+			u, _ := url.Parse("https://example.com/buildpack.zip#sha256=nothex")
+			_, err := buildpackrunner.ParseBuildpackDigest(u)
+			Expect(err).To(MatchError(ContainSubstring("Invalid buildpack digest")))
+		})
+	})
+
 	Describe("DownloadZipAndExtract", func() {
 		var fileserver *httptest.Server
 		var zipDownloader *buildpackrunner.ZipDownloader
@@ -90,6 +122,38 @@ var _ = Describe("ZipBuildpack", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(bytes).To(Equal([]byte("stuff")))
 			})
+
+			Context("when the url pins a sha256 digest", func() {
+				var zipDigest string
+
+				BeforeEach(func() {
+					contents, err := os.ReadFile(zipfile)
+					Expect(err).NotTo(HaveOccurred())
+					sum := sha256.Sum256(contents)
+					zipDigest = hex.EncodeToString(sum[:])
+				})
+
+				It("extracts when the digest matches", func() {
+					u, _ := url.Parse(fileserver.URL)
+					u.Path = filepath.Base(zipfile)
+					u.Fragment = "sha256=" + zipDigest
+					size, err := zipDownloader.DownloadAndExtract(u, destination)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(size).To(Equal(zipSize))
+					Expect(filepath.Join(destination, "contents")).To(BeAnExistingFile())
+				})
+
+				It("fails without extracting when the digest does not match", func() {
+					wrongDigest := strings.Repeat("0", 64)
+					u, _ := url.Parse(fileserver.URL)
+					u.Path = filepath.Base(zipfile)
+					u.Fragment = "sha256=" + wrongDigest
+					size, err := zipDownloader.DownloadAndExtract(u, destination)
+					Expect(err).To(MatchError(ContainSubstring("digest mismatch: expected sha256:" + wrongDigest + ", got sha256:" + zipDigest)))
+					Expect(size).To(Equal(uint64(0)))
+					Expect(filepath.Join(destination, "contents")).NotTo(BeAnExistingFile())
+				})
+			})
 		})
 
 		It("fails when the zip file does not exist", func() {
@@ -99,6 +163,17 @@ var _ = Describe("ZipBuildpack", func() {
 			Expect(size).To(Equal(uint64(0)))
 		})
 
+		It("redacts credentials in the url from errors", func() {
+			u, _ := url.Parse(fileserver.URL)
+			u.Path = "/not-there.zip"
+			u.User = url.UserPassword("user", "s3cr3t-token")
+
+			_, err := zipDownloader.DownloadAndExtract(u, destination)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).NotTo(ContainSubstring("s3cr3t-token"))
+			Expect(err.Error()).To(ContainSubstring("http://***@"))
+		})
+
 		It("fails when the file is not a zip file", func() {
 			u, _ := url.Parse(fileserver.URL)
 			u.Path = filepath.Base(destination)
@@ -107,4 +182,153 @@ var _ = Describe("ZipBuildpack", func() {
 			Expect(size).To(Equal(uint64(0)))
 		})
 	})
+
+	Describe("DownloadAndExtract with a download cache", func() {
+		var (
+			cacheDir      string
+			server        *httptest.Server
+			requests      atomic.Int32
+			notModified   atomic.Int32
+			zipContents   []byte
+			zipDigest     string
+			zipDownloader *buildpackrunner.ZipDownloader
+		)
+
+		cachedArchives := func() []string {
+			files, err := os.ReadDir(cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			archives := []string{}
+			for _, file := range files {
+				if !strings.HasSuffix(file.Name(), ".json") && !strings.HasSuffix(file.Name(), ".lock") {
+					archives = append(archives, file.Name())
+				}
+			}
+			return archives
+		}
+
+		download := func(path string) {
+			u, err := url.Parse(server.URL + path)
+			Expect(err).NotTo(HaveOccurred())
+
+			extractDir, err := os.MkdirTemp(destination, "extract")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = zipDownloader.DownloadAndExtract(u, extractDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(extractDir, "contents")).To(BeAnExistingFile())
+		}
+
+		BeforeEach(func() {
+			var err error
+			cacheDir, err = os.MkdirTemp("", "download-cache")
+			Expect(err).NotTo(HaveOccurred())
+
+			requests.Store(0)
+			notModified.Store(0)
+
+			zipContents = newZip(archiveEntry{name: "contents", contents: "stuff"})
+			sum := sha256.Sum256(zipContents)
+			zipDigest = hex.EncodeToString(sum[:])
+
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				etag := `"` + r.URL.Path + `"`
+				if r.Header.Get("If-None-Match") == etag {
+					notModified.Add(1)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				w.Write(zipContents)
+			}))
+
+			zipDownloader = buildpackrunner.NewCachingZipDownloader(false, buildpackrunner.NewDownloadCache(cacheDir, 1024*1024))
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(cacheDir)
+		})
+
+		It("does not download a pinned buildpack again", func() {
+			download("/buildpack.zip#sha256=" + zipDigest)
+			download("/buildpack.zip#sha256=" + zipDigest)
+
+			Expect(requests.Load()).To(Equal(int32(1)))
+			Expect(cachedArchives()).To(ConsistOf("sha256-" + zipDigest))
+		})
+
+		It("shares pinned buildpacks between urls", func() {
+			download("/buildpack.zip#sha256=" + zipDigest)
+			download("/mirror/buildpack.zip#sha256=" + zipDigest)
+
+			Expect(requests.Load()).To(Equal(int32(1)))
+		})
+
+		It("revalidates an unpinned buildpack with its ETag", func() {
+			download("/buildpack.zip")
+			download("/buildpack.zip")
+
+			Expect(requests.Load()).To(Equal(int32(2)))
+			Expect(notModified.Load()).To(Equal(int32(1)))
+			Expect(cachedArchives()).To(HaveLen(1))
+		})
+
+		It("keeps credentials in the url out of the cache", func() {
+			u, err := url.Parse(server.URL + "/buildpack.zip")
+			Expect(err).NotTo(HaveOccurred())
+			u.User = url.UserPassword("user", "s3cr3t-token")
+
+			_, err = zipDownloader.DownloadAndExtract(u, destination)
+			Expect(err).NotTo(HaveOccurred())
+			download("/buildpack.zip")
+			Expect(notModified.Load()).To(Equal(int32(1)))
+
+			files, err := os.ReadDir(cacheDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, file := range files {
+				contents, err := os.ReadFile(filepath.Join(cacheDir, file.Name()))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).NotTo(ContainSubstring("s3cr3t-token"))
+			}
+		})
+
+		Context("when the cache exceeds its maximum size", func() {
+			BeforeEach(func() {
+				zipDownloader = buildpackrunner.NewCachingZipDownloader(false, buildpackrunner.NewDownloadCache(cacheDir, uint64(len(zipContents)*2)))
+			})
+
+			It("evicts the least recently used buildpacks", func() {
+				download("/first.zip")
+				download("/second.zip")
+				download("/first.zip")
+				download("/third.zip")
+
+				Expect(cachedArchives()).To(HaveLen(2))
+
+				download("/first.zip")
+				Expect(notModified.Load()).To(Equal(int32(2)))
+
+				download("/second.zip")
+				Expect(notModified.Load()).To(Equal(int32(2)))
+			})
+
+			It("does not evict buildpacks another staging is extracting", func() {
+				download("/first.zip")
+				locks, err := filepath.Glob(filepath.Join(cacheDir, "*.lock"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(locks).To(HaveLen(1))
+
+				lock := lockShared(locks[0])
+				defer lock.Close()
+
+				download("/second.zip")
+				download("/third.zip")
+
+				download("/first.zip")
+				Expect(notModified.Load()).To(Equal(int32(1)))
+			})
+		})
+	})
 })
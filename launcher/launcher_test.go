@@ -408,6 +408,68 @@ var _ = Describe("Launcher", func() {
 
 		ItExecutesTheCommandWithTheRightEnvironment()
 
+		Context("when the staging_info.yml declares environment for processes", func() {
+			BeforeEach(func() {
+				removeFromLauncherEnv("VCAP_APPLICATION")
+				launcherCmd.Env = append(launcherCmd.Env, `VCAP_APPLICATION={"process_type":"worker"}`, "B=from-the-app")
+
+				stagingInfo, err := json.Marshal(buildpackrunner.DeaStagingInfo{
+					ProcessEnv: map[string]map[string]string{
+						"web":    {"A": "for-web"},
+						"worker": {"A": "for-worker", "B": "for-worker"},
+					},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				writeStagingInfo(extractDir, string(stagingInfo))
+			})
+
+			It("sets the environment of the process type it starts", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("A=for-worker"))
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("A=for-web"))
+			})
+
+			It("does not change the variables the app sets", func() {
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(string(session.Out.Contents())).To(ContainSubstring("B=from-the-app"))
+				Expect(string(session.Out.Contents())).NotTo(ContainSubstring("B=for-worker"))
+			})
+
+			Context("when it runs a task, which has no process type", func() {
+				BeforeEach(func() {
+					removeFromLauncherEnv("VCAP_APPLICATION")
+					launcherCmd.Env = append(launcherCmd.Env, `VCAP_APPLICATION={"name":"app"}`)
+				})
+
+				It("sets the environment of no process type", func() {
+					Eventually(session).Should(gexec.Exit(0))
+					Expect(string(session.Out.Contents())).NotTo(ContainSubstring("A=for-web"))
+					Expect(string(session.Out.Contents())).NotTo(ContainSubstring("A=for-worker"))
+				})
+			})
+
+			Context("when the start command is that of a sidecar", func() {
+				BeforeEach(func() {
+					stagingInfo, err := json.Marshal(buildpackrunner.DeaStagingInfo{
+						ProcessEnv: map[string]map[string]string{
+							"worker": {"A": "for-worker"},
+						},
+						SidecarEnv: []buildpackrunner.SidecarEnv{
+							{Name: "agent", Command: startCommand, ProcessTypes: []string{"web", "worker"}, Env: map[string]string{"A": "for-the-agent"}},
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					writeStagingInfo(extractDir, string(stagingInfo))
+				})
+
+				It("sets the environment of the sidecar", func() {
+					Eventually(session).Should(gexec.Exit(0))
+					Expect(string(session.Out.Contents())).To(ContainSubstring("A=for-the-agent"))
+					Expect(string(session.Out.Contents())).NotTo(ContainSubstring("A=for-worker"))
+				})
+			})
+		})
+
 		Context("when the staging_info.yml specifies an entrypoint prefix", func() {
 			Context("When running on Windows", func() {
 				BeforeEach(func() {
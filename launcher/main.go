@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,7 +11,7 @@ import (
 	"code.cloudfoundry.org/buildpackapplifecycle/credhub_flags"
 	"code.cloudfoundry.org/buildpackapplifecycle/env"
 	"code.cloudfoundry.org/goshims/osshim"
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 var preStartMessage = "Invoking pre-start scripts."
@@ -19,7 +20,8 @@ var startMessage = "Invoking start command."
 func main() {
 	if len(os.Args) < 4 {
 		fmt.Fprintf(os.Stderr, "%s: received only %d arguments\n", os.Args[0], len(os.Args)-1)
-		fmt.Fprintf(os.Stderr, "Usage: %s <app-directory> <start-command> <metadata>", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <app-directory> <start-command> <metadata>\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "The environment buildpacks declare for a process type is set for the process_type in VCAP_APPLICATION; tasks have none, and get only that of sidecars running their command.")
 		os.Exit(1)
 	}
 
@@ -64,6 +66,11 @@ func main() {
 		os.Exit(3)
 	}
 
+	if err := setProcessEnv(stagingInfo.GetEnv(processType(), command)); err != nil {
+		fmt.Fprint(os.Stderr, err.Error())
+		os.Exit(3)
+	}
+
 	runtime.GOMAXPROCS(1)
 	err = runProcess(dir, command, stagingInfo.GetEntrypointPrefix())
 	if err != nil {
@@ -72,6 +79,33 @@ func main() {
 	}
 }
 
+// processType is the process type the platform is starting, as it names it
+// in VCAP_APPLICATION. Tasks are not started as a process type, so it is
+// empty for them.
+func processType() string {
+	var vcapApplication struct {
+		ProcessType string `json:"process_type"`
+	}
+	// #nosec: G104 - without VCAP_APPLICATION there is no process type
+	json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &vcapApplication) //nolint:errcheck
+	return vcapApplication.ProcessType
+}
+
+// setProcessEnv sets the environment the buildpacks declared for the
+// process, leaving the variables the app already sets alone. The profile.d
+// scripts run afterwards, and still see and may change all of them.
+func setProcessEnv(processEnv map[string]string) error {
+	for name, value := range processEnv {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return fmt.Errorf("Unable to set %s environment variable: %v", name, err)
+		}
+	}
+	return nil
+}
+
 func unmarhsalStagingInfo() (buildpackrunner.DeaStagingInfo, error) {
 	stagingInfo := buildpackrunner.DeaStagingInfo{}
 	stagingInfoData, err := os.ReadFile(buildpackrunner.DeaStagingInfoFilename)
@@ -1,7 +1,10 @@
 package buildpackapplifecycle
 
 import (
-	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 )
 
 const (
@@ -12,43 +15,143 @@ const (
 	NoSupplyScriptFailMsg  = "Error: one of the buildpacks chosen to supply dependencies does not support multi-buildpack apps"
 	MissingFinalizeWarnMsg = "Warning: the last buildpack is not compatible with multi-buildpack apps and cannot make use of any dependencies supplied by the buildpacks specified before it"
 	FinalizeFailMsg        = "Failed to run finalize script"
+	TimeoutFailMsg         = "Buildpack script timed out"
+	StackFailMsg           = "Buildpack does not support the stack"
+	LaunchYMLFailMsg       = "Buildpack wrote an invalid launch.yml"
 	DETECT_FAIL_CODE       = 222
 	COMPILE_FAIL_CODE      = 223
 	RELEASE_FAIL_CODE      = 224
 	SUPPLY_FAIL_CODE       = 225
 	FINALIZE_FAIL_CODE     = 226
+	TIMEOUT_FAIL_CODE      = 227
+	STACK_FAIL_CODE        = 228
+	LAUNCH_YML_FAIL_CODE   = 229
 )
 
+const (
+	DetectPhase   = "detect"
+	SupplyPhase   = "supply"
+	FinalizePhase = "finalize"
+	CompilePhase  = "compile"
+	ReleasePhase  = "release"
+	StackPhase    = "stack"
+)
+
+var phaseExitCodes = map[string]int{
+	DetectPhase:   DETECT_FAIL_CODE,
+	SupplyPhase:   SUPPLY_FAIL_CODE,
+	FinalizePhase: FINALIZE_FAIL_CODE,
+	CompilePhase:  COMPILE_FAIL_CODE,
+	ReleasePhase:  RELEASE_FAIL_CODE,
+	StackPhase:    STACK_FAIL_CODE,
+}
+
+// StagingError is implemented by errors that know which staging phase failed,
+// for which buildpack, and the exit code the builder should report.
+type StagingError interface {
+	error
+	Phase() string
+	BuildpackKey() string
+	ExitCode() int
+	Unwrap() error
+}
+
+// PhaseExitCode returns the exit code reported when the given phase fails, or
+// 1 for an unknown phase.
+func PhaseExitCode(phase string) int {
+	if code, ok := phaseExitCodes[phase]; ok {
+		return code
+	}
+	return 1
+}
+
+// StagingFailure is the machine-readable description of a failed staging
+// written to result.json.
+type StagingFailure struct {
+	Phase        string `json:"phase,omitempty"`
+	BuildpackKey string `json:"buildpack_key,omitempty"`
+	Message      string `json:"message"`
+	Cause        string `json:"cause,omitempty"`
+	ExitCode     int    `json:"exit_code"`
+}
+
+func NewStagingFailure(err error) *StagingFailure {
+	failure := &StagingFailure{
+		Message:  RedactCredentials(err.Error()),
+		ExitCode: ExitCodeFromError(err),
+	}
+
+	if stagingErr := findStagingError(err); stagingErr != nil {
+		failure.Phase = stagingErr.Phase()
+		failure.BuildpackKey = RedactCredentials(stagingErr.BuildpackKey())
+		if cause := stagingErr.Unwrap(); cause != nil {
+			failure.Cause = RedactCredentials(cause.Error())
+		}
+	}
+
+	return failure
+}
+
 func ExitCodeFromError(err error) int {
-	errMsg := err.Error()
-	switch {
-	case strings.Contains(errMsg, DetectFailMsg):
-		return DETECT_FAIL_CODE
-	case strings.Contains(errMsg, CompileFailMsg):
-		return COMPILE_FAIL_CODE
-	case strings.Contains(errMsg, ReleaseFailMsg):
-		return RELEASE_FAIL_CODE
-	case strings.Contains(errMsg, SupplyFailMsg):
-		return SUPPLY_FAIL_CODE
-	case strings.Contains(errMsg, NoSupplyScriptFailMsg):
-		return SUPPLY_FAIL_CODE
-	case strings.Contains(errMsg, FinalizeFailMsg):
-		return FINALIZE_FAIL_CODE
-	default:
-		return 1
+	if stagingErr := findStagingError(err); stagingErr != nil {
+		return stagingErr.ExitCode()
 	}
+	return 1
+}
+
+// findStagingError returns the outermost error in the chain that is
+// attributed to a staging phase.
+func findStagingError(err error) StagingError {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if stagingErr, ok := err.(StagingError); ok && stagingErr.Phase() != "" {
+			return stagingErr
+		}
+	}
+	return nil
 }
 
 type LifecycleMetadata struct {
 	BuildpackKey      string              `json:"buildpack_key,omitempty"`
 	DetectedBuildpack string              `json:"detected_buildpack"`
 	Buildpacks        []BuildpackMetadata `json:"buildpacks"`
+	Compression       string              `json:"compression,omitempty"`
+}
+
+// DropletManifest lists every file packaged into a droplet. Digest is the
+// sha256 of the JSON encoding of Files, so two droplets with the same
+// contents have the same digest.
+type DropletManifest struct {
+	Digest string                `json:"digest"`
+	Files  []DropletManifestFile `json:"files"`
+}
+
+// ComputeDigest sets Digest from the files listed in the manifest.
+func (m *DropletManifest) ComputeDigest() error {
+	files, err := json.Marshal(m.Files)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(files)
+	m.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	return nil
+}
+
+type DropletManifestFile struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Mode       string `json:"mode"`
+	SHA256     string `json:"sha256,omitempty"`
+	LinkTarget string `json:"link_target,omitempty"`
 }
 
 type BuildpackMetadata struct {
 	Key            string           `json:"key" yaml:"key"`
 	Name           string           `json:"name" yaml:"name"`
 	Version        string           `json:"version,omitempty" yaml:"version,omitempty"`
+	Language       string           `json:"language,omitempty" yaml:"-"`
+	Digest         string           `json:"digest,omitempty" yaml:"-"`
+	Commit         string           `json:"commit,omitempty" yaml:"-"`
 	Config         *BuildpackConfig `json:"config,omitempty" yaml:"config,omitempty"`
 	OutputMetadata map[string]any   `json:"output_metadata,omitempty" yaml:"output_metadata,omitempty"`
 }
@@ -59,25 +162,70 @@ type BuildpackConfig struct {
 
 type ProcessTypes map[string]string
 
+// The kinds of ProcessSource, in the order in which staging merges them.
+const (
+	ProcessSourceLaunchYML = "launch.yml"
+	ProcessSourceRelease   = "release"
+	ProcessSourceProcfile  = "Procfile"
+)
+
+// ProcessSource tells where a process or sidecar was defined: in the
+// launch.yml of a buildpack, by the release script of the final buildpack,
+// or in the app's Procfile. Replaced is where the definition it took the
+// place of came from, if any.
+type ProcessSource struct {
+	Kind      string         `yaml:"kind" json:"kind"`
+	Buildpack string         `yaml:"buildpack,omitempty" json:"buildpack,omitempty"`
+	Replaced  *ProcessSource `yaml:"replaced,omitempty" json:"replaced,omitempty"`
+}
+
 type Sidecar struct {
-	Name         string   `yaml:"name" json:"name"`
-	ProcessTypes []string `yaml:"process_types" json:"process_types"`
-	Command      string   `yaml:"command" json:"command"`
-	Memory       int      `yaml:"memory,omitempty" json:"memory,omitempty"`
+	Name         string            `yaml:"name" json:"name"`
+	ProcessTypes []string          `yaml:"process_types" json:"process_types"`
+	Command      string            `yaml:"command" json:"command"`
+	Memory       int               `yaml:"memory,omitempty" json:"memory,omitempty"`
+	Env          map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	Source       *ProcessSource    `yaml:"source,omitempty" json:"source,omitempty"`
+}
+
+// The types of HealthCheck the platform knows.
+const (
+	HealthCheckPort    = "port"
+	HealthCheckProcess = "process"
+	HealthCheckHTTP    = "http"
+)
+
+// HealthCheck is how the platform tells that the instances of a process are
+// healthy. Endpoint is only for http health checks, and Timeout is in
+// seconds.
+type HealthCheck struct {
+	Type     string `yaml:"type" json:"type"`
+	Endpoint string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Timeout  int    `yaml:"timeout,omitempty" json:"timeout,omitempty"`
 }
 
+// Process is a process type of the app. HealthCheck, Instances, DiskQuota,
+// ReadinessCommand and Env are the defaults the buildpacks declared for it,
+// and are left out when they declared none.
 type Process struct {
-	Type    string `yaml:"type" json:"type"`
-	Command string `yaml:"command" json:"command"`
+	Type             string            `yaml:"type" json:"type"`
+	Command          string            `yaml:"command" json:"command"`
+	HealthCheck      *HealthCheck      `yaml:"health_check,omitempty" json:"health_check,omitempty"`
+	Instances        int               `yaml:"instances,omitempty" json:"instances,omitempty"`
+	DiskQuota        int               `yaml:"disk_quota,omitempty" json:"disk_quota,omitempty"`
+	ReadinessCommand string            `yaml:"readiness_command,omitempty" json:"readiness_command,omitempty"`
+	Env              map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	Source           *ProcessSource    `yaml:"source,omitempty" json:"source,omitempty"`
 }
 
 type StagingResult struct {
 	LifecycleMetadata `json:"lifecycle_metadata"`
 	ProcessTypes      `json:"process_types"`
-	ProcessList       []Process `json:"processes,omitempty"`
-	Sidecars          []Sidecar `json:"sidecars,omitempty"`
-	ExecutionMetadata string    `json:"execution_metadata"`
-	LifecycleType     string    `json:"lifecycle_type"`
+	ProcessList       []Process       `json:"processes,omitempty"`
+	Sidecars          []Sidecar       `json:"sidecars,omitempty"`
+	ExecutionMetadata string          `json:"execution_metadata"`
+	LifecycleType     string          `json:"lifecycle_type"`
+	Failure           *StagingFailure `json:"failure,omitempty"`
 }
 
 func UpdateStagingResult(result StagingResult, lifeMeta LifecycleMetadata) StagingResult {
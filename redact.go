@@ -0,0 +1,15 @@
+package buildpackapplifecycle
+
+import "regexp"
+
+// RedactedCredentials replaces the user info of URLs in redacted text.
+const RedactedCredentials = "***"
+
+var urlCredentials = regexp.MustCompile(`(?i)(https?://)[^/?#@\s]+@`)
+
+// RedactCredentials removes the user and password of every HTTP(S) URL in s,
+// e.g. buildpack URLs with embedded tokens, so that s can be logged or written
+// to result.json.
+func RedactCredentials(s string) string {
+	return urlCredentials.ReplaceAllString(s, "${1}"+RedactedCredentials+"@")
+}